@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Response writer recording status and size of the response.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+// Creates response writer recording status and size of the response.
+func newResponseRecorder(w http.ResponseWriter) *responseRecorder {
+	return &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+}
+
+// Records status and writes response header.
+func (rr *responseRecorder) WriteHeader(status int) {
+	rr.status = status
+	rr.ResponseWriter.WriteHeader(status)
+}
+
+// Writes response body, recording its size.
+func (rr *responseRecorder) Write(b []byte) (int, error) {
+	n, err := rr.ResponseWriter.Write(b)
+	rr.size += n
+	return n, err
+}
+
+// Flushes buffered response, when supported.
+func (rr *responseRecorder) Flush() {
+	if f, ok := rr.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Returns the wrapped response writer, for use by http.ResponseController.
+func (rr *responseRecorder) Unwrap() http.ResponseWriter {
+	return rr.ResponseWriter
+}
+
+// Writes access log line in Apache combined log format.
+func writeCombinedLogLine(b *strings.Builder, lr *loggedRequest) {
+	r := lr.request
+
+	username := "-"
+	if r.URL.User != nil && r.URL.User.Username() != "" {
+		username = r.URL.User.Username()
+	}
+
+	b.WriteString(clientIP(r))
+	b.WriteString(" - ")
+	writeQuoted(b, username)
+	b.WriteString(lr.start.Format(" [02/Jan/2006:15:04:05 -0700] \""))
+	b.WriteString(r.Method)
+	b.WriteByte(' ')
+	writeQuoted(b, lr.uri)
+	b.WriteByte(' ')
+	b.WriteString(r.Proto)
+	b.WriteString("\" ")
+	b.WriteString(strconv.Itoa(lr.response.status))
+	b.WriteByte(' ')
+	b.WriteString(strconv.Itoa(lr.response.size))
+	b.WriteString(" \"")
+	writeQuoted(b, r.Referer())
+	b.WriteString("\" \"")
+	writeQuoted(b, r.UserAgent())
+	b.WriteByte('"')
+}
+
+// Replaces values of scrubbed parameters in raw query with "[redacted]".
+// Parameter names are matched case-insensitively, all occurrences of repeated
+// parameters are redacted.
+func scrubQuery(rawQuery string) string {
+	if rawQuery == "" || len(*scrubQueryParams) == 0 {
+		return rawQuery
+	}
+
+	params := strings.Split(rawQuery, "&")
+	for i, param := range params {
+		rawName, _, _ := strings.Cut(param, "=")
+
+		name, err := url.QueryUnescape(rawName)
+		if err != nil {
+			name = rawName
+		}
+
+		for _, scrubbed := range *scrubQueryParams {
+			if strings.EqualFold(name, scrubbed) {
+				params[i] = rawName + "=[redacted]"
+				break
+			}
+		}
+	}
+
+	return strings.Join(params, "&")
+}
+
+// JSON access log record.
+type accessLogRecord struct {
+	Timestamp  string  `json:"timestamp"`
+	RemoteAddr string  `json:"remote_addr"`
+	Method     string  `json:"method"`
+	Path       string  `json:"path"`
+	Query      string  `json:"query"`
+	Status     int     `json:"status"`
+	Bytes      int     `json:"bytes"`
+	Referer    string  `json:"referer"`
+	UserAgent  string  `json:"user_agent"`
+	DurationMs float64 `json:"duration_ms"`
+	TraceID    string  `json:"trace_id,omitempty"`
+	RequestID  string  `json:"request_id,omitempty"`
+}
+
+// Access logger writing lines in configured format: Apache combined log format,
+// JSON or custom template.
+type accessLogger struct {
+	out      io.Writer
+	format   string
+	template logTemplate
+}
+
+// Creates access logger writing to given writer, failing on invalid template
+// or sample rate.
+func newAccessLogger(out io.Writer) (*accessLogger, error) {
+	if *accessLogSampleRate < 0 || *accessLogSampleRate > 1 {
+		return nil, fmt.Errorf("access log sample rate %v out of range [0, 1]", *accessLogSampleRate)
+	}
+
+	l := &accessLogger{out: out, format: *accessLogFormat}
+
+	if *accessLogTemplate != "" {
+		template, err := parseLogTemplate(*accessLogTemplate)
+		if err != nil {
+			return nil, err
+		}
+		l.format, l.template = "template", template
+	}
+
+	return l, nil
+}
+
+// Wraps handler with access logging. Values of scrubbed query parameters are
+// redacted in the logged request, while the handler sees the original ones.
+// Requests of debug handlers are not logged.
+func (l *accessLogger) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if debugPath(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		uri := r.RequestURI
+		if uri == "" {
+			uri = r.URL.RequestURI()
+		}
+
+		if rawPath, rawQuery, ok := strings.Cut(uri, "?"); ok {
+			uri = rawPath + "?" + scrubQuery(rawQuery)
+		}
+
+		lr := &loggedRequest{
+			request:  r,
+			response: newResponseRecorder(w),
+			start:    time.Now(),
+			uri:      uri,
+			path:     r.URL.Path,
+			query:    scrubQuery(r.URL.RawQuery),
+		}
+
+		next.ServeHTTP(lr.response, r)
+
+		lr.duration = time.Since(lr.start)
+		recentRequests.record(lr)
+
+		if !l.sampled(lr) {
+			logSampledOutLines.Inc()
+			return
+		}
+		l.log(lr)
+	})
+}
+
+// Checks whether served request is to be logged. Requests with other than
+// 2xx status are always logged, successful ones are sampled deterministically
+// by hash of remote address and start time of the request, at sample rate in
+// effect.
+func (l *accessLogger) sampled(lr *loggedRequest) bool {
+	sampleRate := currentConfig().accessLogSampleRate
+	if sampleRate >= 1 || lr.response.status < 200 || lr.response.status >= 300 {
+		return true
+	}
+
+	h := fnv.New64a()
+	h.Write([]byte(lr.request.RemoteAddr))
+	h.Write(binary.BigEndian.AppendUint64(nil, uint64(lr.start.UnixNano())))
+
+	return float64(h.Sum64())/math.MaxUint64 < sampleRate
+}
+
+// Writes access log line of served request.
+func (l *accessLogger) log(lr *loggedRequest) {
+	var line []byte
+
+	if l.format == "json" {
+		var err error
+		line, err = json.Marshal(accessLogRecord{
+			Timestamp:  lr.start.Format(time.RFC3339Nano),
+			RemoteAddr: clientIP(lr.request),
+			Method:     lr.request.Method,
+			Path:       lr.path,
+			Query:      lr.query,
+			Status:     lr.response.status,
+			Bytes:      lr.response.size,
+			Referer:    lr.request.Referer(),
+			UserAgent:  lr.request.UserAgent(),
+			DurationMs: float64(lr.duration.Microseconds()) / 1000,
+			TraceID:    traceID(lr.request.Context()),
+			RequestID:  requestID(lr.request.Context()),
+		})
+		if err != nil {
+			slog.Warn("log: Access log line not written", "error", err)
+			return
+		}
+	} else if l.format == "combined" {
+		var b strings.Builder
+		writeCombinedLogLine(&b, lr)
+		line = []byte(b.String())
+	} else {
+		var b strings.Builder
+		for _, segment := range l.template {
+			segment(&b, lr)
+		}
+		line = []byte(b.String())
+	}
+
+	if _, err := l.out.Write(append(line, '\n')); err != nil {
+		slog.Warn("log: Access log line not written", "error", err)
+	}
+}
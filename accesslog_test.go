@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// Creates logged request of given remote address, start time and status.
+func newLoggedRequest(remoteAddr string, start time.Time, status int) *loggedRequest {
+	r := httptest.NewRequest("GET", "/track", nil)
+	r.RemoteAddr = remoteAddr
+	return &loggedRequest{request: r, response: &responseRecorder{status: status}, start: start}
+}
+
+func TestAccessLogSamplingDeterministic(t *testing.T) {
+	parseFlags(t, "--access-log-sample-rate=0.25")
+
+	l, err := newAccessLogger(io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	var sampled int
+	for i := 0; i < 2000; i++ {
+		lr := newLoggedRequest(fmt.Sprintf("198.51.100.%d:%d", i%256, 1024+i), start.Add(time.Duration(i)*time.Millisecond), http.StatusOK)
+
+		decision := l.sampled(lr)
+		for j := 0; j < 3; j++ {
+			if l.sampled(lr) != decision {
+				t.Fatalf("sampling of request %d not deterministic", i)
+			}
+		}
+		if decision {
+			sampled++
+		}
+	}
+
+	if sampled < 400 || sampled > 600 {
+		t.Errorf("%d of 2000 requests sampled, want about 500", sampled)
+	}
+}
+
+func TestAccessLogSamplingAlwaysLogsErrors(t *testing.T) {
+	parseFlags(t, "--access-log-sample-rate=0")
+
+	l, err := newAccessLogger(io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	for _, status := range []int{http.StatusOK, http.StatusNoContent, http.StatusNotModified, http.StatusNotFound, http.StatusTooManyRequests, http.StatusServiceUnavailable} {
+		want := status < 200 || status >= 300
+		if got := l.sampled(newLoggedRequest("198.51.100.1:1024", start, status)); got != want {
+			t.Errorf("request of status %d sampled %v, want %v", status, got, want)
+		}
+	}
+}
+
+func TestAccessLogSampledOutLinesCounted(t *testing.T) {
+	parseFlags(t, "--access-log-sample-rate=0")
+
+	var b strings.Builder
+	l, err := newAccessLogger(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := l.handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+		}
+	}))
+
+	before := testutil.ToFloat64(logSampledOutLines)
+
+	for _, path := range []string{"/track", "/track", "/missing"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	if got := testutil.ToFloat64(logSampledOutLines) - before; got != 2 {
+		t.Errorf("%v sampled out lines counted, want 2", got)
+	}
+	if lines := strings.Count(b.String(), "\n"); lines != 1 || !strings.Contains(b.String(), "/missing") {
+		t.Errorf("access log %q, want line of /missing only", b.String())
+	}
+}
+
+func TestAccessLogSampleRateOutOfRange(t *testing.T) {
+	for _, rate := range []string{"-0.1", "1.5"} {
+		parseFlags(t, "--access-log-sample-rate="+rate)
+
+		if _, err := newAccessLogger(io.Discard); err == nil {
+			t.Errorf("sample rate %s accepted", rate)
+		}
+	}
+}
+
+func TestImageServedLogScrubsQuery(t *testing.T) {
+	servers, _, _ := newTestServers(t, "--scrub-query-param=email")
+
+	var b lockedBuffer
+	previous := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&b, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+
+	servers[0].Handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/track?email=jane%40example.com&c=spring", nil))
+
+	if log := b.String(); !strings.Contains(log, "query=\"email=[redacted]&c=spring\"") || strings.Contains(log, "example.com") {
+		t.Errorf("service log %q, want query scrubbed", log)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"sync/atomic"
+	"time"
+)
+
+// Keys of request context values.
+type contextKey int
+
+const (
+	realClientIPKey contextKey = iota
+	requestIDKey
+)
+
+// Clock of daily salt rotation.
+var saltClock = time.Now
+
+// Creates client IP anonymizer of configured mode: truncate zeroes the last
+// octet of IPv4 and the last 80 bits of IPv6 addresses, hash replaces address
+// with its HMAC-SHA256 keyed with salt. Nil when anonymization is disabled.
+func newIPAnonymizer() (func(netip.Addr) string, error) {
+	switch *anonymizeIP {
+	case "truncate":
+		return truncateIP, nil
+	case "hash":
+		if *ipHashSalt == "" {
+			return nil, errors.New("anonymize: --ip-hash-salt is required to hash IPs")
+		}
+		if *ipHashSaltRotation == "daily" {
+			salt := newDailySalt([]byte(*ipHashSalt), saltClock)
+			return func(addr netip.Addr) string { return hashIP(addr, salt.current()) }, nil
+		}
+		salt := []byte(*ipHashSalt)
+		return func(addr netip.Addr) string { return hashIP(addr, salt) }, nil
+	}
+	return nil, nil
+}
+
+// Salt derived from secret and current UTC date, so that hashes are linkable
+// within a single day only. Rotated at midnight UTC.
+type dailySalt struct {
+	secret []byte
+	now    func() time.Time
+	period atomic.Pointer[saltPeriod]
+}
+
+// Salt of a single day.
+type saltPeriod struct {
+	date string
+	salt []byte
+}
+
+// Creates daily salt derived from secret, with dates taken from given clock.
+func newDailySalt(secret []byte, now func() time.Time) *dailySalt {
+	return &dailySalt{secret: secret, now: now}
+}
+
+// Returns salt of current day, rotating it when the day has changed. Salt is
+// never rotated back to an earlier day, e.g. by request having read the clock
+// just before midnight, its salt being returned only.
+func (s *dailySalt) current() []byte {
+	date := s.now().UTC().Format("2006-01-02")
+
+	period := s.period.Load()
+	if period != nil && period.date == date {
+		return period.salt
+	}
+
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(date))
+	next := &saltPeriod{date: date, salt: mac.Sum(nil)}
+
+	if period != nil && period.date > date {
+		return next.salt
+	}
+
+	if s.period.CompareAndSwap(period, next) {
+		slog.Info("anonymize: IP hash salt rotated", "date", date)
+		return next.salt
+	}
+
+	// Rotated concurrently, to the same salt unless the day changed meanwhile.
+	return s.period.Load().salt
+}
+
+// Truncates IP address to its /24 (IPv4) or /48 (IPv6) network address.
+func truncateIP(addr netip.Addr) string {
+	bits := 24
+	if addr.Is6() {
+		bits = 48
+	}
+
+	prefix, _ := addr.Prefix(bits)
+	return prefix.Addr().String()
+}
+
+// Hashes IP address with HMAC-SHA256 keyed with salt, shortened to 128 bits.
+func hashIP(addr netip.Addr, salt []byte) string {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(addr.AsSlice())
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// Wraps handler so that remote address of requests is anonymized, for all that
+// follows: access log, events and the like. The real client IP is kept in
+// request context for internal use only, e.g. rate limiting. No-op when
+// anonymizer is nil.
+func anonymizeClientAddress(next http.Handler, anonymize func(netip.Addr) string) http.Handler {
+	if anonymize == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		addr, ok := parseHostIP(r.RemoteAddr)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		r = r.WithContext(context.WithValue(r.Context(), realClientIPKey, addr.String()))
+		r.RemoteAddr = anonymize(addr)
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Returns real client IP of request, i.e. not anonymized, for internal use.
+func realClientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(realClientIPKey).(string); ok {
+		return ip
+	}
+	return clientIP(r)
+}
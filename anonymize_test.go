@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"log/slog"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Freezes clock of daily salt rotation at given time, returning function
+// moving it to another time. Clock is restored once test ends.
+func freezeSaltClock(t *testing.T, at time.Time) func(time.Time) {
+	t.Helper()
+
+	var now atomic.Pointer[time.Time]
+	now.Store(&at)
+
+	saltClock = func() time.Time { return *now.Load() }
+	t.Cleanup(func() { saltClock = time.Now })
+
+	return func(at time.Time) { now.Store(&at) }
+}
+
+// Captures service log records, restoring default logger once test ends.
+func captureServiceLog(t *testing.T) *lockedBuffer {
+	t.Helper()
+
+	var b lockedBuffer
+	previous := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&b, nil)))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+
+	return &b
+}
+
+// Buffer safe for concurrent writes.
+type lockedBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.String()
+}
+
+// Returns hash of address with salt of given date derived from secret.
+func dailyHash(addr netip.Addr, secret, date string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(date))
+	return hashIP(addr, mac.Sum(nil))
+}
+
+func TestDailySaltRotatesAtMidnight(t *testing.T) {
+	setClock := freezeSaltClock(t, time.Date(2026, 3, 1, 23, 59, 59, 999e6, time.UTC))
+	log := captureServiceLog(t)
+	parseFlags(t, "--anonymize-ip=hash", "--ip-hash-salt=secret", "--ip-hash-salt-rotation=daily")
+
+	anonymize, err := newIPAnonymizer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := netip.MustParseAddr("198.51.100.7")
+
+	before := anonymize(addr)
+	if want := dailyHash(addr, "secret", "2026-03-01"); before != want {
+		t.Fatalf("hash before midnight %s, want %s", before, want)
+	}
+	if again := anonymize(addr); again != before {
+		t.Errorf("hash within the same day changed from %s to %s", before, again)
+	}
+
+	setClock(time.Date(2026, 3, 2, 0, 0, 0, 0, time.UTC))
+
+	after := anonymize(addr)
+	if want := dailyHash(addr, "secret", "2026-03-02"); after != want {
+		t.Fatalf("hash after midnight %s, want %s", after, want)
+	}
+	if after == before {
+		t.Error("hash not changed at midnight")
+	}
+
+	// Dates are of UTC, regardless of time zone of the clock.
+	setClock(time.Date(2026, 3, 2, 1, 0, 0, 0, time.FixedZone("UTC+2", 2*60*60)))
+	if got := anonymize(addr); got != before {
+		t.Errorf("hash of 23:00 UTC of previous day %s, want %s", got, before)
+	}
+
+	// Salt of earlier day is not rotated back to.
+	if n := strings.Count(log.String(), "IP hash salt rotated"); n != 2 {
+		t.Errorf("salt rotation logged %d times, want 2:\n%s", n, log)
+	}
+	if !strings.Contains(log.String(), "date=2026-03-02") {
+		t.Errorf("salt rotation of 2026-03-02 not logged:\n%s", log)
+	}
+}
+
+func TestDailySaltConcurrentRotation(t *testing.T) {
+	setClock := freezeSaltClock(t, time.Date(2026, 3, 1, 23, 59, 59, 0, time.UTC))
+	log := captureServiceLog(t)
+
+	salt := newDailySalt([]byte("secret"), saltClock)
+	addr := netip.MustParseAddr("2001:db8::1")
+	before, after := dailyHash(addr, "secret", "2026-03-01"), dailyHash(addr, "secret", "2026-03-02")
+
+	if got := hashIP(addr, salt.current()); got != before {
+		t.Fatalf("hash before midnight %s, want %s", got, before)
+	}
+
+	var wg sync.WaitGroup
+	var crossed atomic.Bool
+	start := make(chan struct{})
+	errs := make(chan string, 64)
+
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			for j := 0; j < 1000; j++ {
+				late := crossed.Load()
+				got := hashIP(addr, salt.current())
+				if got != before && got != after || late && got != after {
+					errs <- got
+					return
+				}
+			}
+		}()
+	}
+
+	close(start)
+	setClock(time.Date(2026, 3, 2, 0, 0, 0, 0, time.UTC))
+	crossed.Store(true)
+	wg.Wait()
+	close(errs)
+
+	for got := range errs {
+		t.Errorf("hash %s, want %s before midnight or %s after it", got, before, after)
+	}
+
+	if got := hashIP(addr, salt.current()); got != after {
+		t.Errorf("hash after midnight %s, want %s", got, after)
+	}
+	if n := strings.Count(log.String(), "IP hash salt rotated"); n != 2 {
+		t.Errorf("salt rotation logged %d times, want once per day:\n%s", n, log)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Size in bytes at which batch of buffered log lines is written right away.
+const asyncLogBatchSize = 64 * 1024
+
+// Log writer queueing lines into bounded buffer, written in batches by a
+// dedicated goroutine at least every flush interval. When the buffer is full
+// writes either block or drop lines.
+type asyncWriter struct {
+	out   io.Writer
+	lines chan []byte
+	drop  bool
+	done  chan struct{}
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+// Asynchronous log writers to flush on shutdown.
+var (
+	asyncWritersMu sync.Mutex
+	asyncWriters   []*asyncWriter
+)
+
+// Creates asynchronous writer buffering given number of lines, registered to be
+// flushed on shutdown.
+func newAsyncWriter(out io.Writer, size int, interval time.Duration, drop bool) *asyncWriter {
+	w := &asyncWriter{
+		out:   out,
+		lines: make(chan []byte, size),
+		drop:  drop,
+		done:  make(chan struct{}),
+	}
+
+	go w.run(interval)
+
+	asyncWritersMu.Lock()
+	asyncWriters = append(asyncWriters, w)
+	asyncWritersMu.Unlock()
+
+	return w
+}
+
+// Queues line to be written.
+func (w *asyncWriter) Write(b []byte) (int, error) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	if w.closed {
+		return w.out.Write(b)
+	}
+
+	line := append([]byte(nil), b...)
+
+	if w.drop {
+		select {
+		case w.lines <- line:
+		default:
+			logDroppedLines.Inc()
+		}
+	} else {
+		w.lines <- line
+	}
+
+	return len(b), nil
+}
+
+// Writes queued lines in batches until closed.
+func (w *asyncWriter) run(interval time.Duration) {
+	defer close(w.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var batch []byte
+
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if _, err := w.out.Write(batch); err != nil {
+			slog.Warn("log: Buffered log lines not written", "error", err)
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case line, ok := <-w.lines:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, line...)
+			if len(batch) >= asyncLogBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// Flushes queued lines and stops the writing goroutine; later writes go to the
+// underlying writer directly.
+func (w *asyncWriter) Close() error {
+	w.mu.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.lines)
+	}
+	w.mu.Unlock()
+
+	<-w.done
+	return nil
+}
+
+// Flushes all asynchronous log writers.
+func flushLogs() {
+	asyncWritersMu.Lock()
+	defer asyncWritersMu.Unlock()
+
+	for _, w := range asyncWriters {
+		w.Close()
+	}
+}
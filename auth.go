@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// Credentials required by endpoint: username and password of basic
+// authentication, or bearer token, none required when empty.
+type credentials struct {
+	username    string
+	password    string
+	bearerToken string
+}
+
+// Returns credentials required by metrics endpoint, failing when incomplete.
+func metricsCredentials() (credentials, error) {
+	c := credentials{*metricsUsername, *metricsPassword, *metricsBearerToken}
+	if (c.username == "") != (c.password == "") {
+		return c, errors.New("metrics username or password not given")
+	}
+	return c, nil
+}
+
+// Checks whether any credentials are required.
+func (c credentials) required() bool {
+	return c.password != "" || c.bearerToken != ""
+}
+
+// Checks whether request carries required credentials, either of them when
+// both basic authentication and bearer token are configured.
+func (c credentials) authorized(r *http.Request) bool {
+	if c.bearerToken != "" {
+		if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && secretsEqual(token, c.bearerToken) {
+			return true
+		}
+	}
+	if c.password != "" {
+		if username, password, ok := r.BasicAuth(); ok {
+			// Both are compared, so that timing does not tell which one is wrong.
+			usernameOK := secretsEqual(username, c.username)
+			passwordOK := secretsEqual(password, c.password)
+			return usernameOK && passwordOK
+		}
+	}
+	return false
+}
+
+// Compares secrets in constant time, regardless of their lengths.
+func secretsEqual(given, expected string) bool {
+	g, e := sha256.Sum256([]byte(given)), sha256.Sum256([]byte(expected))
+	return subtle.ConstantTimeCompare(g[:], e[:]) == 1
+}
+
+// Wraps handler of given realm with authentication: requests without required
+// credentials are answered with http 401, counted and logged. No-op when no
+// credentials are required.
+func requireAuth(realm string, c credentials, next http.Handler) http.Handler {
+	if !c.required() {
+		return next
+	}
+
+	challenge := `Bearer realm="` + realm + `"`
+	if c.password != "" {
+		challenge = `Basic realm="` + realm + `", charset="UTF-8"`
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !c.authorized(r) {
+			authFailures.WithLabelValues(realm).Inc()
+			slog.WarnContext(r.Context(), "auth: Authentication failed", "realm", realm, "remote", realClientIP(r), "path", r.URL.Path)
+
+			w.Header().Set("WWW-Authenticate", challenge)
+			http.Error(w, "Error 401 (Unauthorized)", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// States of circuit breaker, as exported by circuit state gauge.
+const (
+	circuitClosed = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+// Circuit breaker of event sink, opened after number of consecutive failed
+// deliveries, so that deliveries are not attempted for backoff duration. Then
+// a single delivery probes the sink, closing the circuit when it succeeds.
+type circuitBreaker struct {
+	name      string
+	threshold int
+	backoff   time.Duration
+
+	mu       sync.Mutex
+	state    int
+	failures int
+	since    time.Time
+}
+
+// Creates closed circuit breaker of named sink with configured threshold and
+// backoff.
+func newCircuitBreaker(name string) *circuitBreaker {
+	sinkCircuitState.WithLabelValues(name).Set(circuitClosed)
+
+	return &circuitBreaker{name: name, threshold: *sinkBreakerThreshold, backoff: *sinkBreakerBackoff}
+}
+
+// Checks whether delivery is allowed, i.e. circuit is closed or is probed once
+// backoff is over. Probe not resolved within backoff is probed anew.
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == circuitClosed {
+		return true
+	}
+	if time.Since(b.since) < b.backoff {
+		return false
+	}
+
+	b.setState(circuitHalfOpen)
+	slog.Info("sink: Circuit half-open, probing delivery", "sink", b.name)
+
+	return true
+}
+
+// Records successful delivery, closing the circuit.
+func (b *circuitBreaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures = 0
+	if b.state != circuitClosed {
+		b.setState(circuitClosed)
+		slog.Info("sink: Circuit closed", "sink", b.name)
+	}
+}
+
+// Records failed delivery, opening the circuit when probe fails or threshold
+// of consecutive failures is reached.
+func (b *circuitBreaker) failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	if b.threshold <= 0 || b.state == circuitOpen {
+		return
+	}
+	if b.state == circuitClosed && b.failures < b.threshold {
+		return
+	}
+
+	b.setState(circuitOpen)
+	slog.Warn("sink: Circuit opened", "sink", b.name, "failures", b.failures, "backoff", b.backoff)
+}
+
+// Sets state of circuit, as of now.
+func (b *circuitBreaker) setState(state int) {
+	b.state, b.since = state, time.Now()
+	sinkCircuitState.WithLabelValues(b.name).Set(float64(state))
+}
+
+// Checks whether circuit is closed.
+func (b *circuitBreaker) closed() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.state == circuitClosed
+}
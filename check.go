@@ -0,0 +1,277 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	kingpin "gopkg.in/alecthomas/kingpin.v2"
+)
+
+// Flags of paths of tracking routes, and of admin routes, served by the same
+// router unless admin listen address is given.
+var (
+	trackingPathFlags = []string{"tracking-url-path", "open-url-path", "click-url-path", "collect-url-path", "link-url-path", "script-url-path", "optout-url-path"}
+	adminPathFlags    = []string{"state-url-path", "metrics-url-path", "stats-url-path", "liveness-url-path", "readiness-url-path", "events-url-path"}
+)
+
+// Flags of files written to, whose directories must be writable, and of files
+// read, which must exist.
+var (
+	writtenFileFlags = []string{"access-log-path", "service-log-path", "event-log-path", "dead-letter-path", "sqlite-path"}
+	readFileFlags    = []string{"block-cidr-file", "allow-cidr-file", "image-path", "prefetch-signatures-file", "geoip-db-path", "pixel-id-file", "robots-path", "metric-label-allowlist-file", "link-map-file", "redirect-allowlist-file", "tls-cert-path", "tls-key-path"}
+)
+
+// Validates configuration of flags, environment and configuration file,
+// printing each problem found, without binding any sockets. Exits with status
+// 1 when there is any problem.
+func check() {
+	problems := checkConfig()
+
+	for _, err := range problems {
+		fmt.Fprintln(os.Stderr, "check:", err)
+	}
+	if len(problems) > 0 {
+		os.Exit(1)
+	}
+
+	fmt.Println("check: Configuration valid")
+}
+
+// Returns problems of configuration.
+func checkConfig() []error {
+	var problems []error
+	report := func(err error) {
+		if err != nil {
+			problems = append(problems, err)
+		}
+	}
+
+	problems = append(problems, checkURLPaths()...)
+
+	for _, name := range []string{"listen-address", "admin-listen-address", "acme-http-listen-address"} {
+		if addr := flagValue(name); addr != "" && (name != "acme-http-listen-address" || len(*acmeHosts) > 0) {
+			report(checkListenAddress(name, addr))
+		}
+	}
+	if *adminListenAddress != "" {
+		report(checkAddressCollisions([]*http.Server{{Addr: *listenAddress}, {Addr: *adminListenAddress}}))
+	}
+
+	for _, name := range writtenFileFlags {
+		if path := flagValue(name); path != "" {
+			report(checkWritable(name, path))
+		}
+	}
+	for _, name := range readFileFlags {
+		if path := flagValue(name); path != "" {
+			if _, err := os.Stat(path); err != nil {
+				report(fmt.Errorf("--%s: %w", name, err))
+			}
+		}
+	}
+
+	if len(*acmeHosts) == 0 {
+		_, err := initTLS(nil)
+		report(err)
+	}
+
+	for _, list := range []struct {
+		name  string
+		cidrs []string
+	}{
+		{"trusted-proxy-cidr", *trustedProxyCIDRs},
+		{"real-ip-trusted-cidr", *realIPTrustedCIDRs},
+		{"proxy-protocol-allowed-source", *proxyProtocolAllowedSources},
+	} {
+		if _, err := parsePrefixes(list.cidrs); err != nil {
+			report(fmt.Errorf("--%s: %w", list.name, err))
+		}
+	}
+	report(initSources())
+	report(flagConfig().validate())
+
+	_, err := metricsCredentials()
+	report(err)
+	_, err = newIPAnonymizer()
+	report(err)
+	_, err = newAccessLogger(io.Discard)
+	report(err)
+	_, err = parseDurationBuckets(*durationBuckets)
+	report(err)
+	_, err = parseDiskLimit(*minFreeDiskLimit)
+	report(err)
+	report(initResponseHeaders())
+	report(initEventFields())
+	report(initCookies())
+
+	return problems
+}
+
+// Path of route, possibly ending with path segment variable, and source it is
+// derived from, flag or route of fixed path.
+type routePath struct {
+	path   string
+	source string
+}
+
+// Returns paths of tracking routes, as registered by initServer.
+func trackingRoutePaths() []routePath {
+	track := strings.TrimSuffix(*trackingURLPath, "/")
+
+	paths := []routePath{
+		{*trackingURLPath, "--tracking-url-path"},
+		{track + ".gif", "--tracking-url-path"},
+		{track + ".png", "--tracking-url-path"},
+		{track + ".webp", "--tracking-url-path"},
+		{track + "/{pixel_id}", "--tracking-url-path"},
+		{strings.TrimSuffix(*openURLPath, "/") + "/{message_id}", "--open-url-path"},
+		{*scriptURLPath, "--script-url-path"},
+		{*clickURLPath, "--click-url-path"},
+		{*collectURLPath, "--collect-url-path"},
+		{strings.TrimSuffix(*collectURLPath, "/") + "/batch", "--collect-url-path"},
+		{strings.TrimSuffix(*linkURLPath, "/") + "/{link_id}", "--link-url-path"},
+	}
+	if *optOutURLPath != "" {
+		paths = append(paths,
+			routePath{*optOutURLPath, "--optout-url-path"},
+			routePath{strings.TrimSuffix(*optOutURLPath, "/") + "/status", "--optout-url-path"})
+	}
+	if *serveRobotsEnabled {
+		paths = append(paths, routePath{"/robots.txt", "robots route"}, routePath{"/favicon.ico", "robots route"})
+	}
+
+	return paths
+}
+
+// Returns paths of admin routes, as registered by initServer.
+func adminRoutePaths() []routePath {
+	paths := []routePath{
+		{*stateURLPath, "--state-url-path"},
+		{*metricsURLPath, "--metrics-url-path"},
+	}
+	for _, name := range []string{"liveness-url-path", "readiness-url-path"} {
+		if path := flagValue(name); path != "" {
+			paths = append(paths, routePath{path, "--" + name})
+		}
+	}
+	if c, err := metricsCredentials(); *adminListenAddress != "" || (err == nil && c.required()) {
+		paths = append(paths, routePath{"/-/reload", "reload route"})
+	}
+	if *statsURLPath != "" {
+		paths = append(paths,
+			routePath{*statsURLPath, "--stats-url-path"},
+			routePath{strings.TrimSuffix(*statsURLPath, "/") + "/top", "--stats-url-path"})
+	}
+	if *enableDashboard {
+		paths = append(paths, routePath{*dashboardURLPath, "--dashboard-url-path"})
+	}
+	if slices.Contains(*sinks, "sqlite") {
+		paths = append(paths, routePath{*eventsURLPath, "--events-url-path"})
+	}
+	if *enableEventStream {
+		paths = append(paths, routePath{strings.TrimSuffix(*eventsURLPath, "/") + "/stream", "--events-url-path"})
+	}
+
+	return paths
+}
+
+// Checks whether path of route matches path of other route: paths are equal,
+// or one ends with path segment variable matching last segment of the other.
+func (p routePath) collides(other routePath) bool {
+	if p.path == other.path {
+		return true
+	}
+	for _, pair := range [][2]string{{p.path, other.path}, {other.path, p.path}} {
+		i := strings.LastIndex(pair[0], "/")
+		if !strings.HasPrefix(pair[0][i+1:], "{") {
+			continue
+		}
+		if segment, ok := strings.CutPrefix(pair[1], pair[0][:i+1]); ok && segment != "" && !strings.Contains(segment, "/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks that URL paths start with / and that paths of routes served by the
+// same router do not collide.
+func checkURLPaths() []error {
+	var errs []error
+
+	names := append(append([]string{}, trackingPathFlags...), adminPathFlags...)
+	if *enableDashboard {
+		names = append(names, "dashboard-url-path")
+	}
+	for _, name := range names {
+		if path := flagValue(name); path != "" && !strings.HasPrefix(path, "/") {
+			errs = append(errs, fmt.Errorf("--%s: path %q does not start with /", name, path))
+		}
+	}
+
+	groups := [][]routePath{trackingRoutePaths(), adminRoutePaths()}
+	if *adminListenAddress == "" {
+		groups = [][]routePath{append(groups[0], groups[1]...)}
+	}
+
+	for _, group := range groups {
+		for i, p := range group {
+			for _, other := range group[:i] {
+				if p.source != other.source && p.collides(other) {
+					errs = append(errs, fmt.Errorf("%s: path %q collides with path %q of %s", p.source, p.path, other.path, other.source))
+				}
+			}
+		}
+	}
+
+	return errs
+}
+
+// Checks that listen address is either of Unix domain socket or host and port.
+func checkListenAddress(name, addr string) error {
+	if path, ok := strings.CutPrefix(addr, unixAddressPrefix); ok {
+		if path == "" {
+			return fmt.Errorf("--%s: socket path not given", name)
+		}
+		return nil
+	}
+
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("--%s: %w", name, err)
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		if _, err := net.LookupPort("tcp", port); err != nil {
+			return fmt.Errorf("--%s: invalid port %q", name, port)
+		}
+	}
+	return nil
+}
+
+// Checks that file at path can be opened for writing, created in its
+// directory when it does not exist, and removed again then.
+func checkWritable(name, path string) error {
+	_, statErr := os.Stat(path)
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("--%s: %w", name, err)
+	}
+	f.Close()
+
+	if errors.Is(statErr, os.ErrNotExist) {
+		os.Remove(path)
+	}
+	return nil
+}
+
+// Returns value of flag by its name.
+func flagValue(name string) string {
+	return kingpin.CommandLine.GetFlag(name).Model().Value.String()
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckConfigValidatesReloadableSettings(t *testing.T) {
+	tests := []struct {
+		args    []string
+		problem string
+	}{
+		{[]string{"--rate-limit=1", "--rate-burst=0"}, "rate burst 0 not positive"},
+		{[]string{"--health-fall=0"}, "health fall 0 and rise 1 not both positive"},
+		{[]string{"--state-file-max-age=-1s"}, "state file max age -1s negative"},
+	}
+
+	for _, tt := range tests {
+		parseFlags(t, tt.args...)
+
+		var found bool
+		for _, err := range checkConfig() {
+			found = found || strings.Contains(err.Error(), tt.problem)
+		}
+		if !found {
+			t.Errorf("problem %q of %q not reported", tt.problem, tt.args)
+		}
+	}
+}
+
+func TestCheckConfigValid(t *testing.T) {
+	parseFlags(t)
+
+	if problems := checkConfig(); len(problems) > 0 {
+		t.Errorf("problems %q of default configuration", problems)
+	}
+}
+
+func TestCheckURLPathsOfRegisteredRoutes(t *testing.T) {
+	tests := []struct {
+		args      []string
+		collision string
+	}{
+		{[]string{"--click-url-path=/collect/batch"}, `path "/collect/batch" collides with path "/collect/batch" of --click-url-path`},
+		{[]string{"--click-url-path=/track.gif"}, `--click-url-path: path "/track.gif" collides with path "/track.gif" of --tracking-url-path`},
+		{[]string{"--click-url-path=/track/click"}, `--click-url-path: path "/track/click" collides with path "/track/{pixel_id}" of --tracking-url-path`},
+		{[]string{"--script-url-path=/robots.txt"}, `path "/robots.txt" collides with path "/robots.txt" of --script-url-path`},
+		{[]string{"--script-url-path=/optout/status"}, `path "/optout/status" collides with path "/optout/status" of --script-url-path`},
+		{[]string{"--metrics-url-path=/stats/top"}, `path "/stats/top" collides with path "/stats/top" of --metrics-url-path`},
+		{[]string{"--metrics-url-path=/-/reload", "--metrics-bearer-token=secret"}, `path "/-/reload" collides with path "/-/reload" of --metrics-url-path`},
+		{[]string{"--metrics-url-path=/events/stream", "--enable-event-stream"}, `path "/events/stream" collides with path "/events/stream" of --metrics-url-path`},
+	}
+
+	for _, tt := range tests {
+		parseFlags(t, tt.args...)
+
+		var found bool
+		for _, err := range checkURLPaths() {
+			found = found || strings.Contains(err.Error(), tt.collision)
+		}
+		if !found {
+			t.Errorf("collision %q of %q not reported, got %q", tt.collision, tt.args, checkURLPaths())
+		}
+	}
+}
+
+func TestCheckURLPathsOfRoutesNotRegistered(t *testing.T) {
+	for _, args := range [][]string{
+		{"--script-url-path=/robots.txt", "--no-serve-robots"},
+		{"--metrics-url-path=/-/reload"},
+		{"--click-url-path=/track/pixel/click"},
+	} {
+		parseFlags(t, args...)
+
+		if errs := checkURLPaths(); len(errs) > 0 {
+			t.Errorf("problems %q of %q", errs, args)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Creates ClickHouse sink inserting batches of events in JSONEachRow
+// format via HTTP interface.
+func newClickHouseSink() (eventSink, error) {
+	if *clickHouseURL == "" || *clickHouseTable == "" {
+		return nil, errors.New("clickhouse url or table not given")
+	}
+
+	insertURL, err := url.Parse(*clickHouseURL)
+	if err != nil {
+		return nil, err
+	}
+	params := insertURL.Query()
+	params.Set("query", "INSERT INTO "+*clickHouseTable+" FORMAT JSONEachRow")
+	params.Set("date_time_input_format", "best_effort")
+	insertURL.RawQuery = params.Encode()
+
+	client := &http.Client{Timeout: 30 * time.Second}
+
+	insert := func(ctx context.Context, body []byte) error {
+		req, err := http.NewRequestWithContext(ctx, "POST", insertURL.String(), bytes.NewReader(body))
+		if err != nil {
+			return &permanentError{err}
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode == http.StatusOK {
+			return nil
+		}
+
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		err = fmt.Errorf("clickhouse response status %d: %s", resp.StatusCode, bytes.TrimSpace(message))
+		if resp.StatusCode >= 400 && resp.StatusCode < 500 {
+			return &permanentError{err}
+		}
+		return err
+	}
+
+	settings := queueSettings{
+		batchSize:     *clickHouseBatchRows,
+		flushInterval: *sinkFlushInterval,
+		workers:       1,
+		overflow:      *sinkOverflow,
+	}
+
+	q, err := newEventQueue("clickhouse", settings, func(ctx context.Context, batch []queuedEvent) ([]queuedEvent, error) {
+		var body []byte
+		for _, e := range batch {
+			body = append(append(body, e.line...), '\n')
+		}
+
+		if err := insert(ctx, body); err != nil {
+			return batch, err
+		}
+		return nil, nil
+	}, func() error {
+		client.CloseIdleConnections()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	slog.Info("clickhouse: Inserting events", "url", insertURL.Redacted(), "table", *clickHouseTable)
+
+	return q, nil
+}
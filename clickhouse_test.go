@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestClickHouseFailuresSpooledBySinkQueue(t *testing.T) {
+	var inserts atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inserts.Add(1)
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	spool := t.TempDir()
+	parseFlags(t, "--clickhouse-url="+srv.URL, "--clickhouse-table=events", "--spool-dir="+spool)
+
+	sink, err := newClickHouseSink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := sink.(*eventQueue)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	defer q.Close(ctx)
+
+	if err := q.Write(ctx, &event{line: []byte(`{"pixel_id":"p"}`)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := inserts.Load(); got != 1 {
+		t.Errorf("%d inserts, want 1", got)
+	}
+
+	segments, err := filepath.Glob(filepath.Join(spool, "clickhouse", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var size int64
+	for _, path := range segments {
+		if info, err := os.Stat(path); err == nil {
+			size += info.Size()
+		}
+	}
+	if size == 0 {
+		t.Errorf("no events spooled in %q", segments)
+	}
+}
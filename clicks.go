@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Type of events of clicks.
+const clickEventType = "click"
+
+// Query parameters of click destination and of campaign.
+const (
+	clickURLParam      = "url"
+	clickCampaignParam = "cid"
+)
+
+// Query parameters of click requests not passed on to destination.
+var clickTrackingParams = []string{clickURLParam, clickCampaignParam, signatureParam, expiryParam, nonceParam}
+
+// Destinations clicks are allowed to redirect to: domains, including their
+// subdomains, and URL prefixes.
+type redirectAllowlist struct {
+	domains  []string
+	prefixes []*url.URL
+}
+
+// Allowed click destinations, none allowed when not loaded.
+var allowedRedirects atomic.Pointer[redirectAllowlist]
+
+// Loads allowed click destinations from configured file, reloaded whenever it
+// changes.
+func initRedirectAllowlist() error {
+	if *redirectAllowlistFile == "" {
+		return nil
+	}
+
+	modTime, err := loadRedirectAllowlist(*redirectAllowlistFile)
+	if err != nil {
+		return err
+	}
+
+	go watchFile(*redirectAllowlistFile, modTime, loadRedirectAllowlist)
+
+	return nil
+}
+
+// Reloads allowed click destinations, leaving ones loaded before in effect on
+// failure.
+func reloadRedirectAllowlist() {
+	if *redirectAllowlistFile == "" {
+		return
+	}
+
+	if _, err := loadRedirectAllowlist(*redirectAllowlistFile); err != nil {
+		slog.Warn("click: Redirect allowlist not reloaded", "path", *redirectAllowlistFile, "error", err)
+	}
+}
+
+// Loads allowed click destinations from file, one domain or URL prefix per
+// line, skipping empty lines and comments. Returned is modification time of
+// loaded file.
+func loadRedirectAllowlist(path string) (time.Time, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	allowlist := &redirectAllowlist{}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if !strings.Contains(line, "://") {
+			allowlist.domains = append(allowlist.domains, strings.ToLower(strings.TrimPrefix(line, ".")))
+			continue
+		}
+
+		prefix, err := url.Parse(line)
+		if err != nil || prefix.Host == "" {
+			return time.Time{}, fmt.Errorf("invalid redirect URL prefix %q", line)
+		}
+		allowlist.prefixes = append(allowlist.prefixes, prefix)
+	}
+	if err := scanner.Err(); err != nil {
+		return time.Time{}, err
+	}
+
+	allowedRedirects.Store(allowlist)
+
+	slog.Info("click: Redirect allowlist loaded", "path", path, "domains", len(allowlist.domains),
+		"prefixes", len(allowlist.prefixes))
+
+	return info.ModTime(), nil
+}
+
+// Checks whether destination is allowed: its host is an allowed domain or its
+// subdomain, or it has scheme and host of allowed URL prefix and path starting
+// with its path.
+func (a *redirectAllowlist) allows(dest *url.URL) bool {
+	host := strings.ToLower(dest.Hostname())
+
+	for _, domain := range a.domains {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+
+	for _, prefix := range a.prefixes {
+		if strings.EqualFold(dest.Scheme, prefix.Scheme) && strings.EqualFold(dest.Host, prefix.Host) &&
+			strings.HasPrefix(dest.EscapedPath(), prefix.EscapedPath()) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns destination of click request: url parameter, unescaped once more
+// when escaped twice, with query parameters of request other than tracking
+// ones appended as they are, since they belong to destination not escaped in
+// url parameter.
+func clickDestination(r *http.Request) (*url.URL, error) {
+	raw := r.URL.Query().Get(clickURLParam)
+	if !strings.Contains(raw, "://") {
+		if unescaped, err := url.QueryUnescape(raw); err == nil {
+			raw = unescaped
+		}
+	}
+
+	dest, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	if dest.Scheme != "http" && dest.Scheme != "https" || dest.Host == "" {
+		return nil, errors.New("destination is not http or https URL")
+	}
+
+	var extra []string
+	for _, pair := range strings.Split(r.URL.RawQuery, "&") {
+		key, _, _ := strings.Cut(pair, "=")
+		if key, err := url.QueryUnescape(key); pair == "" || err != nil || slices.Contains(clickTrackingParams, key) {
+			continue
+		}
+		extra = append(extra, pair)
+	}
+
+	if len(extra) > 0 {
+		if dest.RawQuery != "" {
+			dest.RawQuery += "&"
+		}
+		dest.RawQuery += strings.Join(extra, "&")
+	}
+
+	return dest, nil
+}
+
+// Serves click: records click event and redirects to destination, when it is
+// allowed. Clicks not signed, and requests of headers only, are redirected but
+// not recorded.
+func serveClick(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+
+	dest, err := clickDestination(r)
+	if err != nil {
+		serveClicks.WithLabelValues("invalid").Inc()
+		http.Error(w, "Error 400 (Invalid destination)", http.StatusBadRequest)
+		return
+	}
+
+	if allowlist := allowedRedirects.Load(); allowlist == nil || !allowlist.allows(dest) {
+		serveClicks.WithLabelValues("rejected").Inc()
+		slog.DebugContext(r.Context(), "click: Destination not allowed", "remote", clientIP(r), "destination", dest.Redacted())
+		http.Error(w, "Error 403 (Destination not allowed)", http.StatusForbidden)
+		return
+	}
+
+	if r.Method == "HEAD" {
+		http.Redirect(w, r, dest.String(), http.StatusFound)
+		return
+	}
+
+	if !signedRequest(r) {
+		serveClicks.WithLabelValues("unsigned").Inc()
+		http.Redirect(w, r, dest.String(), http.StatusFound)
+		return
+	}
+
+	duplicate := duplicateRequest(r)
+	if duplicate {
+		serveImageDuplicateRequests.Inc()
+	}
+
+	untracked := untrackedRequest(r)
+
+	if len(eventSinks) > 0 && !untracked {
+		e := newEvent(r)
+		e.Type = clickEventType
+		e.CampaignID = r.URL.Query().Get(clickCampaignParam)
+		e.Destination = dest.String()
+		e.Duplicate = duplicate
+		recordEvent(r.Context(), e)
+	}
+
+	serveClicks.WithLabelValues("redirected").Inc()
+	http.Redirect(w, r, dest.String(), http.StatusFound)
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Type of events collected from request bodies.
+const collectEventType = "collect"
+
+// Request body not collected, with http status and message of response and
+// label of collect requests metric.
+type collectError struct {
+	status  int
+	message string
+	label   string
+	err     error
+}
+
+func (e *collectError) Error() string { return e.err.Error() }
+
+// Reads fields of collect request body: JSON object, form-encoded or plain text
+// one, the latter being either, as sent by navigator.sendBeacon. Body is limited
+// to configured size.
+func readCollectBody(w http.ResponseWriter, r *http.Request) (url.Values, error) {
+	body, err := readBody(w, r)
+	if err != nil {
+		return nil, err
+	}
+
+	mediaType := "text/plain"
+	if contentType := r.Header.Get("Content-Type"); contentType != "" {
+		if mediaType, _, err = mime.ParseMediaType(contentType); err != nil {
+			return nil, &collectError{http.StatusUnsupportedMediaType, "Unsupported content type", "unsupported", err}
+		}
+	}
+
+	var fields url.Values
+
+	switch mediaType {
+	case "application/json":
+		fields, err = parseJSONFields(body)
+	case "text/plain":
+		if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '{' {
+			fields, err = parseJSONFields(trimmed)
+		} else {
+			fields, err = url.ParseQuery(string(trimmed))
+		}
+	case "application/x-www-form-urlencoded":
+		fields, err = url.ParseQuery(string(body))
+	default:
+		return nil, &collectError{http.StatusUnsupportedMediaType, "Unsupported content type", "unsupported", errors.New("unsupported content type " + mediaType)}
+	}
+	if err != nil {
+		return nil, &collectError{http.StatusBadRequest, "Malformed body", "malformed", err}
+	}
+
+	return fields, nil
+}
+
+// Reads request body, limited to configured size.
+func readBody(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, *maxBodyBytes))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return nil, &collectError{http.StatusRequestEntityTooLarge, "Body too large", "too_large", err}
+		}
+		return nil, &collectError{http.StatusBadRequest, "Malformed body", "malformed", err}
+	}
+	return body, nil
+}
+
+// Parses fields of JSON object: strings as they are, other values as JSON,
+// null ones skipped.
+func parseJSONFields(body []byte) (url.Values, error) {
+	if trimmed := bytes.TrimSpace(body); len(trimmed) == 0 || trimmed[0] != '{' {
+		return nil, errors.New("json object expected")
+	}
+
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(body, &object); err != nil {
+		return nil, err
+	}
+
+	fields := make(url.Values, len(object))
+	for k, raw := range object {
+		var s string
+		switch {
+		case string(raw) == "null":
+			continue
+		case json.Unmarshal(raw, &s) == nil:
+			fields.Add(k, s)
+		default:
+			var compact bytes.Buffer
+			json.Compact(&compact, raw)
+			fields.Add(k, compact.String())
+		}
+	}
+
+	return fields, nil
+}
+
+// Serves collect request: records event of query parameters merged with body
+// fields, answering 204.
+func serveCollect(w http.ResponseWriter, r *http.Request) {
+	defer trackServeImageDuration(r.Context(), time.Now(), "collect", "")
+
+	if !acceptCollect(w, r) {
+		return
+	}
+
+	fields, err := readCollectBody(w, r)
+	if err != nil {
+		rejectCollect(w, r, err)
+		return
+	}
+
+	collectEvent(r, fields)
+
+	serveCollectRequests.WithLabelValues("accepted").Inc()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Result of collecting element of batch of events.
+type collectResult struct {
+	Index  int    `json:"index"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Serves batch collect request: records event of each JSON object in array of
+// at most configured number of them, merged with query parameters, answering
+// 207 with per element results. Elements are accepted or rejected on their
+// own.
+func serveCollectBatch(w http.ResponseWriter, r *http.Request) {
+	defer trackServeImageDuration(r.Context(), time.Now(), "collect_batch", "")
+
+	if !acceptCollect(w, r) {
+		return
+	}
+
+	body, err := readBody(w, r)
+	if err != nil {
+		rejectCollect(w, r, err)
+		return
+	}
+
+	var elements []json.RawMessage
+	if err := json.Unmarshal(body, &elements); err != nil {
+		rejectCollect(w, r, &collectError{http.StatusBadRequest, "Malformed body", "malformed", err})
+		return
+	}
+	if len(elements) > *maxBatchEvents {
+		rejectCollect(w, r, &collectError{http.StatusBadRequest, "Too many events", "too_many_events",
+			fmt.Errorf("%d events over maximum of %d", len(elements), *maxBatchEvents)})
+		return
+	}
+
+	results := make([]collectResult, len(elements))
+	for i, element := range elements {
+		results[i].Index = i
+
+		fields, err := parseJSONFields(element)
+		if err != nil {
+			results[i].Status, results[i].Error = "rejected", err.Error()
+			serveCollectEvents.WithLabelValues("rejected").Inc()
+			continue
+		}
+
+		collectEvent(r, fields)
+
+		results[i].Status = "accepted"
+		serveCollectEvents.WithLabelValues("accepted").Inc()
+	}
+
+	serveCollectRequests.WithLabelValues("accepted").Inc()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusMultiStatus)
+
+	if err := json.NewEncoder(w).Encode(struct {
+		Results []collectResult `json:"results"`
+	}{results}); err != nil {
+		slog.DebugContext(r.Context(), "collect: Response not written", "path", r.URL.Path, "error", err)
+	}
+}
+
+// Sets headers of collect response and answers preflight and requests other
+// than POST. Returns whether request is to be collected.
+func acceptCollect(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+
+	switch r.Method {
+	case "OPTIONS":
+		w.WriteHeader(http.StatusNoContent)
+		return false
+	case "POST":
+	default:
+		methodNotAllowed(w, r, "POST", "OPTIONS")
+		return false
+	}
+
+	if shedLoad() {
+		serveImageRequestsShed.Inc()
+		http.Error(w, "Error 503 (Service overloaded)", http.StatusServiceUnavailable)
+		return false
+	}
+
+	return true
+}
+
+// Answers collect request not collected, counting it by its label.
+func rejectCollect(w http.ResponseWriter, r *http.Request, err error) {
+	var cerr *collectError
+	errors.As(err, &cerr)
+
+	serveCollectRequests.WithLabelValues(cerr.label).Inc()
+	slog.DebugContext(r.Context(), "collect: Body not collected", "remote", clientIP(r), "error", err)
+	http.Error(w, fmt.Sprintf("Error %d (%s)", cerr.status, cerr.message), cerr.status)
+}
+
+// Records event of collect request, of query parameters merged with given
+// fields.
+func collectEvent(r *http.Request, fields url.Values) {
+	query := r.URL.Query()
+	for k, values := range fields {
+		query[k] = append(query[k], values...)
+	}
+
+	duplicate := duplicateNonce(query.Get(nonceParam))
+	if duplicate {
+		serveImageDuplicateRequests.Inc()
+	}
+
+	untracked := untrackedRequest(r)
+
+	if len(eventSinks) > 0 && !untracked {
+		e := newEvent(r)
+		e.Type = collectEventType
+		if eventFields.query {
+			e.Query = query
+		}
+		e.Duplicate = duplicate
+		recordEvent(r.Context(), e)
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	kingpin "gopkg.in/alecthomas/kingpin.v2"
+	"gopkg.in/yaml.v3"
+)
+
+// Prefix of environment variables setting flags, followed by flag name in
+// upper case with dashes replaced by underscores.
+const envPrefix = "SERVE_AND_TRACK_"
+
+// Names of flags set by environment variables, logged once logs are
+// initialized, and values of flags given as arguments, by their names. Both
+// take precedence over configuration file on reload.
+var (
+	envFlags []string
+	argFlags map[string]string
+)
+
+// Flags whose values are secret, masked when configuration is logged.
+var secretFlags = map[string]bool{
+	"signing-secret":       true,
+	"ip-hash-salt":         true,
+	"metrics-password":     true,
+	"metrics-bearer-token": true,
+	"webhook-auth-header":  true,
+}
+
+// Loads configuration: of configuration file given by --config-file among
+// given arguments, or by its environment variable, and of environment
+// variables, setting defaults of flags, so that flags take precedence over
+// environment, and environment over the file.
+func loadConfig(args []string) error {
+	given := givenFlags(args)
+	argFlags, envFlags = given, nil
+
+	if err := loadConfigFile(cmp.Or(given["config-file"], os.Getenv(envName("config-file")))); err != nil {
+		return err
+	}
+
+	loadEnvironment(given)
+
+	return nil
+}
+
+// Returns name of environment variable setting flag.
+func envName(flag string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flag, "-", "_"))
+}
+
+// Returns values of flags given among arguments, by their names, last one of
+// repeated ones.
+func givenFlags(args []string) map[string]string {
+	given := map[string]string{}
+
+	if ctx, _ := kingpin.CommandLine.ParseContext(args); ctx != nil {
+		for _, e := range ctx.Elements {
+			if f, ok := e.Clause.(*kingpin.FlagClause); ok && e.Value != nil {
+				given[f.Model().Name] = *e.Value
+			}
+		}
+	}
+
+	return given
+}
+
+// Sets defaults of flags from their environment variables, unless flags are
+// among given ones. Values of repeatable flags are separated by commas, or by
+// newlines when there are any.
+func loadEnvironment(given map[string]string) {
+	for _, m := range kingpin.CommandLine.Model().Flags {
+		value := os.Getenv(envName(m.Name))
+		if value == "" || m.Name == "help" || m.Name == "version" {
+			continue
+		}
+
+		values := []string{value}
+		if cumulative(m) {
+			separator := ","
+			if strings.Contains(value, "\n") {
+				separator = "\n"
+			}
+			values = strings.Split(strings.TrimSuffix(value, separator), separator)
+		}
+
+		setFlagDefault(kingpin.CommandLine.GetFlag(m.Name), values...)
+
+		if _, ok := given[m.Name]; !ok {
+			envFlags = append(envFlags, m.Name)
+		}
+	}
+}
+
+// Sets defaults of flag to given values. Secret flags get placeholder of their
+// name, so that their values are not shown in usage.
+func setFlagDefault(f *kingpin.FlagClause, values ...string) {
+	if name := f.Model().Name; secretFlags[name] {
+		f.PlaceHolder(strings.ToUpper(name))
+	}
+	f.Default(values...)
+}
+
+// Checks whether flag is repeatable.
+func cumulative(m *kingpin.FlagModel) bool {
+	v, ok := m.Value.(interface{ IsCumulative() bool })
+	return ok && v.IsCumulative()
+}
+
+// Loads configuration file at given path, when given, setting defaults of
+// flags by its keys. Keys not naming flags are rejected.
+func loadConfigFile(path string) error {
+	if path == "" {
+		return nil
+	}
+
+	values, err := readConfigFile(path)
+	if err != nil {
+		return err
+	}
+
+	var unknown []string
+
+	for key, value := range values {
+		f := kingpin.CommandLine.GetFlag(key)
+		if f == nil || key == "config-file" || key == "help" || key == "version" {
+			unknown = append(unknown, key)
+			continue
+		}
+
+		defaults, err := configValues(value)
+		if err != nil {
+			return fmt.Errorf("%s: %s: %w", path, key, err)
+		}
+
+		if len(defaults) > 1 && !cumulative(f.Model()) {
+			return fmt.Errorf("%s: %s: single value expected", path, key)
+		}
+
+		setFlagDefault(f, defaults...)
+	}
+
+	if len(unknown) > 0 {
+		slices.Sort(unknown)
+		return fmt.Errorf("%s: unknown keys %s", path, strings.Join(unknown, ", "))
+	}
+
+	loadedConfigFile = values
+	return nil
+}
+
+// Reads configuration file, as YAML or TOML by its extension.
+func readConfigFile(path string) (map[string]any, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	values := map[string]any{}
+
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(b, &values)
+	case ".toml":
+		err = toml.Unmarshal(b, &values)
+	default:
+		return nil, fmt.Errorf("%s: unsupported configuration file extension", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return values, nil
+}
+
+// Returns flag values of configuration value: of scalar one, or of each
+// element of list, for repeatable flags.
+func configValues(value any) ([]string, error) {
+	switch v := value.(type) {
+	case nil:
+		return nil, errors.New("value not given")
+	case []any:
+		values := make([]string, 0, len(v))
+		for _, element := range v {
+			s, err := configScalar(element)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, s)
+		}
+		return values, nil
+	default:
+		s, err := configScalar(v)
+		if err != nil {
+			return nil, err
+		}
+		return []string{s}, nil
+	}
+}
+
+// Returns flag value of scalar configuration value.
+func configScalar(value any) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case bool, int, int64, uint64, float64:
+		return fmt.Sprint(v), nil
+	default:
+		return "", fmt.Errorf("scalar value expected, got %T", value)
+	}
+}
+
+// Logs effective configuration at debug level: values of all flags, with
+// secrets masked, as are passwords of URLs.
+func logEffectiveConfig() {
+	if !slog.Default().Enabled(context.Background(), slog.LevelDebug) {
+		return
+	}
+
+	var attrs []any
+	for _, f := range kingpin.CommandLine.Model().Flags {
+		if f.Name == "help" || f.Name == "version" {
+			continue
+		}
+		attrs = append(attrs, f.Name, maskConfigValue(f.Name, f.Value.String()))
+	}
+
+	slog.Debug("config: Effective configuration", attrs...)
+	if len(envFlags) > 0 {
+		slog.Debug("config: Flags set by environment", "flags", strings.Join(envFlags, ", "))
+	}
+}
+
+// Masks value of flag when it is secret or URL with password.
+func maskConfigValue(name, value string) string {
+	if value == "" || value == "[]" {
+		return value
+	}
+	if secretFlags[name] {
+		return "[redacted]"
+	}
+	if u, err := url.Parse(value); err == nil && u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			return u.Redacted()
+		}
+	}
+	return value
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+	kingpin "gopkg.in/alecthomas/kingpin.v2"
+	"gopkg.in/yaml.v3"
+)
+
+// Returns flags settable by configuration file: all but help, version, config
+// file itself and hidden ones.
+func configurableFlags() []*kingpin.FlagModel {
+	var flags []*kingpin.FlagModel
+	for _, m := range kingpin.CommandLine.Model().Flags {
+		if m.Hidden || m.Name == "help" || m.Name == "version" || m.Name == "config-file" {
+			continue
+		}
+		flags = append(flags, m)
+	}
+	return flags
+}
+
+// Returns options of enum flag.
+func enumOptions(m *kingpin.FlagModel) []string {
+	v := reflect.ValueOf(m.Value).Elem().FieldByName("options")
+	options := make([]string, v.Len())
+	for i := range options {
+		options[i] = v.Index(i).String()
+	}
+	return options
+}
+
+// Returns configuration value of flag, of its type, as native boolean, number
+// or list where applicable: the first of test values differs from default of the
+// flag, the second one from the first.
+func flagTestValue(t *testing.T, m *kingpin.FlagModel, second bool) any {
+	t.Helper()
+
+	pick := func(a, b any) any {
+		if second {
+			return b
+		}
+		return a
+	}
+
+	switch kind := fmt.Sprintf("%T", m.Value); kind {
+	case "*kingpin.boolValue":
+		set := !slices.Equal(m.Default, []string{"true"})
+		return pick(set, !set)
+	case "*kingpin.durationValue":
+		return pick("7s", "9m")
+	case "*kingpin.intValue", "*kingpin.int64Value", "*kingpin.uint64Value":
+		return pick(7, 9)
+	case "*kingpin.float64Value":
+		return pick(0.25, 0.75)
+	case "*kingpin.stringValue":
+		return pick("first-"+m.Name, "second-"+m.Name)
+	case "*kingpin.accumulator":
+		return pick([]any{"first", "second"}, []any{"third"})
+	case "*kingpin.enumValue":
+		var options []string
+		for _, o := range enumOptions(m) {
+			if !slices.Equal(m.Default, []string{o}) {
+				options = append(options, o)
+			}
+		}
+		if len(options) < 2 {
+			options = append(options, m.Default...)
+		}
+		return pick(options[0], options[1])
+	case "*kingpin.enumsValue":
+		options := enumOptions(m)
+		return pick([]any{options[0], options[1]}, []any{options[2]})
+	default:
+		t.Fatalf("flag %s of unknown kind %s", m.Name, kind)
+		return nil
+	}
+}
+
+// Returns arguments giving flags values of configuration, in order of names.
+func configArgs(values map[string]any) []string {
+	var args []string
+	for _, name := range slices.Sorted(maps.Keys(values)) {
+		switch v := values[name].(type) {
+		case bool:
+			if v {
+				args = append(args, "--"+name)
+			} else {
+				args = append(args, "--no-"+name)
+			}
+		case []any:
+			for _, element := range v {
+				args = append(args, fmt.Sprintf("--%s=%v", name, element))
+			}
+		default:
+			args = append(args, fmt.Sprintf("--%s=%v", name, v))
+		}
+	}
+	return args
+}
+
+// Writes configuration of given format, yaml or toml, to temporary directory,
+// returning its path.
+func writeConfigFile(t *testing.T, format string, values map[string]any) string {
+	t.Helper()
+
+	var b bytes.Buffer
+	var err error
+	switch format {
+	case "yaml":
+		err = yaml.NewEncoder(&b).Encode(values)
+	case "toml":
+		err = toml.NewEncoder(&b).Encode(values)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "config."+format)
+	if err := os.WriteFile(path, b.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// Returns values of configurable flags, as strings, other than those given by
+// parseFlags.
+func flagValues() map[string]string {
+	values := map[string]string{}
+	for _, m := range configurableFlags() {
+		if !slices.Contains(testFlags, m.Name) {
+			values[m.Name] = m.Value.String()
+		}
+	}
+	return values
+}
+
+// Loads configuration of given arguments and parses them, returning values of
+// flags.
+func loadAndParse(t *testing.T, args ...string) map[string]string {
+	t.Helper()
+
+	if err := loadConfig(args); err != nil {
+		t.Fatal(err)
+	}
+	parseFlags(t, args...)
+
+	return flagValues()
+}
+
+// Compares values of flags, failing on every difference.
+func compareFlagValues(t *testing.T, got, want map[string]string) {
+	t.Helper()
+
+	for name, value := range want {
+		if got[name] != value {
+			t.Errorf("flag %s is %q, want %q", name, got[name], value)
+		}
+	}
+}
+
+func TestConfigFileSetsEveryFlag(t *testing.T) {
+	for _, format := range []string{"yaml", "toml"} {
+		t.Run(format, func(t *testing.T) {
+			values := map[string]any{}
+			for _, m := range configurableFlags() {
+				values[m.Name] = flagTestValue(t, m, false)
+			}
+
+			want := loadAndParse(t, configArgs(values)...)
+
+			defaults := loadAndParse(t)
+			for name, value := range want {
+				if defaults[name] == value {
+					t.Errorf("test value %q of flag %s is its default", value, name)
+				}
+			}
+
+			got := loadAndParse(t, "--config-file="+writeConfigFile(t, format, values))
+			compareFlagValues(t, got, want)
+		})
+	}
+}
+
+func TestFlagsOverrideConfigFile(t *testing.T) {
+	for _, format := range []string{"yaml", "toml"} {
+		t.Run(format, func(t *testing.T) {
+			file, flags := map[string]any{}, map[string]any{}
+			for _, m := range configurableFlags() {
+				file[m.Name] = flagTestValue(t, m, false)
+				flags[m.Name] = flagTestValue(t, m, true)
+			}
+
+			want := loadAndParse(t, configArgs(flags)...)
+
+			args := append(configArgs(flags), "--config-file="+writeConfigFile(t, format, file))
+			got := loadAndParse(t, args...)
+			compareFlagValues(t, got, want)
+		})
+	}
+}
+
+func TestConfigFileRejectsUnknownKeys(t *testing.T) {
+	for _, values := range []map[string]any{
+		{"no-such-flag": "value"},
+		{"config-file": "other.yaml"},
+		{"listen-address": []any{":80", ":81"}},
+		{"rate-limit": map[string]any{"value": 1}},
+	} {
+		path := writeConfigFile(t, "yaml", values)
+		if err := loadConfig([]string{"--config-file=" + path}); err == nil {
+			t.Errorf("configuration %v accepted", values)
+		}
+		parseFlags(t)
+	}
+}
+
+func TestConfigValueOfTOMLNumbers(t *testing.T) {
+	path := writeConfigFile(t, "toml", map[string]any{"rate-limit": 2.5, "rate-burst": 20})
+	loadAndParse(t, "--config-file="+path)
+
+	if *rateLimit != 2.5 || *rateBurst != 20 {
+		t.Errorf("rate limit %v and burst %v, want 2.5 and 20", *rateLimit, *rateBurst)
+	}
+	if got := strconv.Itoa(*rateBurst); got != "20" {
+		t.Errorf("rate burst %s, want 20", got)
+	}
+}
+
+func TestEnvironmentPrecedence(t *testing.T) {
+	tests := []struct {
+		flag                    string
+		file                    any
+		env                     string
+		arg                     string
+		value                   func() string
+		fromFile, fromEnv, want string
+	}{
+		{"visitor-cookie-name", "file-vid", "env-vid", "--visitor-cookie-name=arg-vid",
+			func() string { return *visitorCookieName }, "file-vid", "env-vid", "arg-vid"},
+		{"read-timeout", "7s", "9m", "--read-timeout=11h",
+			func() string { return readTimeout.String() }, "7s", "9m0s", "11h0m0s"},
+		{"scrub-query-param", []any{"file"}, "email,token", "--scrub-query-param=arg",
+			func() string { return strings.Join(*scrubQueryParams, "|") }, "file", "email|token", "arg"},
+		{"scrub-query-param", []any{"file"}, "a,b\nc\n", "--scrub-query-param=arg",
+			func() string { return strings.Join(*scrubQueryParams, "|") }, "file", "a,b|c", "arg"},
+		{"respect-dnt", true, "false", "--respect-dnt",
+			func() string { return strconv.FormatBool(*respectDNT) }, "true", "false", "true"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.flag, func(t *testing.T) {
+			file := "--config-file=" + writeConfigFile(t, "yaml", map[string]any{tt.flag: tt.file})
+
+			loadAndParse(t, file)
+			if got := tt.value(); got != tt.fromFile {
+				t.Errorf("value %q by file, want %q", got, tt.fromFile)
+			}
+
+			t.Setenv(envName(tt.flag), tt.env)
+
+			loadAndParse(t, file)
+			if got := tt.value(); got != tt.fromEnv {
+				t.Errorf("value %q by environment over file, want %q", got, tt.fromEnv)
+			}
+			if !slices.Contains(envFlags, tt.flag) {
+				t.Errorf("flag set by environment not among %q", envFlags)
+			}
+
+			loadAndParse(t, file, tt.arg)
+			if got := tt.value(); got != tt.want {
+				t.Errorf("value %q by flag over environment, want %q", got, tt.want)
+			}
+			if slices.Contains(envFlags, tt.flag) {
+				t.Errorf("flag given as argument among %q set by environment", envFlags)
+			}
+		})
+	}
+}
+
+func TestEnvironmentNamesConfigFile(t *testing.T) {
+	path := writeConfigFile(t, "toml", map[string]any{"visitor-cookie-name": "file-vid"})
+	t.Setenv(envName("config-file"), path)
+
+	loadAndParse(t)
+	if *visitorCookieName != "file-vid" {
+		t.Errorf("visitor cookie name %q, want file-vid of configuration file named by environment", *visitorCookieName)
+	}
+}
+
+func TestSecretsOfConfigurationNotInUsage(t *testing.T) {
+	values := map[string]any{}
+	for name := range secretFlags {
+		values[name] = "file-" + name
+	}
+	path := writeConfigFile(t, "yaml", values)
+	t.Setenv(envName("signing-secret"), "env-signing-secret")
+
+	loadAndParse(t, "--config-file="+path)
+
+	var b bytes.Buffer
+	kingpin.CommandLine.UsageWriter(&b)
+	t.Cleanup(func() { kingpin.CommandLine.UsageWriter(os.Stderr) })
+	kingpin.CommandLine.Usage(nil)
+
+	for name := range secretFlags {
+		if strings.Contains(b.String(), "file-"+name) || strings.Contains(b.String(), "env-"+name) {
+			t.Errorf("value of %s shown in usage", name)
+		}
+		if !strings.Contains(b.String(), "--"+name+"="+strings.ToUpper(name)) {
+			t.Errorf("placeholder of %s not shown in usage", name)
+		}
+	}
+}
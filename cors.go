@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Checks whether origin is allowed: matching any of allowed origins, given as
+// origins or hosts, either with * as entire host matching any, or leading *.
+// label matching any subdomain regardless of port. Wildcard reports whether
+// origin is allowed only by * as entire host.
+func allowedOrigin(origin string, allowed []string) (ok, wildcard bool) {
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false, false
+	}
+	host := strings.ToLower(u.Host)
+	hostname := strings.ToLower(u.Hostname())
+
+	for _, pattern := range allowed {
+		pattern = strings.ToLower(pattern)
+
+		if scheme, rest, ok := strings.Cut(pattern, "://"); ok {
+			if scheme != u.Scheme {
+				continue
+			}
+			pattern = rest
+		}
+
+		switch {
+		case pattern == "*":
+			wildcard = true
+		case strings.HasPrefix(pattern, "*."):
+			if strings.HasSuffix(hostname, pattern[1:]) {
+				return true, false
+			}
+		case pattern == host:
+			return true, false
+		}
+	}
+
+	return wildcard, wildcard
+}
+
+// Returns given methods of tracking route, with OPTIONS of preflight requests
+// when allowed origins are given.
+func corsMethods(methods ...string) []string {
+	if len(*corsAllowedOrigins) == 0 {
+		return methods
+	}
+	return append(methods, "OPTIONS")
+}
+
+// Wraps tracking handler with CORS handling: requests of allowed origins get
+// CORS headers, with credentials as sent by navigator.sendBeacon, and OPTIONS
+// requests are answered with http 204 rather than passed to the handler, as
+// collect handlers do. Origins allowed only by * get literal * without
+// credentials, so that any site cannot make credentialed requests. Requests
+// of other origins get no CORS headers. No-op when allowed origins are not
+// given.
+func corsTracking(next http.Handler) http.Handler {
+	if len(*corsAllowedOrigins) == 0 {
+		return next
+	}
+
+	methods := strings.Join(*corsAllowedMethods, ", ")
+	maxAge := strconv.Itoa(int(corsMaxAge.Seconds()))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		options := r.Method == "OPTIONS"
+		preflight := options && r.Header.Get("Access-Control-Request-Method") != ""
+
+		w.Header().Add("Vary", "Origin")
+
+		allowed, wildcard := false, false
+		if origin != "" {
+			allowed, wildcard = allowedOrigin(origin, *corsAllowedOrigins)
+		}
+		if !allowed {
+			if options {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if wildcard {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if !preflight {
+			if options {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Methods", methods)
+		if headers := r.Header.Get("Access-Control-Request-Headers"); headers != "" {
+			w.Header().Set("Access-Control-Allow-Headers", headers)
+		}
+		w.Header().Set("Access-Control-Max-Age", maxAge)
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAllowedOrigin(t *testing.T) {
+	tests := []struct {
+		origin   string
+		allowed  []string
+		ok       bool
+		wildcard bool
+	}{
+		{"https://example.com", []string{"example.com"}, true, false},
+		{"https://example.com:8443", []string{"example.com"}, false, false},
+		{"https://example.com:8443", []string{"example.com:8443"}, true, false},
+		{"https://www.example.com", []string{"*.example.com"}, true, false},
+		{"https://www.example.com:8443", []string{"*.example.com"}, true, false},
+		{"https://example.com.attacker.net:443", []string{"*.example.com"}, false, false},
+		{"https://www.example.com", []string{"http://*.example.com"}, false, false},
+		{"https://attacker.net", []string{"*"}, true, true},
+		{"https://www.example.com", []string{"*", "*.example.com"}, true, false},
+		{"null", []string{"*"}, false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.origin, func(t *testing.T) {
+			ok, wildcard := allowedOrigin(tt.origin, tt.allowed)
+			if ok != tt.ok || wildcard != tt.wildcard {
+				t.Errorf("allowedOrigin(%q, %q) = %v, %v, want %v, %v", tt.origin, tt.allowed, ok, wildcard, tt.ok, tt.wildcard)
+			}
+		})
+	}
+}
+
+func TestCORSWildcardWithoutCredentials(t *testing.T) {
+	tests := []struct {
+		allowed     string
+		origin      string
+		credentials string
+	}{
+		{"*", "*", ""},
+		{"https://example.com", "https://example.com", "true"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.allowed, func(t *testing.T) {
+			servers, _, _ := newTestServers(t, "--cors-allowed-origin="+tt.allowed)
+
+			r := httptest.NewRequest("GET", "/track", nil)
+			r.Header.Set("Origin", "https://example.com")
+			w := httptest.NewRecorder()
+			servers[0].Handler.ServeHTTP(w, r)
+
+			if got := w.Header().Get("Access-Control-Allow-Origin"); got != tt.origin {
+				t.Errorf("Access-Control-Allow-Origin %q, want %q", got, tt.origin)
+			}
+			if got := w.Header().Get("Access-Control-Allow-Credentials"); got != tt.credentials {
+				t.Errorf("Access-Control-Allow-Credentials %q, want %q", got, tt.credentials)
+			}
+		})
+	}
+}
+
+func TestCORSOptionsNotPassedToHandlers(t *testing.T) {
+	servers, _, _ := newTestServers(t, "--cors-allowed-origin=https://example.com")
+
+	for _, origin := range []string{"https://example.com", "https://attacker.net", ""} {
+		for _, path := range []string{"/click?url=https://example.com/", "/l/link"} {
+			r := httptest.NewRequest("OPTIONS", path, nil)
+			if origin != "" {
+				r.Header.Set("Origin", origin)
+			}
+			w := httptest.NewRecorder()
+			servers[0].Handler.ServeHTTP(w, r)
+
+			if w.Code != http.StatusNoContent {
+				t.Errorf("status %d of OPTIONS %s of origin %q, want 204", w.Code, path, origin)
+			}
+		}
+	}
+}
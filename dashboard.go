@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"strconv"
+)
+
+// Dashboard page polling stats, with stats path placeholder.
+//
+//go:embed dashboard.html
+var dashboardPage []byte
+
+// Serves dashboard page, of stats of configured path.
+func serveDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		methodNotAllowed(w, r, "GET", "HEAD")
+		return
+	}
+
+	body := bytes.Replace(dashboardPage, []byte("%STATS_URL%"), []byte(template.JSEscapeString(*statsURLPath)), 1)
+
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; script-src 'unsafe-inline'; style-src 'unsafe-inline'; connect-src 'self'")
+
+	if r.Method == "HEAD" {
+		return
+	}
+
+	if _, err := w.Write(body); err != nil {
+		slog.DebugContext(r.Context(), "dashboard: Response not written", "path", r.URL.Path, "error", err)
+	}
+}
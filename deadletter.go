@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"time"
+)
+
+// Dead letter record of event whose delivery failed permanently.
+type deadLetter struct {
+	Timestamp string          `json:"timestamp"`
+	Sink      string          `json:"sink"`
+	Reason    string          `json:"reason"`
+	Event     json.RawMessage `json:"event"`
+}
+
+// Dead letter file writer, nil when dead letter file is not given.
+var deadLetters io.Writer
+
+// Initializes dead letter file, reopened on SIGHUP like log files are.
+func initDeadLetters() error {
+	if *deadLetterFilePath == "" {
+		return nil
+	}
+
+	f, err := openLogFile(*deadLetterFilePath, logRotation{})
+	if err != nil {
+		return err
+	}
+	registerLogFile(f)
+
+	deadLetters = f
+
+	return nil
+}
+
+// Writes events not delivered to sink to dead letter file, when given.
+func writeDeadLetters(sink string, events []queuedEvent, reason error) {
+	if deadLetters == nil || len(events) == 0 {
+		return
+	}
+
+	timestamp := time.Now().Format(time.RFC3339Nano)
+
+	var b []byte
+	for _, e := range events {
+		line, err := json.Marshal(deadLetter{
+			Timestamp: timestamp,
+			Sink:      sink,
+			Reason:    reason.Error(),
+			Event:     e.line,
+		})
+		if err != nil {
+			continue
+		}
+		b = append(append(b, line...), '\n')
+	}
+
+	if _, err := deadLetters.Write(b); err != nil {
+		slog.Warn("sink: Dead letters not written", "sink", sink, "events", len(events), "error", err)
+		return
+	}
+
+	sinkDeadLetterEvents.WithLabelValues(sink).Add(float64(len(events)))
+}
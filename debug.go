@@ -0,0 +1,36 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Paths of debug handlers, excluded from access log.
+const (
+	pprofURLPath  = "/debug/pprof/"
+	expvarURLPath = "/debug/vars"
+)
+
+// Registers profiling and expvar handlers on router, behind given handler
+// wrapper. No-op unless profiling is enabled.
+func initDebug(r *mux.Router, wrap func(http.Handler) http.Handler) {
+	if !*enablePprof {
+		return
+	}
+
+	r.Handle(pprofURLPath+"cmdline", wrap(http.HandlerFunc(pprof.Cmdline)))
+	r.Handle(pprofURLPath+"profile", wrap(http.HandlerFunc(pprof.Profile)))
+	r.Handle(pprofURLPath+"symbol", wrap(http.HandlerFunc(pprof.Symbol)))
+	r.Handle(pprofURLPath+"trace", wrap(http.HandlerFunc(pprof.Trace)))
+	r.PathPrefix(pprofURLPath).Handler(wrap(http.HandlerFunc(pprof.Index)))
+	r.Handle(expvarURLPath, wrap(expvar.Handler()))
+}
+
+// Checks whether path is of debug handlers, when enabled.
+func debugPath(path string) bool {
+	return *enablePprof && (strings.HasPrefix(path, pprofURLPath) || path == expvarURLPath)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Query parameter of nonce identifying repeated fetches of tracking image.
+const nonceParam = "n"
+
+// Set of nonces seen recently, kept in two generations: nonces are seen when
+// present in either. Generations are rotated once the current one is older
+// than window or holds half of maximum number of entries, so that nonces are
+// seen for at least window, unless evicted early, and memory use is bounded.
+type nonceSet struct {
+	window     time.Duration
+	maxEntries int
+
+	mu       sync.Mutex
+	current  map[string]struct{}
+	previous map[string]struct{}
+	rotated  time.Time
+}
+
+// Nonces seen recently, nil when deduplication is disabled.
+var seenNonces *nonceSet
+
+// Initializes set of nonces seen recently, when deduplication window is given.
+func initDedup() {
+	if *dedupWindow <= 0 || *dedupMaxEntries <= 0 {
+		return
+	}
+
+	seenNonces = &nonceSet{
+		window:     *dedupWindow,
+		maxEntries: *dedupMaxEntries,
+		current:    map[string]struct{}{},
+		previous:   map[string]struct{}{},
+		rotated:    time.Now(),
+	}
+}
+
+// Adds nonce to set, returning whether it has been seen before.
+func (s *nonceSet) seen(nonce string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if time.Since(s.rotated) >= s.window || len(s.current) >= max(s.maxEntries/2, 1) {
+		s.previous, s.current = s.current, make(map[string]struct{}, len(s.current))
+		s.rotated = time.Now()
+	}
+
+	if _, ok := s.current[nonce]; ok {
+		return true
+	}
+	_, ok := s.previous[nonce]
+
+	s.current[nonce] = struct{}{}
+
+	return ok
+}
+
+// Checks whether request of tracking image repeats earlier one, as of its
+// nonce.
+func duplicateRequest(r *http.Request) bool {
+	return duplicateNonce(r.URL.Query().Get(nonceParam))
+}
+
+// Checks whether nonce has been seen recently, empty nonce never has.
+func duplicateNonce(nonce string) bool {
+	if seenNonces == nil || nonce == "" {
+		return false
+	}
+
+	return seenNonces.seen(nonce)
+}
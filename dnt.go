@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"net/http"
+)
+
+// Client address of requests not to be tracked, in access log.
+const redactedClientAddress = "-"
+
+// Checks whether client asks not to be tracked, with DNT or Sec-GPC header.
+func doNotTrack(r *http.Request) bool {
+	return r.Header.Get("DNT") == "1" || r.Header.Get("Sec-GPC") == "1"
+}
+
+// Checks whether request is not to be tracked: client asks so and it is
+// respected.
+func trackingRefused(r *http.Request) bool {
+	return *respectDNT && doNotTrack(r)
+}
+
+// Wraps handler with redaction of client address of requests not to be
+// tracked, keeping real one for internal use. No-op unless do not track is
+// respected.
+func redactDoNotTrack(next http.Handler) http.Handler {
+	if !*respectDNT {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !doNotTrack(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		r = r.WithContext(context.WithValue(r.Context(), realClientIPKey, realClientIP(r)))
+		r.RemoteAddr = redactedClientAddress
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRespectDNT(t *testing.T) {
+	tests := []struct {
+		name      string
+		header    string
+		anonymize string
+		tracked   bool
+		client    string
+	}{
+		{"no header", "", "none", true, "198.51.100.7"},
+		{"DNT", "DNT", "none", false, redactedClientAddress},
+		{"Sec-GPC", "Sec-GPC", "none", false, redactedClientAddress},
+		{"no header, truncated IP", "", "truncate", true, "198.51.100.0"},
+		{"DNT, truncated IP", "DNT", "truncate", false, redactedClientAddress},
+		{"Sec-GPC, hashed IP", "Sec-GPC", "hash", false, redactedClientAddress},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			eventLog := filepath.Join(t.TempDir(), "events.log")
+			servers, _, stop := newTestServers(t,
+				"--respect-dnt",
+				"--visitor-cookie-name=vid",
+				"--sink=log",
+				"--event-log-path="+eventLog,
+				"--anonymize-ip="+tt.anonymize,
+				"--ip-hash-salt=secret",
+			)
+
+			before := testutil.ToFloat64(serveImageDNTRequests)
+
+			r := httptest.NewRequest("GET", "/track", nil)
+			r.RemoteAddr = "198.51.100.7:1234"
+			if tt.header != "" {
+				r.Header.Set(tt.header, "1")
+			}
+			w := httptest.NewRecorder()
+			servers[0].Handler.ServeHTTP(w, r)
+
+			stop()
+
+			if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/gif" {
+				t.Errorf("status %d of %q, want 200 of GIF image", w.Code, w.Header().Get("Content-Type"))
+			}
+
+			if cookie := w.Header().Get("Set-Cookie"); (cookie != "") != tt.tracked {
+				t.Errorf("visitor cookie %q set, tracked %v", cookie, tt.tracked)
+			}
+
+			events, err := os.ReadFile(eventLog)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := 0
+			if tt.tracked {
+				want = 1
+			}
+			if got := strings.Count(string(events), "\n"); got != want {
+				t.Errorf("%d events recorded, want %d", got, want)
+			}
+
+			dnt := testutil.ToFloat64(serveImageDNTRequests) - before
+			if (dnt == 1) == tt.tracked || dnt > 1 {
+				t.Errorf("%v requests counted as not tracked, tracked %v", dnt, tt.tracked)
+			}
+
+			accessLog, err := os.ReadFile(*accessLogFilePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if client, _, _ := strings.Cut(string(accessLog), " "); client != tt.client {
+				t.Errorf("client address %q in access log, want %q", client, tt.client)
+			}
+		})
+	}
+}
+
+func TestDNTIgnoredUnlessRespected(t *testing.T) {
+	servers, _, _ := newTestServers(t, "--visitor-cookie-name=vid")
+
+	before := testutil.ToFloat64(serveImageDNTRequests)
+
+	r := httptest.NewRequest("GET", "/track", nil)
+	r.Header.Set("DNT", "1")
+	w := httptest.NewRecorder()
+	servers[0].Handler.ServeHTTP(w, r)
+
+	if w.Header().Get("Set-Cookie") == "" {
+		t.Error("visitor cookie not set")
+	}
+	if got := testutil.ToFloat64(serveImageDNTRequests) - before; got != 0 {
+		t.Errorf("%v requests counted as not tracked, want 0", got)
+	}
+}
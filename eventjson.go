@@ -0,0 +1,280 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+// Built-in fields of tracking events, as enabled by default and toggled by
+// event field options.
+var eventFields = struct {
+	ip, ua, referer, query, host, tls, vars bool
+}{ip: true, ua: true, referer: true, query: true, vars: true}
+
+// Canonical names of request headers included in tracking events.
+var eventHeaders []string
+
+// Toggles built-in fields of tracking events and sets included headers, as
+// configured. Unknown fields are rejected.
+func initEventFields() error {
+	fields := map[string]*bool{
+		"ip":      &eventFields.ip,
+		"ua":      &eventFields.ua,
+		"referer": &eventFields.referer,
+		"query":   &eventFields.query,
+		"host":    &eventFields.host,
+		"tls":     &eventFields.tls,
+		"vars":    &eventFields.vars,
+	}
+
+	for _, toggle := range *eventFieldToggles {
+		name, excluded := strings.CutPrefix(toggle, "-")
+		enabled, ok := fields[name]
+		if !ok {
+			return fmt.Errorf("unknown event field %q", name)
+		}
+		*enabled = !excluded
+	}
+
+	for _, name := range *eventIncludeHeaders {
+		name = http.CanonicalHeaderKey(name)
+		if !slices.Contains(eventHeaders, name) {
+			eventHeaders = append(eventHeaders, name)
+		}
+	}
+
+	return nil
+}
+
+// Appends JSON encoding of tracking event to buffer, with enabled fields and
+// included headers only. Encoding is equivalent to encoding/json one, without
+// reflection, as it is done per request.
+func appendEvent(b []byte, e *event) []byte {
+	b = append(b, `{"timestamp":`...)
+	b = appendJSONString(b, e.Timestamp)
+
+	if e.Type != "" {
+		b = append(b, `,"type":`...)
+		b = appendJSONString(b, e.Type)
+	}
+	if e.PixelID != "" {
+		b = append(b, `,"pixel_id":`...)
+		b = appendJSONString(b, e.PixelID)
+	}
+	if e.MessageID != "" {
+		b = append(b, `,"message_id":`...)
+		b = appendJSONString(b, e.MessageID)
+	}
+	if e.RecipientHash != "" {
+		b = append(b, `,"recipient_hash":`...)
+		b = appendJSONString(b, e.RecipientHash)
+	}
+	if e.Prefetch {
+		b = append(b, `,"is_prefetch":true`...)
+	}
+	if e.CampaignID != "" {
+		b = append(b, `,"campaign_id":`...)
+		b = appendJSONString(b, e.CampaignID)
+	}
+	if e.LinkID != "" {
+		b = append(b, `,"link_id":`...)
+		b = appendJSONString(b, e.LinkID)
+	}
+	if e.Destination != "" {
+		b = append(b, `,"destination":`...)
+		b = appendJSONString(b, e.Destination)
+	}
+	if e.VisitorID != "" {
+		b = append(b, `,"visitor_id":`...)
+		b = appendJSONString(b, e.VisitorID)
+	}
+	if e.TraceID != "" {
+		b = append(b, `,"trace_id":`...)
+		b = appendJSONString(b, e.TraceID)
+	}
+	if e.RequestID != "" {
+		b = append(b, `,"request_id":`...)
+		b = appendJSONString(b, e.RequestID)
+	}
+	if e.CountryCode != "" {
+		b = append(b, `,"country_code":`...)
+		b = appendJSONString(b, e.CountryCode)
+	}
+	if e.Region != "" {
+		b = append(b, `,"region":`...)
+		b = appendJSONString(b, e.Region)
+	}
+	if e.City != "" {
+		b = append(b, `,"city":`...)
+		b = appendJSONString(b, e.City)
+	}
+	if e.DeviceClass != "" {
+		b = append(b, `,"device_class":`...)
+		b = appendJSONString(b, e.DeviceClass)
+	}
+	if e.BrowserFamily != "" {
+		b = append(b, `,"browser_family":`...)
+		b = appendJSONString(b, e.BrowserFamily)
+	}
+
+	if eventFields.ip {
+		b = append(b, `,"remote_addr":`...)
+		b = appendJSONString(b, e.RemoteAddr)
+	}
+	if eventFields.ua {
+		b = append(b, `,"user_agent":`...)
+		b = appendJSONString(b, e.UserAgent)
+	}
+	if eventFields.referer {
+		b = append(b, `,"referer":`...)
+		b = appendJSONString(b, e.Referer)
+	}
+	if eventFields.query {
+		b = append(b, `,"query":`...)
+		b = appendJSONValues(b, e.Query)
+	}
+	if eventFields.vars {
+		b = append(b, `,"vars":`...)
+		b = appendJSONMap(b, e.Vars)
+	}
+	if eventFields.host {
+		b = append(b, `,"host":`...)
+		b = appendJSONString(b, e.Host)
+	}
+	if eventFields.tls && e.TLS {
+		b = append(b, `,"tls":true`...)
+	}
+	if len(e.Headers) > 0 {
+		b = append(b, `,"headers":`...)
+		b = appendJSONMap(b, e.Headers)
+	}
+	if e.Duplicate {
+		b = append(b, `,"duplicate":true`...)
+	}
+
+	return append(b, '}')
+}
+
+// Appends JSON object of query values, keys sorted.
+func appendJSONValues(b []byte, values url.Values) []byte {
+	if values == nil {
+		return append(b, "null"...)
+	}
+
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	b = append(b, '{')
+	for i, k := range keys {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = appendJSONString(b, k)
+		b = append(b, ':')
+
+		if values[k] == nil {
+			b = append(b, "null"...)
+			continue
+		}
+		b = append(b, '[')
+		for j, v := range values[k] {
+			if j > 0 {
+				b = append(b, ',')
+			}
+			b = appendJSONString(b, v)
+		}
+		b = append(b, ']')
+	}
+	return append(b, '}')
+}
+
+// Appends JSON object of string map, keys sorted.
+func appendJSONMap(b []byte, m map[string]string) []byte {
+	if m == nil {
+		return append(b, "null"...)
+	}
+
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	b = append(b, '{')
+	for i, k := range keys {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = appendJSONString(b, k)
+		b = append(b, ':')
+		b = appendJSONString(b, m[k])
+	}
+	return append(b, '}')
+}
+
+// Hexadecimal digits of JSON unicode escapes.
+const jsonHexDigits = "0123456789abcdef"
+
+// Appends JSON string, escaped as by encoding/json, with invalid UTF-8
+// replaced by replacement character.
+func appendJSONString(b []byte, s string) []byte {
+	b = append(b, '"')
+
+	start := 0
+	for i := 0; i < len(s); {
+		if c := s[i]; c < utf8.RuneSelf {
+			if c >= 0x20 && c != '"' && c != '\\' && c != '<' && c != '>' && c != '&' {
+				i++
+				continue
+			}
+
+			b = append(b, s[start:i]...)
+			switch c {
+			case '"', '\\':
+				b = append(b, '\\', c)
+			case '\n':
+				b = append(b, '\\', 'n')
+			case '\r':
+				b = append(b, '\\', 'r')
+			case '\t':
+				b = append(b, '\\', 't')
+			case '\b':
+				b = append(b, '\\', 'b')
+			case '\f':
+				b = append(b, '\\', 'f')
+			default:
+				b = append(b, '\\', 'u', '0', '0', jsonHexDigits[c>>4], jsonHexDigits[c&0xf])
+			}
+			i++
+			start = i
+			continue
+		}
+
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			b = append(b, s[start:i]...)
+			b = append(b, "\ufffd"...)
+			i += size
+			start = i
+			continue
+		}
+		if r == '\u2028' || r == '\u2029' {
+			b = append(b, s[start:i]...)
+			b = append(b, '\\', 'u', '2', '0', '2', jsonHexDigits[r&0xf])
+			i += size
+			start = i
+			continue
+		}
+		i += size
+	}
+
+	b = append(b, s[start:]...)
+	return append(b, '"')
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/url"
+	"testing"
+)
+
+// Strings exercising escaping of JSON strings.
+var jsonTestStrings = []string{
+	"",
+	"plain",
+	`"quoted"`,
+	`back\slash`,
+	"new\nline, carriage\rreturn, tab\t",
+	"\x00\x01\x08\x0c\x1f\x7f",
+	"<script>&amp;</script>",
+	"zażółć 日本 🎉",
+	"invalid \xff\xfe utf-8 \xe2\x82",
+	"line\u2028paragraph\u2029separators",
+}
+
+func TestAppendJSONStringMatchesEncodingJSON(t *testing.T) {
+	for _, s := range jsonTestStrings {
+		want, err := json.Marshal(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := appendJSONString(nil, s); !bytes.Equal(got, want) {
+			t.Errorf("encoding of %q is %s, want %s", s, got, want)
+		}
+	}
+}
+
+func TestAppendEventMatchesEncodingJSON(t *testing.T) {
+	previous := eventFields
+	eventFields.ip, eventFields.ua, eventFields.referer, eventFields.query = true, true, true, true
+	eventFields.host, eventFields.tls, eventFields.vars = true, true, true
+	t.Cleanup(func() { eventFields = previous })
+
+	for _, s := range jsonTestStrings[1:] {
+		e := &event{
+			Timestamp: "2026-03-01T12:00:00Z", Type: s, PixelID: s, MessageID: s,
+			RecipientHash: s, Prefetch: true, CampaignID: s, LinkID: s, Destination: s,
+			VisitorID: s, TraceID: s, RequestID: s, CountryCode: s, Region: s, City: s,
+			DeviceClass: s, BrowserFamily: s, RemoteAddr: s, UserAgent: s, Referer: s,
+			Query: url.Values{s: {s, "b"}, "a": nil}, Vars: map[string]string{s: s, "z": "y"},
+			Host: s, TLS: true, Headers: map[string]string{"X-" + s: s}, Duplicate: true,
+		}
+
+		want, err := json.Marshal(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := appendEvent(nil, e); !bytes.Equal(got, want) {
+			t.Errorf("encoding of event of %q is\n%s\nwant\n%s", s, got, want)
+		}
+	}
+
+	e := &event{Timestamp: "2026-03-01T12:00:00Z", Host: "example.com"}
+	want, _ := json.Marshal(e)
+	if got := appendEvent(nil, e); !bytes.Equal(got, want) {
+		t.Errorf("encoding of empty event is\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestAppendEventRoundTrip(t *testing.T) {
+	for _, s := range jsonTestStrings {
+		var got event
+		if err := json.Unmarshal(appendEvent(nil, &event{UserAgent: s}), &got); err != nil {
+			t.Errorf("encoding of %q not decoded: %v", s, err)
+			continue
+		}
+		if want := string([]rune(s)); got.UserAgent != want {
+			t.Errorf("user agent %q decoded, want %q", got.UserAgent, want)
+		}
+	}
+}
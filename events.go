@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Tracking event, recorded per served tracking image. Type is empty for hits of
+// tracking image.
+type event struct {
+	Timestamp     string            `json:"timestamp"`
+	Type          string            `json:"type,omitempty"`
+	PixelID       string            `json:"pixel_id,omitempty"`
+	MessageID     string            `json:"message_id,omitempty"`
+	RecipientHash string            `json:"recipient_hash,omitempty"`
+	Prefetch      bool              `json:"is_prefetch,omitempty"`
+	CampaignID    string            `json:"campaign_id,omitempty"`
+	LinkID        string            `json:"link_id,omitempty"`
+	Destination   string            `json:"destination,omitempty"`
+	VisitorID     string            `json:"visitor_id,omitempty"`
+	TraceID       string            `json:"trace_id,omitempty"`
+	RequestID     string            `json:"request_id,omitempty"`
+	CountryCode   string            `json:"country_code,omitempty"`
+	Region        string            `json:"region,omitempty"`
+	City          string            `json:"city,omitempty"`
+	DeviceClass   string            `json:"device_class,omitempty"`
+	BrowserFamily string            `json:"browser_family,omitempty"`
+	RemoteAddr    string            `json:"remote_addr"`
+	UserAgent     string            `json:"user_agent"`
+	Referer       string            `json:"referer"`
+	Query         url.Values        `json:"query"`
+	Vars          map[string]string `json:"vars"`
+	Host          string            `json:"host,omitempty"`
+	TLS           bool              `json:"tls,omitempty"`
+	Headers       map[string]string `json:"headers,omitempty"`
+	Duplicate     bool              `json:"duplicate,omitempty"`
+
+	line        []byte
+	spanContext trace.SpanContext
+}
+
+// Event log file, nil when event log is disabled.
+var eventLogFile *logFile
+
+// Creates event log sink writing events as JSON lines to given path, rotated
+// and reopened like the access log is.
+func newLogSink() (eventSink, error) {
+	if *eventLogFilePath == "" {
+		return nil, errors.New("event log path not given")
+	}
+
+	f, err := openLogFile(*eventLogFilePath, logRotation{
+		maxSizeMB:  *eventLogMaxSizeMB,
+		maxBackups: *eventLogMaxBackups,
+		compress:   *eventLogCompress,
+	})
+	if err != nil {
+		return nil, err
+	}
+	registerLogFile(f)
+
+	eventLogFile = f
+
+	q, err := newEventQueue("log", defaultQueueSettings(), func(ctx context.Context, batch []queuedEvent) ([]queuedEvent, error) {
+		var b []byte
+		for _, e := range batch {
+			b = append(append(b, e.line...), '\n')
+		}
+
+		if _, err := f.Write(b); err != nil {
+			eventWriteErrors.Add(float64(len(batch)))
+			return batch, err
+		}
+		return nil, nil
+	}, func() error { return nil })
+	if err != nil {
+		return nil, err
+	}
+
+	return q, nil
+}
+
+// Creates tracking event of request, with pixel or message identifier of its
+// route, the latter making it email open event, with class of its user agent,
+// client address as anonymized, and with enabled fields and included headers
+// only.
+func newEvent(r *http.Request) *event {
+	e := &event{
+		Timestamp: time.Now().Format(time.RFC3339Nano),
+		PixelID:   mux.Vars(r)["pixel_id"],
+	}
+
+	if id := mux.Vars(r)["message_id"]; id != "" {
+		e.Type = openEventType
+		e.MessageID = id
+		e.RecipientHash = r.URL.Query().Get(recipientParam)
+		e.Prefetch = isPrefetch(r)
+	}
+
+	e.RequestID = requestID(r.Context())
+	if sc := trace.SpanContextFromContext(r.Context()); sc.IsValid() {
+		e.TraceID, e.spanContext = sc.TraceID().String(), sc
+	}
+
+	class := classifyUserAgent(r.UserAgent())
+	e.DeviceClass, e.BrowserFamily = class.device, class.browser
+
+	if eventFields.ip {
+		e.RemoteAddr = clientIP(r)
+	}
+	if eventFields.ua {
+		e.UserAgent = r.UserAgent()
+	}
+	if eventFields.referer {
+		e.Referer = r.Referer()
+	}
+	if eventFields.query {
+		e.Query = r.URL.Query()
+	}
+	if eventFields.vars {
+		e.Vars = mux.Vars(r)
+		if e.Vars == nil {
+			e.Vars = map[string]string{}
+		}
+	}
+	if eventFields.host {
+		e.Host = r.Host
+	}
+	if eventFields.tls {
+		e.TLS = r.TLS != nil
+	}
+
+	for _, name := range eventHeaders {
+		if value := r.Header.Get(name); value != "" {
+			if e.Headers == nil {
+				e.Headers = make(map[string]string, len(eventHeaders))
+			}
+			e.Headers[name] = value
+		}
+	}
+
+	return e
+}
+
+// Records tracking event to all event sinks, encoded once. Events are queued
+// by sinks, so that tracking requests are served regardless of their failures.
+func recordEvent(ctx context.Context, e *event) {
+	e.line = appendEvent(make([]byte, 0, 512), e)
+
+	writeEvent(ctx, e)
+}
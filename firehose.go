@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/firehose"
+	"github.com/aws/aws-sdk-go-v2/service/firehose/types"
+)
+
+// Limits of Firehose PutRecordBatch request.
+const (
+	firehoseMaxBatchRecords = 500
+	firehoseMaxBatchBytes   = 4 * 1024 * 1024
+)
+
+// Number of attempts to put throttled records before they are dead lettered.
+const firehoseMaxAttempts = 5
+
+// Creates Firehose sink putting events to configured delivery stream, with
+// AWS credentials and region resolved from environment, shared configuration
+// files or instance metadata.
+func newFirehoseSink() (eventSink, error) {
+	if *firehoseStreamName == "" {
+		return nil, errors.New("firehose stream name not given")
+	}
+
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	client := firehose.NewFromConfig(cfg)
+
+	q, err := newEventQueue("firehose", defaultQueueSettings(), func(ctx context.Context, batch []queuedEvent) ([]queuedEvent, error) {
+		var failed []queuedEvent
+		var lastErr error
+
+		for len(batch) > 0 {
+			n, size := 0, 0
+			for n < len(batch) && n < firehoseMaxBatchRecords && size+len(batch[n].line)+1 <= firehoseMaxBatchBytes {
+				size += len(batch[n].line) + 1
+				n++
+			}
+			n = max(n, 1)
+
+			if f, err := putFirehoseRecords(ctx, client, batch[:n]); err != nil {
+				failed, lastErr = append(failed, f...), err
+			}
+			batch = batch[n:]
+		}
+
+		return failed, lastErr
+	}, func() error { return nil })
+	if err != nil {
+		return nil, err
+	}
+
+	slog.Info("firehose: Putting events", "stream", *firehoseStreamName, "region", cfg.Region)
+
+	return q, nil
+}
+
+// Puts events to Firehose delivery stream, retrying throttled records with
+// exponential backoff. Returned are events not put.
+func putFirehoseRecords(ctx context.Context, client *firehose.Client, events []queuedEvent) ([]queuedEvent, error) {
+	backoff := 100 * time.Millisecond
+
+	for attempt := 1; ; attempt++ {
+		records := make([]types.Record, len(events))
+		for i, e := range events {
+			records[i] = types.Record{Data: append(append(make([]byte, 0, len(e.line)+1), e.line...), '\n')}
+		}
+
+		out, err := client.PutRecordBatch(ctx, &firehose.PutRecordBatchInput{
+			DeliveryStreamName: aws.String(*firehoseStreamName),
+			Records:            records,
+		})
+
+		var unavailable *types.ServiceUnavailableException
+		if err != nil && !errors.As(err, &unavailable) {
+			return events, err
+		}
+
+		if err == nil {
+			var retried []queuedEvent
+			for i, entry := range out.RequestResponses {
+				if entry.ErrorCode != nil {
+					retried = append(retried, events[i])
+					err = fmt.Errorf("%s: %s", aws.ToString(entry.ErrorCode), aws.ToString(entry.ErrorMessage))
+				}
+			}
+			if len(retried) == 0 {
+				return nil, nil
+			}
+			events = retried
+		}
+
+		if attempt == firehoseMaxAttempts {
+			return events, err
+		}
+
+		sinkRetries.WithLabelValues("firehose").Inc()
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return events, ctx.Err()
+		}
+		backoff *= 2
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Timeout of writing forward message and of reading its acknowledgement.
+const fluentTimeout = 10 * time.Second
+
+// Connection to Fluentd forward input, redialed when broken.
+type fluentConn struct {
+	network string
+	address string
+	conn    net.Conn
+}
+
+// Creates Fluentd sink sending batches of events in forward mode messages
+// of forward protocol, acknowledged when configured.
+func newFluentSink() (eventSink, error) {
+	if *fluentAddress == "" {
+		return nil, errors.New("fluent address not given")
+	}
+
+	c := &fluentConn{network: "tcp", address: *fluentAddress}
+	if path, ok := strings.CutPrefix(*fluentAddress, unixAddressPrefix); ok {
+		c.network, c.address = "unix", path
+	}
+
+	settings := defaultQueueSettings()
+	switch *fluentBufferOverflow {
+	case "drop-newest":
+		settings.overflow = "drop-new"
+	case "drop-oldest":
+		settings.overflow = "drop-old"
+	}
+
+	q, err := newEventQueue("fluent", settings, func(ctx context.Context, batch []queuedEvent) ([]queuedEvent, error) {
+		message, chunk, err := newFluentMessage(*fluentTag, batch, *fluentRequireAck)
+		if err != nil {
+			return batch, err
+		}
+
+		// Connection broken since last delivery is detected on write, so the
+		// message is sent once more on a new connection.
+		for attempt := 1; ; attempt++ {
+			err = c.send(ctx, message, chunk)
+			if err == nil {
+				return nil, nil
+			}
+			if attempt == 2 || ctx.Err() != nil {
+				return batch, err
+			}
+			sinkRetries.WithLabelValues("fluent").Inc()
+		}
+	}, func() error {
+		if c.conn == nil {
+			return nil
+		}
+		return c.conn.Close()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	slog.Info("fluent: Forwarding events", "address", *fluentAddress, "tag", *fluentTag, "ack", *fluentRequireAck)
+
+	return q, nil
+}
+
+// Encodes batch of events as forward mode message of given tag, with chunk
+// identifier to be acknowledged when requiring acknowledgement.
+func newFluentMessage(tag string, batch []queuedEvent, ack bool) ([]byte, string, error) {
+	entries := make([]any, len(batch))
+	for i, e := range batch {
+		timestamp, err := time.Parse(time.RFC3339Nano, e.event.Timestamp)
+		if err != nil {
+			return nil, "", err
+		}
+		entries[i] = []any{timestamp.Unix(), e.event}
+	}
+
+	option := map[string]any{"size": len(batch)}
+
+	var chunk string
+	if ack {
+		id := make([]byte, 16)
+		rand.Read(id)
+		chunk = base64.StdEncoding.EncodeToString(id)
+		option["chunk"] = chunk
+	}
+
+	var b bytes.Buffer
+	enc := msgpack.NewEncoder(&b)
+	enc.SetCustomStructTag("json")
+	if err := enc.Encode([]any{tag, entries, option}); err != nil {
+		return nil, "", err
+	}
+
+	return b.Bytes(), chunk, nil
+}
+
+// Sends forward message, dialing connection when not connected, and waits for
+// acknowledgement of its chunk when given. Connection is closed on failure.
+func (c *fluentConn) send(ctx context.Context, message []byte, chunk string) error {
+	if c.conn == nil {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, c.network, c.address)
+		if err != nil {
+			return err
+		}
+		c.conn = conn
+	}
+
+	err := c.exchange(message, chunk)
+	if err != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+
+	return err
+}
+
+// Writes forward message and reads acknowledgement of its chunk when given.
+func (c *fluentConn) exchange(message []byte, chunk string) error {
+	c.conn.SetDeadline(time.Now().Add(fluentTimeout))
+
+	if _, err := c.conn.Write(message); err != nil {
+		return err
+	}
+
+	if chunk == "" {
+		return nil
+	}
+
+	var response struct {
+		Ack string `msgpack:"ack"`
+	}
+	if err := msgpack.NewDecoder(c.conn).Decode(&response); err != nil {
+		return err
+	}
+	if response.Ack != chunk {
+		return fmt.Errorf("fluent acknowledgement %q does not match chunk %q", response.Ack, chunk)
+	}
+
+	return nil
+}
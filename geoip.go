@@ -0,0 +1,96 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+// Label of per country metric of client addresses not located.
+const unknownCountry = "unknown"
+
+// GeoIP database, nil when GeoIP database path is not given.
+var geoIPDB atomic.Pointer[geoip2.Reader]
+
+// Location of client address.
+type geoLocation struct {
+	countryCode string
+	region      string
+	city        string
+}
+
+// Loads GeoIP database from configured file, reloaded whenever it changes.
+func initGeoIP() error {
+	if *geoIPDBPath == "" {
+		return nil
+	}
+
+	modTime, err := loadGeoIP(*geoIPDBPath)
+	if err != nil {
+		return err
+	}
+
+	go watchFile(*geoIPDBPath, modTime, loadGeoIP)
+
+	return nil
+}
+
+// Loads GeoIP database from MaxMind DB file, read into memory so that
+// database replaced on reload is not closed while looked up. Returned is
+// modification time of loaded file.
+func loadGeoIP(path string) (time.Time, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	db, err := geoip2.FromBytes(b)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	geoIPDB.Store(db)
+
+	slog.Info("geoip: Database loaded", "path", path, "type", db.Metadata().DatabaseType,
+		"built", time.Unix(int64(db.Metadata().BuildEpoch), 0).UTC())
+
+	return info.ModTime(), nil
+}
+
+// Returns location of real client address of request, and whether GeoIP
+// database is loaded. Addresses not located, or failed to be, are of empty
+// location.
+func locateClient(r *http.Request) (geoLocation, bool) {
+	db := geoIPDB.Load()
+	if db == nil {
+		return geoLocation{}, false
+	}
+
+	ip := net.ParseIP(realClientIP(r))
+	if ip == nil {
+		return geoLocation{}, true
+	}
+
+	city, err := db.City(ip)
+	if err != nil {
+		slog.Debug("geoip: Address not located", "error", err)
+		return geoLocation{}, true
+	}
+
+	l := geoLocation{countryCode: city.Country.IsoCode, city: city.City.Names["en"]}
+	if len(city.Subdivisions) > 0 {
+		l.region = city.Subdivisions[0].IsoCode
+	}
+
+	return l, true
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"strings"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// Configured response headers, set on tracking image responses, or on every
+// response when global.
+var responseHeaders http.Header
+
+// Parses configured response headers, given as "Name: value". Headers
+// controlled by handlers are rejected: Content-Type and Content-Length, and
+// Cache-Control in no-store cache mode, ETag and Last-Modified in revalidate
+// one.
+func initResponseHeaders() error {
+	controlled := map[string]bool{"Content-Type": true, "Content-Length": true}
+	switch *cacheMode {
+	case noStoreCacheMode:
+		controlled["Cache-Control"] = true
+	case revalidateCacheMode:
+		controlled["Etag"], controlled["Last-Modified"] = true, true
+	}
+
+	responseHeaders = http.Header{}
+
+	for _, header := range *responseHeaderValues {
+		name, value, ok := strings.Cut(header, ":")
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+
+		if !ok || !httpguts.ValidHeaderFieldName(name) || !httpguts.ValidHeaderFieldValue(value) {
+			return fmt.Errorf("response header %q not of Name: value form", header)
+		}
+
+		name = textproto.CanonicalMIMEHeaderKey(name)
+		if controlled[name] {
+			return fmt.Errorf("response header %s controlled by service in %s cache mode", name, *cacheMode)
+		}
+
+		responseHeaders.Add(name, value)
+	}
+
+	return nil
+}
+
+// Sets configured response headers, replacing ones set already.
+func setResponseHeaders(h http.Header) {
+	for name, values := range responseHeaders {
+		h[name] = values
+	}
+}
+
+// Wraps handler with setting of configured response headers on every
+// response. No-op unless response headers are global.
+func globalResponseHeaders(next http.Handler) http.Handler {
+	if !*responseHeadersGlobal || len(responseHeaders) == 0 {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		setResponseHeaders(w.Header())
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Statuses of health checks: pass, fail, and warn of failing check not
+// affecting health of service.
+const (
+	checkPass = "pass"
+	checkFail = "fail"
+	checkWarn = "warn"
+)
+
+// Named check of health of service, critical ones failing making service
+// unhealthy. Times of last success and failure are tracked across
+// evaluations.
+type healthCheck struct {
+	name     string
+	critical func() bool
+	check    func() (bool, string)
+
+	mu          sync.Mutex
+	lastSuccess time.Time
+	lastFailure time.Time
+}
+
+// Result of health check, as served verbosely.
+type checkResult struct {
+	Name        string     `json:"name"`
+	Status      string     `json:"status"`
+	Detail      string     `json:"detail,omitempty"`
+	Critical    bool       `json:"critical"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	LastFailure *time.Time `json:"last_failure,omitempty"`
+}
+
+// Health checks of service, in order of evaluation.
+var healthChecks = []*healthCheck{
+	{name: "draining", critical: always, check: checkDraining},
+	{name: "state-file", critical: always, check: checkStateFile},
+	{name: "log-writable", critical: func() bool { return *failHealthOnLogError }, check: checkLogWritable},
+	{name: "sink-connected", critical: never, check: checkSinksConnected},
+	{name: "disk-space", critical: func() bool { return minFreeDisk.set() }, check: checkDiskSpace},
+	{name: "memory", critical: func() bool { return currentConfig().maxMemoryBytes > 0 }, check: checkMemory},
+	{name: "goroutines", critical: func() bool { return currentConfig().maxGoroutines > 0 }, check: checkGoroutines},
+}
+
+func always() bool { return true }
+func never() bool  { return false }
+
+// Evaluates health checks, returning whether service is healthy, with no
+// critical check failing, and results of all checks.
+func evaluateHealth() (bool, []checkResult) {
+	healthy := true
+	results := make([]checkResult, 0, len(healthChecks))
+
+	for _, c := range healthChecks {
+		ok, detail := c.check()
+		result := checkResult{Name: c.name, Status: checkPass, Detail: detail, Critical: c.critical()}
+
+		now := time.Now()
+
+		c.mu.Lock()
+		if ok {
+			c.lastSuccess = now
+		} else {
+			c.lastFailure = now
+			result.Status = checkWarn
+			if result.Critical {
+				result.Status, healthy = checkFail, false
+			}
+		}
+		if !c.lastSuccess.IsZero() {
+			t := c.lastSuccess
+			result.LastSuccess = &t
+		}
+		if !c.lastFailure.IsZero() {
+			t := c.lastFailure
+			result.LastFailure = &t
+		}
+		c.mu.Unlock()
+
+		results = append(results, result)
+	}
+
+	return healthy, results
+}
+
+// Checks that service is neither draining nor in drain mode.
+func checkDraining() (bool, string) {
+	if draining.Load() {
+		return false, "draining"
+	}
+	if drainMode.Load() {
+		return false, "drain mode"
+	}
+	return true, ""
+}
+
+// Checks that state file is present and, when configured, that it is not older
+// than the maximum age nor reports failure by its first line.
+func checkStateFile() (bool, string) {
+	fi, err := os.Stat(*stateFilePath)
+	if err != nil {
+		return false, err.Error()
+	}
+
+	if age, maxAge := time.Since(fi.ModTime()), currentConfig().stateFileMaxAge; maxAge > 0 && age > maxAge {
+		return false, fmt.Sprintf("%s stale, modified %s ago", *stateFilePath, age.Round(time.Second))
+	}
+
+	if *stateFileContent {
+		line, err := readFirstLine(*stateFilePath)
+		if err != nil {
+			return false, err.Error()
+		}
+		if reason, ok := strings.CutPrefix(line, "fail:"); ok {
+			return false, strings.TrimSpace(reason)
+		}
+		if line == "fail" {
+			return false, *stateFilePath + " reports failure"
+		}
+	}
+
+	return true, *stateFilePath + " present"
+}
+
+// Reads first line of file, trimmed, reading at most 4 KiB of it.
+func readFirstLine(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	b := make([]byte, 4096)
+	n, err := io.ReadFull(f, b)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+
+	line, _, _ := strings.Cut(string(b[:n]), "\n")
+	return strings.TrimSpace(line), nil
+}
+
+// Checks that access log is written to its file rather than failed over.
+func checkLogWritable() (bool, string) {
+	if accessLogBroken.Load() {
+		return false, "access log failed over to stderr"
+	}
+	return true, ""
+}
+
+// Checks that circuits of event sinks are closed.
+func checkSinksConnected() (bool, string) {
+	var open []string
+	for _, s := range eventSinks {
+		if q, ok := s.(*eventQueue); ok && q.breaker != nil && !q.breaker.closed() {
+			open = append(open, q.name)
+		}
+	}
+	if len(open) > 0 {
+		return false, "circuit open of " + strings.Join(open, ", ")
+	}
+	return true, ""
+}
+
+// Health of service as last evaluated: whether it is healthy, damped by
+// consecutive evaluations, with results of checks of the evaluation.
+type healthState struct {
+	healthy   bool
+	results   []checkResult
+	checkedAt time.Time
+}
+
+var (
+	// Health of service as last evaluated, nil until first evaluation.
+	health atomic.Pointer[healthState]
+
+	// Consecutive evaluations of health contrary to the current one.
+	healthStreak int
+)
+
+// Initializes evaluation of health: evaluates it right away and then at every
+// health interval in background.
+func initHealthEvaluation() error {
+	if *healthInterval <= 0 {
+		return fmt.Errorf("health interval %v not positive", *healthInterval)
+	}
+
+	updateHealth()
+
+	ticker := time.NewTicker(*healthInterval)
+	go func() {
+		defer ticker.Stop()
+
+		for range ticker.C {
+			updateHealth()
+		}
+	}()
+
+	return nil
+}
+
+// Evaluates health checks, turning service unhealthy after health fall
+// consecutive unhealthy evaluations and healthy again after health rise
+// healthy ones. Transitions are logged and counted.
+func updateHealth() {
+	expireOverride()
+
+	healthy, results := evaluateHealth()
+	state := &healthState{healthy: healthy, results: results, checkedAt: time.Now()}
+
+	last := health.Load()
+	if last == nil {
+		health.Store(state)
+		return
+	}
+
+	if healthy == last.healthy {
+		healthStreak = 0
+		health.Store(state)
+		return
+	}
+
+	healthStreak++
+	threshold := currentConfig().healthFall
+	if healthy {
+		threshold = currentConfig().healthRise
+	}
+
+	if healthStreak < threshold {
+		state.healthy = last.healthy
+		health.Store(state)
+		return
+	}
+
+	healthStreak = 0
+	health.Store(state)
+
+	if healthy {
+		healthTransitions.WithLabelValues("up").Inc()
+		slog.Info("state: Service healthy")
+	} else {
+		var failing []string
+		for _, result := range results {
+			if result.Status == checkFail {
+				failing = append(failing, result.Name)
+			}
+		}
+		healthTransitions.WithLabelValues("down").Inc()
+		slog.Warn("state: Service unhealthy", "failing", strings.Join(failing, ", "))
+	}
+}
+
+// Returns health of service as last evaluated, evaluated right away when it
+// has not been yet.
+func currentHealth() *healthState {
+	if state := health.Load(); state != nil {
+		return state
+	}
+
+	healthy, results := evaluateHealth()
+	return &healthState{healthy: healthy, results: results, checkedAt: time.Now()}
+}
+
+// Serves health verbosely: overall status, with results of all checks as last
+// evaluated, as JSON.
+func serveVerboseState(w http.ResponseWriter, r *http.Request) {
+	state := currentHealth()
+
+	status, code := checkPass, http.StatusOK
+	if !serviceHealthy() {
+		status, code = checkFail, http.StatusServiceUnavailable
+	}
+
+	writeJSON(w, r, code, struct {
+		Status    string          `json:"status"`
+		CheckedAt time.Time       `json:"checked_at"`
+		DrainMode bool            `json:"drain_mode"`
+		Override  *overrideRecord `json:"override,omitempty"`
+		Checks    []checkResult   `json:"checks"`
+	}{status, state.checkedAt, drainMode.Load(), activeOverride().record(), state.results})
+}
+
+// Checks whether request of state asks for verbose health, with verbose=1
+// query parameter or by accepting JSON.
+func verboseState(r *http.Request) bool {
+	return r.URL.Query().Get("verbose") == "1" || strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// Serves liveness of service: http 200 unless event pipeline is wedged, i.e.
+// any of event queues made no progress with events pending for longer than the
+// deadlock threshold, http 503 then, so that the process gets restarted.
+func serveLiveness(w http.ResponseWriter, r *http.Request) {
+	defer trackServeImageDuration(r.Context(), time.Now(), "liveness", "")
+
+	if r.Method != "GET" && r.Method != "HEAD" {
+		methodNotAllowed(w, r, "GET", "HEAD")
+		return
+	}
+
+	alive := true
+	for _, s := range eventSinks {
+		if q, ok := s.(*eventQueue); ok && q.wedged(*deadlockThreshold) {
+			slog.WarnContext(r.Context(), "state: Event pipeline wedged", "sink", q.name, "threshold", *deadlockThreshold)
+			alive = false
+		}
+	}
+
+	writeState(w, r, alive)
+}
+
+// Serves readiness of service: http 503 as soon as service is draining, before
+// the shutdown delay, or when service is unhealthy, http 200 otherwise. Served
+// verbosely like service state.
+func serveReadiness(w http.ResponseWriter, r *http.Request) {
+	defer trackServeImageDuration(r.Context(), time.Now(), "readiness", "")
+
+	if r.Method != "GET" && r.Method != "HEAD" {
+		methodNotAllowed(w, r, "GET", "HEAD")
+		return
+	}
+
+	w.Header().Add("Vary", "Accept")
+
+	if verboseState(r) {
+		serveVerboseState(w, r)
+		return
+	}
+
+	writeState(w, r, serviceHealthy())
+}
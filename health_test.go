@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+// Returns status of service state of given path served by main server.
+func stateStatus(t *testing.T, srv *http.Server, path string) int {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+	return w.Code
+}
+
+func TestReadinessDrainingTransition(t *testing.T) {
+	servers, _, _ := newTestServers(t, "--health-fall=3", "--health-rise=2")
+	srv := servers[0]
+
+	if got := stateStatus(t, srv, *readinessURLPath); got != http.StatusOK {
+		t.Fatalf("readiness of healthy service %d, want 200", got)
+	}
+
+	// Draining is not damped by health fall, as SIGTERM is to be followed by
+	// shutdown delay only.
+	draining.Store(true)
+
+	if got := stateStatus(t, srv, *readinessURLPath); got != http.StatusServiceUnavailable {
+		t.Errorf("readiness of draining service %d, want 503", got)
+	}
+	if got := stateStatus(t, srv, *stateURLPath); got != http.StatusServiceUnavailable {
+		t.Errorf("state of draining service %d, want 503", got)
+	}
+	if got := stateStatus(t, srv, *livenessURLPath); got != http.StatusOK {
+		t.Errorf("liveness of draining service %d, want 200", got)
+	}
+}
+
+func TestReadinessDrainModeTransition(t *testing.T) {
+	servers, _, _ := newTestServers(t)
+	srv := servers[0]
+
+	toggleDrain()
+	if got := stateStatus(t, srv, *readinessURLPath); got != http.StatusServiceUnavailable {
+		t.Errorf("readiness in drain mode %d, want 503", got)
+	}
+
+	toggleDrain()
+	if got := stateStatus(t, srv, *readinessURLPath); got != http.StatusOK {
+		t.Errorf("readiness out of drain mode %d, want 200", got)
+	}
+}
+
+func TestReadinessFallAndRise(t *testing.T) {
+	servers, _, _ := newTestServers(t, "--health-fall=3", "--health-rise=2")
+	srv := servers[0]
+
+	if err := os.Remove(*stateFilePath); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusServiceUnavailable, http.StatusServiceUnavailable} {
+		updateHealth()
+		if got := stateStatus(t, srv, *readinessURLPath); got != want {
+			t.Errorf("readiness after %d failing evaluations %d, want %d", i+1, got, want)
+		}
+	}
+
+	if err := os.WriteFile(*stateFilePath, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, want := range []int{http.StatusServiceUnavailable, http.StatusOK} {
+		updateHealth()
+		if got := stateStatus(t, srv, *readinessURLPath); got != want {
+			t.Errorf("readiness after %d passing evaluations %d, want %d", i+1, got, want)
+		}
+	}
+
+	// Draining service is not ready right away, regardless of health rise.
+	draining.Store(true)
+	if got := stateStatus(t, srv, *readinessURLPath); got != http.StatusServiceUnavailable {
+		t.Errorf("readiness of draining service %d, want 503", got)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"hash/fnv"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Format of tracking image loaded from image file, in per format metric.
+const customImageFormat = "custom"
+
+// Response modes of tracking requests: serving tracking image or no content.
+const (
+	gifResponseMode       = "gif"
+	noContentResponseMode = "204"
+)
+
+// Cache modes of tracking image: fetched on every view, or revalidated.
+const (
+	noStoreCacheMode    = "no-store"
+	revalidateCacheMode = "revalidate"
+)
+
+// Query parameter overriding response mode per request. It is the recipient
+// parameter of open events as well, thus not overriding on open path.
+const responseModeParam = "r"
+
+// Image served as tracking image, with its content type, its format in per
+// format metric, and its entity tag and modification time for revalidation.
+type trackingImage struct {
+	body        []byte
+	contentType string
+	format      string
+	etag        string
+	modTime     time.Time
+}
+
+// Creates tracking image, with entity tag of hash of its content.
+func newTrackingImage(body []byte, contentType, format string, modTime time.Time) *trackingImage {
+	h := fnv.New64a()
+	h.Write(body)
+
+	return &trackingImage{
+		body:        body,
+		contentType: contentType,
+		format:      format,
+		etag:        `"` + strconv.FormatUint(h.Sum64(), 36) + `"`,
+		modTime:     modTime,
+	}
+}
+
+// Start time of service, modification time of embedded images.
+var startTime = time.Now()
+
+// Embedded transparent images, by format, the GIF one served unless format is
+// requested or accepted.
+var (
+	gifImage  = newTrackingImage(GIF, "image/gif", "gif", startTime)
+	pngImage  = newTrackingImage(PNG, "image/png", "png", startTime)
+	webpImage = newTrackingImage(WebP, "image/webp", "webp", startTime)
+
+	embeddedImages = map[string]*trackingImage{"gif": gifImage, "png": pngImage, "webp": webpImage}
+)
+
+// Tracking image loaded from image file, nil when image path is not given or
+// file is not loaded.
+var customImage atomic.Pointer[trackingImage]
+
+// Loads tracking image from configured file, reloaded whenever it changes.
+func initImage() {
+	if *imageFilePath == "" {
+		return
+	}
+
+	modTime, _ := loadImage(*imageFilePath)
+
+	go watchFile(*imageFilePath, modTime, loadImage)
+}
+
+// Loads tracking image from file, with content type inferred from its
+// extension or sniffed from its content otherwise. On failure, embedded images
+// are served instead. Returned is modification time of loaded file.
+func loadImage(path string) (time.Time, error) {
+	info, err := os.Stat(path)
+	if err == nil {
+		var body []byte
+		if body, err = os.ReadFile(path); err == nil {
+			contentType := mime.TypeByExtension(filepath.Ext(path))
+			if !strings.HasPrefix(contentType, "image/") {
+				contentType = http.DetectContentType(body)
+			}
+
+			customImage.Store(newTrackingImage(body, contentType, customImageFormat, info.ModTime()))
+
+			slog.Info("track: Image loaded", "path", path, "content_type", contentType, "size", len(body))
+
+			return info.ModTime(), nil
+		}
+	}
+
+	customImage.Store(nil)
+	imageLoadErrors.Inc()
+
+	slog.Warn("track: Image not loaded, serving embedded one", "path", path, "error", err)
+
+	return time.Time{}, err
+}
+
+// Returns tracking image to serve for request: embedded one of format of its
+// route, image loaded from image file, or embedded one of format accepted by
+// client, GIF unless WebP or PNG is accepted explicitly.
+func requestedImage(r *http.Request) *trackingImage {
+	if format := mux.Vars(r)["format"]; format != "" {
+		return embeddedImages[format]
+	}
+
+	if image := customImage.Load(); image != nil {
+		return image
+	}
+
+	accept := r.Header.Get("Accept")
+	switch {
+	case accepts(accept, "image/webp"):
+		return webpImage
+	case accepts(accept, "image/png"):
+		return pngImage
+	}
+	return gifImage
+}
+
+// Checks whether Accept header lists media type explicitly, with non zero
+// quality.
+func accepts(header, mediaType string) bool {
+	for _, accepted := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(accepted, ";")
+		if !strings.EqualFold(strings.TrimSpace(name), mediaType) {
+			continue
+		}
+
+		for _, param := range strings.Split(params, ";") {
+			if k, v, ok := strings.Cut(strings.TrimSpace(param), "="); ok && k == "q" {
+				if q, err := strconv.ParseFloat(v, 64); err == nil && q == 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// Returns response mode of request: the one of its response mode parameter,
+// unless on open path, configured one otherwise.
+func responseMode(r *http.Request) string {
+	if mux.Vars(r)["message_id"] == "" {
+		switch mode := r.URL.Query().Get(responseModeParam); mode {
+		case gifResponseMode, noContentResponseMode:
+			return mode
+		}
+	}
+	return *imageResponseMode
+}
+
+// Checks whether client has tracking image cached already: with matching
+// entity tag when If-None-Match is given, not older than its modification
+// time otherwise.
+func notModified(r *http.Request, image *trackingImage) bool {
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		return etagMatches(match, image.etag)
+	}
+
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	return !image.modTime.Truncate(time.Second).After(since)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Wraps handler of given name with generic http instrumentation: requests in
+// flight, requests and their duration partitioned by handler, method and
+// response status code, so that errors answered by any handler, or by none,
+// are counted, and sizes of requests and responses partitioned by handler.
+func instrument(name string, next http.Handler) http.Handler {
+	labels := prometheus.Labels{"handler": name}
+
+	requestSize := httpRequestSize.With(labels)
+	responseSize := httpResponseSize.With(labels)
+
+	next = promhttp.InstrumentHandlerInFlight(httpInFlightRequests,
+		promhttp.InstrumentHandlerCounter(httpRequests.MustCurryWith(labels),
+			promhttp.InstrumentHandlerDuration(httpRequestDuration.MustCurryWith(labels), next)))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if span := trace.SpanFromContext(r.Context()); span.IsRecording() {
+			span.SetName(r.Method + " " + name)
+		}
+
+		// Response writer is recorded by access log already, unless it is
+		// disabled for request.
+		rr, ok := recorderOf(w)
+		if !ok {
+			rr = newResponseRecorder(w)
+			w = rr
+		}
+		written := rr.size
+
+		next.ServeHTTP(w, r)
+
+		size := requestSizeOf(r)
+		requestSize.Observe(float64(size))
+		responseSize.Observe(float64(rr.size - written))
+
+		if statsd != nil {
+			statsd.count("request_bytes", size, "handler:"+name)
+			statsd.count("response_bytes", int64(rr.size-written), "handler:"+name)
+		}
+	})
+}
+
+// Returns response recorder of response writer, either it or wrapped by it.
+func recorderOf(w http.ResponseWriter) (*responseRecorder, bool) {
+	for {
+		switch v := w.(type) {
+		case *responseRecorder:
+			return v, true
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = v.Unwrap()
+		default:
+			return nil, false
+		}
+	}
+}
+
+// Returns size of request in bytes: of its request line, headers as sent and
+// body, as declared by its content length.
+func requestSizeOf(r *http.Request) int64 {
+	uri := r.RequestURI
+	if uri == "" {
+		uri = r.URL.RequestURI()
+	}
+
+	size := int64(len(r.Method) + len(uri) + len(r.Proto) + len("  \r\n"))
+	if r.Host != "" {
+		size += int64(len("Host: \r\n") + len(r.Host))
+	}
+	for name, values := range r.Header {
+		for _, value := range values {
+			size += int64(len(name) + len(": \r\n") + len(value))
+		}
+	}
+	size += int64(len("\r\n"))
+
+	if r.ContentLength > 0 {
+		size += r.ContentLength
+	}
+
+	return size
+}
+
+// Returns handler of metrics of registry, negotiating OpenMetrics format, so
+// that exemplars are exposed, alongside text and protobuf ones.
+func metricsHandler(registry *prometheus.Registry) http.Handler {
+	return promhttp.InstrumentMetricHandler(metricsRegisterer(registry),
+		promhttp.HandlerFor(registry, promhttp.HandlerOpts{EnableOpenMetrics: true, Registry: metricsRegisterer(registry)}))
+}
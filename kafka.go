@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// Creates Kafka sink producing events to configured topic, keyed by
+// visitor identifier, when brokers are given.
+func newKafkaSink() (eventSink, error) {
+	if *kafkaBrokers == "" {
+		return nil, errors.New("kafka brokers not given")
+	}
+
+	if *kafkaTopic == "" {
+		return nil, errors.New("kafka topic not given")
+	}
+
+	w := &kafka.Writer{
+		Addr:         kafka.TCP(strings.Split(*kafkaBrokers, ",")...),
+		Topic:        *kafkaTopic,
+		Balancer:     &kafka.Hash{},
+		BatchSize:    *sinkBatchSize,
+		BatchTimeout: 10 * time.Millisecond,
+		RequiredAcks: kafka.RequireOne,
+		Transport:    &kafka.Transport{ClientID: *kafkaClientID},
+	}
+
+	q, err := newEventQueue("kafka", defaultQueueSettings(), tracedDelivery("kafka", func(ctx context.Context, batch []queuedEvent) ([]queuedEvent, error) {
+		messages := make([]kafka.Message, len(batch))
+		for i, e := range batch {
+			messages[i] = kafka.Message{Key: []byte(visitorID(e.event)), Value: e.line}
+		}
+
+		err := w.WriteMessages(ctx, messages...)
+
+		var writeErrors kafka.WriteErrors
+		if errors.As(err, &writeErrors) {
+			var failed []queuedEvent
+			for i, err := range writeErrors {
+				if err != nil {
+					failed = append(failed, batch[i])
+				}
+			}
+			return failed, err
+		}
+		if err != nil {
+			return batch, err
+		}
+		return nil, nil
+	}), w.Close)
+	if err != nil {
+		w.Close()
+		return nil, err
+	}
+
+	slog.Info("kafka: Producing events", "brokers", *kafkaBrokers, "topic", *kafkaTopic)
+
+	return q, nil
+}
+
+// Returns visitor identifier of event: value of visitor identifier query
+// parameter, identifier of visitor cookie or client address when not given.
+func visitorID(e *event) string {
+	if id := e.Query.Get(*visitorIDParam); id != "" {
+		return id
+	}
+	if e.VisitorID != "" {
+		return e.VisitorID
+	}
+	return e.RemoteAddr
+}
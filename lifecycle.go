@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+)
+
+// Resources opened when initializing the server, such as event sinks and log
+// files, to be flushed and closed in order of registration on shutdown.
+type lifecycle struct {
+	closers []namedCloser
+}
+
+// Named function flushing and closing resource.
+type namedCloser struct {
+	name  string
+	close func(ctx context.Context) error
+}
+
+// Registers resource to be closed by given function.
+func (l *lifecycle) add(name string, close func(ctx context.Context) error) {
+	l.closers = append(l.closers, namedCloser{name, close})
+}
+
+// Closes registered resources in order, logging failures. Resources are
+// abandoned once context is done, logged as not closed.
+func (l *lifecycle) close(ctx context.Context) {
+	for _, c := range l.closers {
+		done := make(chan error, 1)
+		go func() { done <- c.close(ctx) }()
+
+		select {
+		case err := <-done:
+			if err != nil {
+				slog.Warn("lifecycle: Resource not closed", "resource", c.name, "error", err)
+			}
+		case <-ctx.Done():
+			slog.Warn("lifecycle: Resource not closed", "resource", c.name, "error", ctx.Err())
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/yaml.v3"
+)
+
+// Destination of short link, redirected to with given status, 301 or 302.
+type linkTarget struct {
+	URL    string `yaml:"url"`
+	Status int    `yaml:"status"`
+}
+
+// Destinations of short links by identifier.
+var links atomic.Pointer[map[string]linkTarget]
+
+// Loads short links from configured file, reloaded whenever it changes and on
+// SIGHUP.
+func initLinks() error {
+	if *linkMapFile == "" {
+		return nil
+	}
+
+	modTime, err := loadLinks(*linkMapFile)
+	if err != nil {
+		return err
+	}
+
+	go watchFile(*linkMapFile, modTime, loadLinks)
+
+	return nil
+}
+
+// Reloads short links from configured file, logging failures.
+func reloadLinks() {
+	if *linkMapFile == "" {
+		return
+	}
+
+	if _, err := loadLinks(*linkMapFile); err != nil {
+		slog.Warn("link: Link map not reloaded", "path", *linkMapFile, "error", err)
+	}
+}
+
+// Loads short links from YAML file, mapping identifiers to destination URLs or
+// to url and status, or from CSV file of id,url[,status] records otherwise.
+// Returned is modification time of loaded file.
+func loadLinks(path string) (time.Time, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	targets := map[string]linkTarget{}
+
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml":
+		if err := yaml.NewDecoder(f).Decode(&targets); err != nil {
+			return time.Time{}, err
+		}
+	default:
+		r := csv.NewReader(f)
+		r.Comment = '#'
+		r.FieldsPerRecord = -1
+		r.TrimLeadingSpace = true
+
+		records, err := r.ReadAll()
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		for _, record := range records {
+			if len(record) < 2 || len(record) > 3 {
+				return time.Time{}, fmt.Errorf("invalid link record %q, id,url[,status] expected", strings.Join(record, ","))
+			}
+
+			target := linkTarget{URL: record[1]}
+			if len(record) == 3 {
+				if target.Status, err = strconv.Atoi(record[2]); err != nil {
+					return time.Time{}, fmt.Errorf("invalid status of link %q", record[0])
+				}
+			}
+			targets[record[0]] = target
+		}
+	}
+
+	for id, target := range targets {
+		if target.Status == 0 {
+			target.Status = http.StatusFound
+		}
+		if target.Status != http.StatusMovedPermanently && target.Status != http.StatusFound {
+			return time.Time{}, fmt.Errorf("invalid status %d of link %q, 301 or 302 expected", target.Status, id)
+		}
+
+		if u, err := url.Parse(target.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return time.Time{}, fmt.Errorf("invalid destination %q of link %q", target.URL, id)
+		}
+
+		targets[id] = target
+	}
+
+	links.Store(&targets)
+
+	slog.Info("link: Link map loaded", "path", path, "links", len(targets))
+
+	return info.ModTime(), nil
+}
+
+// Accepts destination given as plain URL besides mapping of url and status.
+func (t *linkTarget) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		t.URL = value.Value
+		return nil
+	}
+
+	type target linkTarget
+	return value.Decode((*target)(t))
+}
+
+// Returns label of link identifier in per link metric: the identifier when it
+// is in link map, other otherwise.
+func linkIDLabel(id string) string {
+	if targets := links.Load(); targets != nil {
+		if _, ok := (*targets)[id]; ok {
+			return id
+		}
+	}
+	return otherPixelID
+}
+
+// Serves short link: records click event and redirects to destination of link
+// identifier. Requests of headers only are redirected but not recorded.
+func serveLink(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+
+	id := mux.Vars(r)["link_id"]
+
+	var target linkTarget
+	var ok bool
+	if targets := links.Load(); targets != nil {
+		target, ok = (*targets)[id]
+	}
+	if !ok {
+		serveLinksNotFound.Inc()
+		http.NotFound(w, r)
+		return
+	}
+
+	if r.Method == "HEAD" {
+		http.Redirect(w, r, target.URL, target.Status)
+		return
+	}
+
+	duplicate := duplicateRequest(r)
+	if duplicate {
+		serveImageDuplicateRequests.Inc()
+	}
+
+	untracked := untrackedRequest(r)
+
+	if len(eventSinks) > 0 && !untracked {
+		e := newEvent(r)
+		e.Type = clickEventType
+		e.LinkID = id
+		e.Destination = target.URL
+		e.Duplicate = duplicate
+		recordEvent(r.Context(), e)
+	}
+
+	serveLinkClicks.WithLabelValues(linkIDLabel(id)).Inc()
+	http.Redirect(w, r, target.URL, target.Status)
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestLinkClicksLabeledByLinkID(t *testing.T) {
+	dir := t.TempDir()
+	linkMap, pixelIDs := filepath.Join(dir, "links.yaml"), filepath.Join(dir, "pixels.txt")
+	if err := os.WriteFile(linkMap, []byte("promo: https://example.com/promo\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(pixelIDs, []byte("newsletter\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	servers, _, _ := newTestServers(t, "--link-map-file="+linkMap, "--pixel-id-file="+pixelIDs)
+
+	before := testutil.ToFloat64(serveLinkClicks.WithLabelValues("promo"))
+
+	w := httptest.NewRecorder()
+	servers[0].Handler.ServeHTTP(w, httptest.NewRequest("GET", "/l/promo", nil))
+
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "https://example.com/promo" {
+		t.Errorf("status %d to %q, want 302 to link destination", w.Code, w.Header().Get("Location"))
+	}
+	if got := testutil.ToFloat64(serveLinkClicks.WithLabelValues("promo")) - before; got != 1 {
+		t.Errorf("%v clicks of promo counted, want 1", got)
+	}
+	if got := linkIDLabel("missing"); got != otherPixelID {
+		t.Errorf("label %q of link not in link map, want %q", got, otherPixelID)
+	}
+}
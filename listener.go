@@ -0,0 +1,340 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/coreos/go-systemd/v22/activation"
+	"github.com/pires/go-proxyproto"
+)
+
+// Prefix of listen address denoting Unix domain socket.
+const unixAddressPrefix = "unix://"
+
+// Files of sockets passed by systemd. Kept open for the lifetime of the
+// process, so that shutdown closes only their duplicates and systemd can hand
+// the sockets over to the next instance.
+var systemdFiles []*os.File
+
+// Creates listener for given server: the socket inherited from the previous
+// process on upgrade, the socket passed by systemd for the main server in socket
+// activation mode, a socket bound to server address otherwise. The listener
+// limits and counts connections and, for the main server in PROXY protocol
+// mode, parses PROXY headers.
+func listenServer(srv *http.Server) (net.Listener, error) {
+	main := srv.Addr == *listenAddress
+
+	listener, err := inheritedListener(srv.Addr)
+
+	if listener == nil && err == nil {
+		if *systemdSocket && main {
+			listener, err = listenSystemd()
+		} else {
+			listener, err = listen(srv.Addr)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	registerListener(srv.Addr, listener)
+
+	listener = newLimitListener(listener, *maxConnections)
+
+	if *enableProxyProtocol && main {
+		if listener, err = newProxyProtocolListener(listener); err != nil {
+			return nil, err
+		}
+	}
+
+	return timeoutCountingListener{listener}, nil
+}
+
+// Creates listener on the first socket passed by systemd via LISTEN_FDS.
+func listenSystemd() (net.Listener, error) {
+	systemdFiles = activation.Files(true)
+	if len(systemdFiles) == 0 {
+		return nil, errors.New("listen: --systemd-socket given but no sockets passed by systemd")
+	}
+
+	return net.FileListener(systemdFiles[0])
+}
+
+// Creates listener for given address: Unix domain socket when address starts
+// with unix://, TCP socket otherwise.
+func listen(addr string) (net.Listener, error) {
+	if !strings.HasPrefix(addr, unixAddressPrefix) {
+		return net.Listen("tcp", addr)
+	}
+
+	return listenUnix(strings.TrimPrefix(addr, unixAddressPrefix))
+}
+
+// Creates Unix domain socket listener with configured file mode. The socket
+// file is removed when listener is closed, i.e. on server shutdown, unless it is
+// handed over to the new process on upgrade.
+func listenUnix(path string) (net.Listener, error) {
+	mode, err := strconv.ParseUint(*socketMode, 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("listen: invalid socket mode %q", *socketMode)
+	}
+
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Chmod(path, os.FileMode(mode)); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	return listener, nil
+}
+
+// Removes socket file left behind by a crashed previous run, i.e. one nothing
+// is listening on. Errors when socket is still in use or path is not a socket.
+func removeStaleSocket(path string) error {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("listen: %s exists and is not a socket", path)
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("listen: %s is in use", path)
+	}
+
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return err
+	}
+
+	return os.Remove(path)
+}
+
+// Listener counting connections terminated by read or write timeout.
+type timeoutCountingListener struct {
+	net.Listener
+}
+
+// Accepts connection wrapped to count timeouts.
+func (l timeoutCountingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	c := &timeoutCountingConn{Conn: conn}
+	c.reading.Store(true)
+	return c, nil
+}
+
+// Connection counting read or write timeouts. Read timeouts are counted only
+// while a request is being read, i.e. from accepting connection or from first
+// byte read after it got idle, not ones of idle timeout nor of reads aborted by
+// the http server itself by deadline in the past, and once per deadline.
+type timeoutCountingConn struct {
+	net.Conn
+	reading atomic.Bool
+	ignored atomic.Bool
+}
+
+// Sets read deadline, noting whether it aborts pending read.
+func (c *timeoutCountingConn) SetReadDeadline(t time.Time) error {
+	c.ignored.Store(!t.IsZero() && !t.After(time.Now()))
+	return c.Conn.SetReadDeadline(t)
+}
+
+// Reads from connection, counting read timeouts of requests being read.
+func (c *timeoutCountingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.reading.Store(true)
+	}
+	if errors.Is(err, os.ErrDeadlineExceeded) && c.reading.Load() && !c.ignored.Swap(true) {
+		connectionTimeouts.WithLabelValues("read").Inc()
+	}
+	return n, err
+}
+
+// Notes connection got idle, waiting for next request, as http server state
+// hook: read timeouts are not counted until next request starts.
+func trackConnState(conn net.Conn, state http.ConnState) {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	if c, ok := conn.(*timeoutCountingConn); ok && state == http.StateIdle {
+		c.reading.Store(false)
+	}
+}
+
+// Writes to connection, counting write timeouts.
+func (c *timeoutCountingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		connectionTimeouts.WithLabelValues("write").Inc()
+	}
+	return n, err
+}
+
+// Listener limiting number of concurrently open connections and counting them.
+// Connections over the limit are queued, i.e. not accepted until open ones get
+// closed.
+type limitListener struct {
+	net.Listener
+	sem       chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Creates listener limited to given number of open connections, unlimited when
+// zero.
+func newLimitListener(l net.Listener, n int) *limitListener {
+	ll := &limitListener{Listener: l, done: make(chan struct{})}
+	if n > 0 {
+		ll.sem = make(chan struct{}, n)
+	}
+	return ll
+}
+
+// Accepts connection once there is room for it under the limit.
+func (l *limitListener) Accept() (net.Conn, error) {
+	if !l.acquire() {
+		return nil, net.ErrClosed
+	}
+
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		l.release()
+		return nil, err
+	}
+
+	openConnections.Inc()
+	return &limitConn{Conn: conn, release: l.release}, nil
+}
+
+// Closes listener, unblocking queued Accept calls.
+func (l *limitListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+// Acquires room for a connection: false when listener got closed meanwhile.
+func (l *limitListener) acquire() bool {
+	if l.sem == nil {
+		return true
+	}
+
+	select {
+	case l.sem <- struct{}{}:
+		return true
+	default:
+		queuedConnections.Inc()
+	}
+
+	select {
+	case l.sem <- struct{}{}:
+		return true
+	case <-l.done:
+		return false
+	}
+}
+
+// Releases room of a connection.
+func (l *limitListener) release() {
+	if l.sem != nil {
+		<-l.sem
+	}
+}
+
+// Connection releasing its room under the limit when closed.
+type limitConn struct {
+	net.Conn
+	release   func()
+	closeOnce sync.Once
+}
+
+// Closes connection, releasing its room once.
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(func() {
+		openConnections.Dec()
+		c.release()
+	})
+	return err
+}
+
+// Creates listener parsing PROXY protocol v1 and v2 headers, accepted only from
+// allowed sources when these are given.
+func newProxyProtocolListener(l net.Listener) (net.Listener, error) {
+	policy := func(proxyproto.ConnPolicyOptions) (proxyproto.Policy, error) {
+		return proxyproto.USE, nil
+	}
+
+	if len(*proxyProtocolAllowedSources) > 0 {
+		var err error
+		if policy, err = proxyproto.PolicyFromRanges(*proxyProtocolAllowedSources, proxyproto.USE, proxyproto.REJECT); err != nil {
+			return nil, fmt.Errorf("listen: %w", err)
+		}
+	}
+
+	return proxyHeaderErrorListener{&proxyproto.Listener{
+		Listener:          l,
+		ConnPolicy:        policy,
+		ReadHeaderTimeout: *readHeaderTimeout,
+	}}, nil
+}
+
+// Listener counting connections with malformed or disallowed PROXY headers.
+type proxyHeaderErrorListener struct {
+	net.Listener
+}
+
+// Accepts connection wrapped to count PROXY header errors.
+func (l proxyHeaderErrorListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyHeaderErrorConn{Conn: conn}, nil
+}
+
+// Connection counting PROXY header error. The header is parsed on first read,
+// so an error of the first read other than end of stream or timeout is a header
+// error; such a connection gets closed by the http server.
+type proxyHeaderErrorConn struct {
+	net.Conn
+	once sync.Once
+}
+
+// Reads from connection, counting PROXY header error.
+func (c *proxyHeaderErrorConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.once.Do(func() {
+		if err != nil && err != io.EOF && !errors.Is(err, os.ErrDeadlineExceeded) {
+			proxyProtocolErrors.Inc()
+		}
+	})
+	return n, err
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// Starts http server on listener counting timeouts, with given header and idle
+// timeouts, returning its address.
+func startTimeoutServer(t *testing.T, readHeaderTimeout, idleTimeout time.Duration) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &http.Server{
+		Handler:           http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("OK")) }),
+		ConnState:         trackConnState,
+		ReadHeaderTimeout: readHeaderTimeout,
+		IdleTimeout:       idleTimeout,
+	}
+	go srv.Serve(timeoutCountingListener{listener})
+	t.Cleanup(func() { srv.Close() })
+
+	return listener.Addr().String()
+}
+
+func TestReadHeaderTimeoutDisconnectsHalfOpenRequest(t *testing.T) {
+	addr := startTimeoutServer(t, 100*time.Millisecond, time.Minute)
+	before := testutil.ToFloat64(connectionTimeouts.WithLabelValues("read"))
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Fatalf("connection not closed by server: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("connection closed after %v, want about read header timeout", elapsed)
+	}
+
+	if got := testutil.ToFloat64(connectionTimeouts.WithLabelValues("read")) - before; got != 1 {
+		t.Errorf("read timeouts counted %v, want 1", got)
+	}
+}
+
+func TestKeepAliveRequestsCountNoTimeouts(t *testing.T) {
+	addr := startTimeoutServer(t, time.Second, 100*time.Millisecond)
+	before := testutil.ToFloat64(connectionTimeouts.WithLabelValues("read"))
+
+	client := &http.Client{Transport: &http.Transport{}}
+	defer client.CloseIdleConnections()
+
+	for i := 0; i < 3; i++ {
+		resp, err := client.Get("http://" + addr + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	// Idle connection gets closed by idle timeout meanwhile.
+	time.Sleep(300 * time.Millisecond)
+
+	if got := testutil.ToFloat64(connectionTimeouts.WithLabelValues("read")) - before; got != 0 {
+		t.Errorf("read timeouts counted %v, want 0", got)
+	}
+}
+
+func TestInheritedUnixListenerRemovesSocket(t *testing.T) {
+	parseFlags(t)
+
+	dir, err := os.MkdirTemp("", "sat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "sock")
+	previous, err := listenUnix(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Handed over as on upgrade: the previous process keeps the socket file.
+	f, err := previous.(*net.UnixListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// Inherited fd is closed by listener inheriting it.
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous.(*net.UnixListener).SetUnlinkOnClose(false)
+	previous.Close()
+
+	t.Setenv(upgradeListenFDsEnv, fmt.Sprintf("%s%s=%d", unixAddressPrefix, path, fd))
+	listener, err := inheritedListener(unixAddressPrefix + path)
+	if err != nil || listener == nil {
+		t.Fatalf("listener %v not inherited: %v", listener, err)
+	}
+
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("socket file removed by previous listener: %v", err)
+	}
+
+	listener.Close()
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("socket file not removed by inherited listener: %v", err)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Whether access log is broken, i.e. written to fallback after failures.
+var accessLogBroken atomic.Bool
+
+// Log writer switching to fallback writer after given number of consecutive
+// write failures of log file. Log file is periodically reopened while failed,
+// and when it was removed, so that writes return to it once a write to it
+// succeeds again.
+type failoverWriter struct {
+	file      *logFile
+	fallback  io.Writer
+	threshold int
+	broken    *atomic.Bool
+
+	done      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+
+	mu       sync.Mutex
+	failures int
+	failed   bool
+	reopened bool
+}
+
+// Creates failover writer of log file, reopened at every interval while failed.
+func newFailoverWriter(file *logFile, fallback io.Writer, threshold int, interval time.Duration, broken *atomic.Bool) *failoverWriter {
+	w := &failoverWriter{
+		file:      file,
+		fallback:  fallback,
+		threshold: threshold,
+		broken:    broken,
+		done:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+	}
+
+	go w.run(interval)
+
+	return w
+}
+
+// Writes to log file, or to fallback writer when log file failed. Failed log
+// file is written to again once reopened, and recovers when that write
+// succeeds.
+func (w *failoverWriter) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.failed {
+		if !w.reopened {
+			return w.fallback.Write(b)
+		}
+		w.reopened = false
+
+		if _, err := w.file.Write(b); err != nil {
+			logWriteErrors.Inc()
+			slog.Debug("log: Reopened log file failed", "path", w.file.path, "error", err)
+			return w.fallback.Write(b)
+		}
+
+		w.failed, w.failures = false, 0
+		w.broken.Store(false)
+		slog.Info("log: Failed log file recovered", "path", w.file.path)
+		return len(b), nil
+	}
+
+	n, err := w.file.Write(b)
+	if err == nil {
+		w.failures = 0
+		return n, nil
+	}
+
+	logWriteErrors.Inc()
+
+	w.failures++
+	if w.failures < w.threshold {
+		return n, err
+	}
+
+	w.failed = true
+	w.broken.Store(true)
+	slog.Error("log: Log file failed, writing to stderr", "path", w.file.path, "failures", w.failures, "error", err)
+
+	return w.fallback.Write(b)
+}
+
+// Stops reopening of log file, which is closed on its own.
+func (w *failoverWriter) Close() error {
+	w.closeOnce.Do(func() { close(w.done) })
+	<-w.stopped
+	return nil
+}
+
+// Reopens log file at every interval when failed or removed, until closed.
+func (w *failoverWriter) run(interval time.Duration) {
+	defer close(w.stopped)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-w.done:
+			return
+		}
+
+		w.mu.Lock()
+		failed := w.failed
+		w.mu.Unlock()
+
+		_, err := os.Stat(w.file.path)
+		removed := errors.Is(err, fs.ErrNotExist)
+
+		if !failed && !removed {
+			continue
+		}
+
+		if err := w.file.Reopen(); err != nil {
+			slog.Debug("log: Log file not reopened", "path", w.file.path, "error", err)
+			continue
+		}
+
+		if removed {
+			slog.Warn("log: Removed log file recreated", "path", w.file.path)
+		}
+
+		if failed {
+			w.mu.Lock()
+			w.reopened = true
+			w.mu.Unlock()
+
+			slog.Debug("log: Failed log file reopened", "path", w.file.path)
+		}
+	}
+}
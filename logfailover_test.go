@@ -0,0 +1,120 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Creates failover writer of log file at given path, reopened every
+// millisecond, switching to returned fallback on the first failure.
+func newTestFailoverWriter(t *testing.T, path string) (*failoverWriter, *lockedBuffer, *atomic.Bool) {
+	t.Helper()
+
+	f, err := openLogFile(path, logRotation{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+
+	var fallback lockedBuffer
+	var broken atomic.Bool
+	w := newFailoverWriter(f, &fallback, 1, time.Millisecond, &broken)
+	t.Cleanup(func() { w.Close() })
+
+	return w, &fallback, &broken
+}
+
+// Waits until failed log file of writer is reopened.
+func waitReopened(t *testing.T, w *failoverWriter) {
+	t.Helper()
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		w.mu.Lock()
+		reopened := w.reopened
+		w.mu.Unlock()
+		if reopened {
+			return
+		}
+	}
+	t.Fatal("log file not reopened")
+}
+
+func TestFailoverWriterRecoversAfterWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	w, fallback, broken := newTestFailoverWriter(t, path)
+
+	w.file.file.Close()
+
+	w.Write([]byte("failed\n"))
+	if !broken.Load() || fallback.String() != "failed\n" {
+		t.Fatalf("failed write %q to fallback, broken %v", fallback.String(), broken.Load())
+	}
+
+	waitReopened(t, w)
+
+	if _, err := w.Write([]byte("recovered\n")); err != nil {
+		t.Fatal(err)
+	}
+	if broken.Load() {
+		t.Error("log file broken after successful write")
+	}
+	if got := readLines(t, path); len(got) != 1 || got[0] != "recovered" {
+		t.Errorf("log file lines %q, want recovered", got)
+	}
+}
+
+func TestFailoverWriterStaysOnFallbackWhileWritesFail(t *testing.T) {
+	if _, err := os.Stat("/dev/full"); err != nil {
+		t.Skip("no /dev/full")
+	}
+	w, fallback, broken := newTestFailoverWriter(t, "/dev/full")
+
+	w.Write([]byte("first\n"))
+	waitReopened(t, w)
+	w.Write([]byte("second\n"))
+
+	if !broken.Load() {
+		t.Error("log file recovered though writes to it fail")
+	}
+	if got := fallback.String(); got != "first\nsecond\n" {
+		t.Errorf("fallback %q, want both lines", got)
+	}
+}
+
+func TestFailoverWriterCloseStopsReopening(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	w, _, _ := newTestFailoverWriter(t, path)
+
+	w.Close()
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("log file recreated after close: %v", err)
+	}
+}
+
+func TestCloseLogsStopsFailoverWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	parseFlags(t, "--access-log-path="+path, "--log-reopen-interval=1ms")
+
+	if _, err := initLogs(); err != nil {
+		t.Fatal(err)
+	}
+	if err := closeLogs(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("access log recreated after logs closed: %v", err)
+	}
+}
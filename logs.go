@@ -0,0 +1,342 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// Log file which can be reopened, e.g. after rotation by logrotate, or which is
+// rotated by size by itself. Writes are serialized, so that lines are neither
+// lost nor interleaved while reopening or rotating.
+type logFile struct {
+	path string
+
+	mu       sync.Mutex
+	file     io.WriteCloser
+	rotating bool
+}
+
+// Size based rotation of log file, disabled when maximum size is zero.
+type logRotation struct {
+	maxSizeMB  int
+	maxBackups int
+	compress   bool
+}
+
+// Log files to reopen on SIGHUP, and log writers to close on shutdown.
+var (
+	logFilesMu sync.Mutex
+	logFiles   []*logFile
+	logWriters []io.Closer
+)
+
+// Writer of service log, closed last on shutdown.
+var serviceLogWriter io.Writer
+
+// Opens log file at given path for appending, rotated by size when rotation is
+// enabled: backups beyond maximum count are deleted, optionally compressed.
+func openLogFile(path string, rotation logRotation) (*logFile, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	if rotation.maxSizeMB <= 0 {
+		return &logFile{path: path, file: file}, nil
+	}
+
+	file.Close()
+
+	return &logFile{
+		path: path,
+		file: &lumberjack.Logger{
+			Filename:   path,
+			MaxSize:    rotation.maxSizeMB,
+			MaxBackups: rotation.maxBackups,
+			Compress:   rotation.compress,
+		},
+		rotating: true,
+	}, nil
+}
+
+// Writes to log file.
+func (f *logFile) Write(b []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.file.Write(b)
+}
+
+// Reopens log file: the new file is opened before the old one gets closed, so
+// on error writes continue to the old one. Rotated file is closed only, to be
+// reopened on next write.
+func (f *logFile) Reopen() error {
+	if f.rotating {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		return f.file.Close()
+	}
+
+	file, err := os.OpenFile(f.path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	old := f.file
+	f.file = file
+	f.mu.Unlock()
+
+	return old.Close()
+}
+
+// Time format of rotated log file names, as of lumberjack.
+const logBackupTimeFormat = "2006-01-02T15-04-05.000"
+
+// Rotates log file: renames it to backup named by current time, as rotation by
+// size does, and opens it anew.
+func (f *logFile) Rotate() error {
+	if f.rotating {
+		return f.file.(*lumberjack.Logger).Rotate()
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := os.Rename(f.path, logBackupPath(f.path, time.Now())); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(f.path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	old := f.file
+	f.file = file
+
+	return old.Close()
+}
+
+// Returns path of backup of log file rotated at given time.
+func logBackupPath(path string, t time.Time) string {
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "-" + t.UTC().Format(logBackupTimeFormat) + ext
+}
+
+// Returns paths of backups of rotated log file, with rotation times, in order
+// of rotation. Backups are possibly compressed.
+func logBackups(path string) ([]string, []time.Time, error) {
+	ext := filepath.Ext(path)
+	prefix := strings.TrimSuffix(path, ext) + "-"
+
+	matches, err := filepath.Glob(prefix + "*")
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.Strings(matches)
+
+	var paths []string
+	var times []time.Time
+	for _, match := range matches {
+		timestamp, ok := strings.CutSuffix(strings.TrimSuffix(strings.TrimPrefix(match, prefix), ".gz"), ext)
+		if !ok {
+			continue
+		}
+		t, err := time.Parse(logBackupTimeFormat, timestamp)
+		if err != nil {
+			continue
+		}
+		paths, times = append(paths, match), append(times, t)
+	}
+
+	return paths, times, nil
+}
+
+// Closes log file.
+func (f *logFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.file.Close()
+}
+
+// Opens log writer at given path, registered to be reopened on SIGHUP.
+// Fallback writer is returned when the path is not given or the file cannot be
+// opened, the latter logged as error.
+func openLogWriter(path string, rotation logRotation, fallback io.Writer) io.Writer {
+	if path == "" {
+		return fallback
+	}
+
+	f, err := openLogFile(path, rotation)
+	if err != nil {
+		slog.Error("log: Log file not opened, writing to fallback", "path", path, "fallback", fallbackName(fallback), "error", err)
+		return fallback
+	}
+	registerLogFile(f)
+
+	return f
+}
+
+// Returns name of fallback log writer, stdout or stderr.
+func fallbackName(w io.Writer) string {
+	if w == os.Stdout {
+		return "stdout"
+	}
+	return "stderr"
+}
+
+// Registers log file to be reopened on SIGHUP.
+func registerLogFile(f *logFile) {
+	logFilesMu.Lock()
+	logFiles = append(logFiles, f)
+	logFilesMu.Unlock()
+}
+
+// Creates structured service logger writing records of configured level and
+// above in configured format: text or json, with request identifiers of
+// records logged by handlers.
+func newServiceLogger(w io.Writer) *slog.Logger {
+	levels := map[string]slog.Level{
+		"debug": slog.LevelDebug,
+		"info":  slog.LevelInfo,
+		"warn":  slog.LevelWarn,
+		"error": slog.LevelError,
+	}
+	opts := &slog.HandlerOptions{Level: levels[*logLevel]}
+
+	if *logFormat == "json" {
+		return slog.New(requestIDLogHandler{slog.NewJSONHandler(w, opts)})
+	}
+	return slog.New(requestIDLogHandler{slog.NewTextHandler(w, opts)})
+}
+
+// Initializes logs: default logger writes to the service log and returned is
+// the access log writer. Logs go to syslog when its address is given, access
+// log is written asynchronously when buffer size is given. Access log file
+// fails over to stderr on write failures.
+func initLogs() (io.Writer, error) {
+	if err := initServiceLog(); err != nil {
+		return nil, err
+	}
+
+	var accessLog io.Writer
+
+	if *accessLogSyslogAddress != "" {
+		w, err := newSyslogWriter("access", *accessLogSyslogAddress, *accessLogSyslogTag)
+		if err != nil {
+			return nil, err
+		}
+		accessLog = w
+	} else {
+		accessLog = openLogWriter(*accessLogFilePath, logRotation{
+			maxSizeMB:  *accessLogMaxSizeMB,
+			maxBackups: *accessLogMaxBackups,
+			compress:   *accessLogCompress,
+		}, os.Stdout)
+
+		if f, ok := accessLog.(*logFile); ok {
+			w := newFailoverWriter(f, os.Stderr, *logFailoverThreshold, *logReopenInterval, &accessLogBroken)
+
+			logFilesMu.Lock()
+			logWriters = append(logWriters, w)
+			logFilesMu.Unlock()
+
+			accessLog = w
+		}
+	}
+
+	if *logBufferSize > 0 {
+		accessLog = newAsyncWriter(accessLog, *logBufferSize, *logFlushInterval, *logBufferFullPolicy == "drop")
+	}
+
+	return accessLog, nil
+}
+
+// Initializes service log, as default logger.
+func initServiceLog() error {
+	var serviceLog io.Writer
+
+	if *serviceLogSyslogAddress != "" {
+		w, err := newSyslogWriter("service", *serviceLogSyslogAddress, *serviceLogSyslogTag)
+		if err != nil {
+			return err
+		}
+		serviceLog = w
+	} else {
+		serviceLog = openLogWriter(*serviceLogFilePath, logRotation{
+			maxSizeMB:  *serviceLogMaxSizeMB,
+			maxBackups: *serviceLogMaxBackups,
+			compress:   *serviceLogCompress,
+		}, os.Stderr)
+	}
+
+	serviceLogWriter = serviceLog
+	slog.SetDefault(newServiceLogger(serviceLog))
+
+	return nil
+}
+
+// Closes log files and syslog connections, the service log last, after which
+// service log records go to stderr.
+func closeLogs() error {
+	logFilesMu.Lock()
+	defer logFilesMu.Unlock()
+
+	var service io.Closer
+	var errs []error
+
+	closers := slices.Clone(logWriters)
+	for _, f := range logFiles {
+		closers = append(closers, f)
+	}
+
+	// Closed logs are forgotten, so that they are neither reopened nor closed
+	// again.
+	logWriters, logFiles = nil, nil
+
+	for _, c := range closers {
+		if w, ok := c.(io.Writer); ok && w == serviceLogWriter {
+			service = c
+			continue
+		}
+		if err := c.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if service != nil {
+		slog.SetDefault(newServiceLogger(os.Stderr))
+		if err := service.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Reopens all log files, logging failures.
+func reopenLogs() {
+	logFilesMu.Lock()
+	defer logFilesMu.Unlock()
+
+	for _, f := range logFiles {
+		if err := f.Reopen(); err != nil {
+			slog.Warn("log: Log file not reopened", "path", f.path, "error", err)
+		}
+	}
+
+	slog.Info("log: Log files reopened")
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Opens log file registered to be reopened, closed once test ends.
+func openTestLogFile(t *testing.T, path string) *logFile {
+	t.Helper()
+
+	f, err := openLogFile(path, logRotation{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	registerLogFile(f)
+	t.Cleanup(func() { closeLogs() })
+
+	return f
+}
+
+// Reads lines of file at given path.
+func readLines(t *testing.T, path string) []string {
+	t.Helper()
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+}
+
+func TestReopenLogsAfterRename(t *testing.T) {
+	dir := t.TempDir()
+	path, rotated := filepath.Join(dir, "access.log"), filepath.Join(dir, "access.log.1")
+
+	f := openTestLogFile(t, path)
+
+	if _, err := f.Write([]byte("before rotation\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(path, rotated); err != nil {
+		t.Fatal(err)
+	}
+
+	// Written to the renamed file until reopened.
+	if _, err := f.Write([]byte("before reopen\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	reopenLogs()
+
+	if _, err := f.Write([]byte("after reopen\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := readLines(t, rotated), []string{"before rotation", "before reopen"}; !slices.Equal(got, want) {
+		t.Errorf("rotated file lines %q, want %q", got, want)
+	}
+	if got, want := readLines(t, path), []string{"after reopen"}; !slices.Equal(got, want) {
+		t.Errorf("new file lines %q, want %q", got, want)
+	}
+}
+
+func TestReopenLogsWhileWriting(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.log")
+
+	f := openTestLogFile(t, path)
+
+	const writers, lines = 8, 500
+
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < lines; j++ {
+				fmt.Fprintf(f, "writer %d line %d %s\n", i, j, strings.Repeat("x", 100))
+			}
+		}()
+	}
+
+	for i := 1; i <= 5; i++ {
+		if err := os.Rename(path, fmt.Sprintf("%s.%d", path, i)); err != nil {
+			t.Fatal(err)
+		}
+		reopenLogs()
+	}
+
+	wg.Wait()
+
+	paths, err := filepath.Glob(path + "*")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var total int
+	for _, p := range paths {
+		b, err := os.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(b) == 0 {
+			continue
+		}
+		for _, line := range readLines(t, p) {
+			var i, j int
+			var x string
+			if n, err := fmt.Sscanf(line, "writer %d line %d %s", &i, &j, &x); n != 3 || err != nil || len(x) != 100 {
+				t.Fatalf("line %q of %s torn", line, p)
+			}
+			total++
+		}
+	}
+
+	if total != writers*lines {
+		t.Errorf("%d lines written, want %d", total, writers*lines)
+	}
+}
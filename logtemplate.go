@@ -0,0 +1,206 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Request served, as seen by access log formatting.
+type loggedRequest struct {
+	request  *http.Request
+	response *responseRecorder
+	start    time.Time
+	duration time.Duration
+	uri      string
+	path     string
+	query    string
+}
+
+// Access log line template, parsed from Apache mod_log_config like format
+// string, e.g. `%h %t "%r" %s %b %D "%{Host}i"`.
+type logTemplate []logSegment
+
+// Part of access log line: literal text or value of a placeholder.
+type logSegment func(b *strings.Builder, lr *loggedRequest)
+
+// Parses access log template, failing on unknown placeholders.
+func parseLogTemplate(format string) (logTemplate, error) {
+	var template logTemplate
+	var literal strings.Builder
+
+	flush := func() {
+		if literal.Len() > 0 {
+			text := literal.String()
+			template = append(template, func(b *strings.Builder, _ *loggedRequest) { b.WriteString(text) })
+			literal.Reset()
+		}
+	}
+
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			literal.WriteByte(format[i])
+			continue
+		}
+
+		start := i
+		i++
+
+		if i < len(format) && format[i] == '>' {
+			i++
+		}
+
+		var arg string
+		if i < len(format) && format[i] == '{' {
+			end := strings.IndexByte(format[i:], '}')
+			if end < 0 {
+				return nil, fmt.Errorf("log: unterminated placeholder at %d in %q", start, format)
+			}
+			arg = format[i+1 : i+end]
+			i += end + 1
+		}
+
+		if i >= len(format) {
+			return nil, fmt.Errorf("log: incomplete placeholder at %d in %q", start, format)
+		}
+
+		if format[i] == '%' {
+			literal.WriteByte('%')
+			continue
+		}
+
+		segment, ok := logPlaceholder(format[i], arg)
+		if !ok {
+			return nil, fmt.Errorf("log: unknown placeholder %q in %q", format[start:i+1], format)
+		}
+
+		flush()
+		template = append(template, segment)
+	}
+
+	flush()
+
+	return template, nil
+}
+
+// Returns access log segment of a placeholder with optional argument.
+func logPlaceholder(directive byte, arg string) (logSegment, bool) {
+	switch {
+	case directive == 'i' && strings.EqualFold(arg, "Host"):
+		return func(b *strings.Builder, lr *loggedRequest) { writeLogValue(b, lr.request.Host) }, true
+	case directive == 'i' && arg != "":
+		return func(b *strings.Builder, lr *loggedRequest) { writeLogValue(b, lr.request.Header.Get(arg)) }, true
+	case directive == 'o' && arg != "":
+		return func(b *strings.Builder, lr *loggedRequest) { writeLogValue(b, lr.response.Header().Get(arg)) }, true
+	case directive == 'x' && arg == "SSL_PROTOCOL":
+		return func(b *strings.Builder, lr *loggedRequest) {
+			if lr.request.TLS != nil {
+				writeLogValue(b, tlsVersionName(lr.request.TLS.Version))
+			} else {
+				b.WriteByte('-')
+			}
+		}, true
+	case arg != "":
+		return nil, false
+	}
+
+	switch directive {
+	case 'h':
+		return func(b *strings.Builder, lr *loggedRequest) { writeLogValue(b, clientIP(lr.request)) }, true
+	case 'l':
+		return func(b *strings.Builder, _ *loggedRequest) { b.WriteByte('-') }, true
+	case 'u':
+		return func(b *strings.Builder, lr *loggedRequest) {
+			user, _, _ := lr.request.BasicAuth()
+			writeLogValue(b, user)
+		}, true
+	case 't':
+		return func(b *strings.Builder, lr *loggedRequest) {
+			b.WriteString(lr.start.Format("[02/Jan/2006:15:04:05 -0700]"))
+		}, true
+	case 'r':
+		return func(b *strings.Builder, lr *loggedRequest) {
+			writeLogValue(b, lr.request.Method+" "+lr.uri+" "+lr.request.Proto)
+		}, true
+	case 's':
+		return func(b *strings.Builder, lr *loggedRequest) { b.WriteString(strconv.Itoa(lr.response.status)) }, true
+	case 'b':
+		return func(b *strings.Builder, lr *loggedRequest) {
+			if lr.response.size == 0 {
+				b.WriteByte('-')
+			} else {
+				b.WriteString(strconv.Itoa(lr.response.size))
+			}
+		}, true
+	case 'B':
+		return func(b *strings.Builder, lr *loggedRequest) { b.WriteString(strconv.Itoa(lr.response.size)) }, true
+	case 'D':
+		return func(b *strings.Builder, lr *loggedRequest) {
+			b.WriteString(strconv.FormatInt(lr.duration.Microseconds(), 10))
+		}, true
+	case 'T':
+		return func(b *strings.Builder, lr *loggedRequest) {
+			b.WriteString(strconv.FormatInt(int64(lr.duration.Seconds()), 10))
+		}, true
+	case 'm':
+		return func(b *strings.Builder, lr *loggedRequest) { writeLogValue(b, lr.request.Method) }, true
+	case 'U':
+		return func(b *strings.Builder, lr *loggedRequest) { writeLogValue(b, lr.path) }, true
+	case 'q':
+		return func(b *strings.Builder, lr *loggedRequest) {
+			if lr.query != "" {
+				writeLogValue(b, "?"+lr.query)
+			}
+		}, true
+	case 'H':
+		return func(b *strings.Builder, lr *loggedRequest) { writeLogValue(b, lr.request.Proto) }, true
+	case 'v':
+		return func(b *strings.Builder, lr *loggedRequest) { writeLogValue(b, lr.request.Host) }, true
+	}
+
+	return nil, false
+}
+
+// Writes value to access log line: "-" when empty, escaped otherwise.
+func writeLogValue(b *strings.Builder, value string) {
+	if value == "" {
+		b.WriteByte('-')
+		return
+	}
+
+	writeQuoted(b, value)
+}
+
+// Writes value to access log line with quotes, backslashes and control
+// characters escaped so that values cannot forge log lines.
+func writeQuoted(b *strings.Builder, value string) {
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c == 0x7f:
+			fmt.Fprintf(b, "\\x%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+}
+
+// Returns name of TLS protocol version.
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLSv1"
+	case tls.VersionTLS11:
+		return "TLSv1.1"
+	case tls.VersionTLS12:
+		return "TLSv1.2"
+	case tls.VersionTLS13:
+		return "TLSv1.3"
+	}
+	return "-"
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Label value of query parameter values not allowed or beyond maximum number
+// of distinct values.
+const otherLabelValue = "other"
+
+// Metric label of query parameter, with distinct values labeled so far.
+type metricLabel struct {
+	param string
+
+	mu     sync.Mutex
+	values map[string]bool
+}
+
+// Requests partitioned by configured query parameters, nil when none given.
+var serveImageRequestsByParam *prometheus.CounterVec
+
+// Metric labels of configured query parameters, in order of counter labels.
+var metricLabels []*metricLabel
+
+// Allowed values of metric labels by query parameter, any value of parameters
+// not given is allowed.
+var allowedLabelValues atomic.Pointer[map[string]map[string]bool]
+
+// Registers with given registerer counter of requests partitioned by
+// configured query parameters and loads allowed values of their labels,
+// reloaded whenever they change.
+func initMetricLabels(reg prometheus.Registerer) error {
+	if len(*metricLabelParams) == 0 {
+		return nil
+	}
+
+	var names []string
+	for _, param := range *metricLabelParams {
+		name := metricLabelName(param)
+		for _, existing := range names {
+			if existing == name {
+				return fmt.Errorf("metric label parameter %q duplicates label %q", param, name)
+			}
+		}
+		names = append(names, name)
+		metricLabels = append(metricLabels, &metricLabel{param: param, values: map[string]bool{}})
+	}
+
+	if *metricLabelAllowlistFile != "" {
+		modTime, err := loadAllowedLabelValues(*metricLabelAllowlistFile)
+		if err != nil {
+			return err
+		}
+		go watchFile(*metricLabelAllowlistFile, modTime, loadAllowedLabelValues)
+	}
+
+	serveImageRequestsByParam = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tracking_requests_by_param_total",
+			Help: "Number of requests served partitioned by configured query parameters, other unless allowed.",
+		},
+		names,
+	)
+
+	return reg.Register(serveImageRequestsByParam)
+}
+
+// Returns Prometheus label name of query parameter, with invalid characters
+// replaced by underscores.
+func metricLabelName(param string) string {
+	name := []byte(param)
+	for i, c := range name {
+		if !(c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || i > 0 && c >= '0' && c <= '9') {
+			name[i] = '_'
+		}
+	}
+	if len(name) == 0 || strings.HasPrefix(string(name), "__") {
+		return "param_" + string(name)
+	}
+	return string(name)
+}
+
+// Loads allowed values of metric labels from file, one param=value per line,
+// skipping empty lines and comments. Returned is modification time of loaded
+// file.
+func loadAllowedLabelValues(path string) (time.Time, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	allowed := map[string]map[string]bool{}
+	n := 0
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		param, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return time.Time{}, fmt.Errorf("invalid metric label value %q, param=value expected", line)
+		}
+		if allowed[param] == nil {
+			allowed[param] = map[string]bool{}
+		}
+		allowed[param][value] = true
+		n++
+	}
+	if err := scanner.Err(); err != nil {
+		return time.Time{}, err
+	}
+
+	allowedLabelValues.Store(&allowed)
+
+	slog.Info("track: Allowed metric label values loaded", "path", path, "values", n)
+
+	return info.ModTime(), nil
+}
+
+// Returns label value of query parameter value: the value when allowed, if
+// allowed values of the parameter are given, and within maximum number of
+// distinct values, other otherwise.
+func (l *metricLabel) labelValue(value string) string {
+	if value == "" {
+		return ""
+	}
+
+	if allowed := allowedLabelValues.Load(); allowed != nil && (*allowed)[l.param] != nil && !(*allowed)[l.param][value] {
+		return otherLabelValue
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.values[value] {
+		if len(l.values) >= *metricLabelMaxValues {
+			return otherLabelValue
+		}
+		l.values[value] = true
+	}
+
+	return value
+}
+
+// Counts request in counter partitioned by configured query parameters.
+func countRequestByParams(r *http.Request) {
+	if serveImageRequestsByParam == nil {
+		return
+	}
+
+	query := r.URL.Query()
+
+	values := make([]string, len(metricLabels))
+	for i, l := range metricLabels {
+		values[i] = l.labelValue(query.Get(l.param))
+	}
+
+	serveImageRequestsByParam.WithLabelValues(values...).Inc()
+}
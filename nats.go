@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// Number of attempts to publish event to JetStream before it is dead lettered.
+const natsMaxAttempts = 3
+
+// Creates NATS sink publishing events to subject per pixel, with
+// acknowledged publishes when JetStream is enabled, fire and forget otherwise.
+// Connection is (re)established in background, so that broker unavailability
+// affects event delivery only.
+func newNATSSink() (eventSink, error) {
+	if *natsURL == "" {
+		return nil, errors.New("nats url not given")
+	}
+
+	nc, err := nats.Connect(*natsURL,
+		nats.Name("serve-and-track"),
+		nats.RetryOnFailedConnect(true),
+		nats.MaxReconnects(-1),
+		nats.ConnectHandler(func(nc *nats.Conn) {
+			natsConnected.Set(1)
+			slog.Info("nats: Connected", "url", nc.ConnectedUrlRedacted())
+		}),
+		nats.ReconnectHandler(func(nc *nats.Conn) {
+			natsConnected.Set(1)
+			slog.Info("nats: Reconnected", "url", nc.ConnectedUrlRedacted())
+		}),
+		nats.DisconnectErrHandler(func(nc *nats.Conn, err error) {
+			natsConnected.Set(0)
+			slog.Warn("nats: Disconnected", "error", err)
+		}),
+		nats.ClosedHandler(func(nc *nats.Conn) {
+			natsConnected.Set(0)
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if nc.IsConnected() {
+		natsConnected.Set(1)
+	}
+
+	deliver := func(ctx context.Context, batch []queuedEvent) ([]queuedEvent, error) {
+		var failed []queuedEvent
+		var lastErr error
+		for _, e := range batch {
+			if err := nc.Publish(natsSubject(e.event), e.line); err != nil {
+				failed, lastErr = append(failed, e), err
+			}
+		}
+		return failed, lastErr
+	}
+
+	if *natsJetStream {
+		js, err := jetstream.New(nc)
+		if err != nil {
+			nc.Close()
+			return nil, err
+		}
+		deliver = func(ctx context.Context, batch []queuedEvent) ([]queuedEvent, error) {
+			return publishJetStream(ctx, js, batch)
+		}
+	}
+
+	q, err := newEventQueue("nats", defaultQueueSettings(), deliver, func() error {
+		defer nc.Close()
+
+		if !nc.IsConnected() {
+			return nil
+		}
+		return nc.FlushTimeout(*shutdownTimeout)
+	})
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+
+	slog.Info("nats: Publishing events", "url", *natsURL, "subject_prefix", *natsSubjectPrefix, "jetstream", *natsJetStream)
+
+	return q, nil
+}
+
+// Publishes events to JetStream, retrying unacknowledged ones. Returned are
+// events not acknowledged.
+func publishJetStream(ctx context.Context, js jetstream.JetStream, events []queuedEvent) ([]queuedEvent, error) {
+	var err error
+
+	for attempt := 1; attempt <= natsMaxAttempts && len(events) > 0; attempt++ {
+		if attempt > 1 {
+			sinkRetries.WithLabelValues("nats").Inc()
+
+			select {
+			case <-time.After(time.Duration(attempt) * 250 * time.Millisecond):
+			case <-ctx.Done():
+				return events, ctx.Err()
+			}
+		}
+
+		var failed []queuedEvent
+		futures := make([]jetstream.PubAckFuture, len(events))
+		for i, e := range events {
+			if futures[i], err = js.PublishAsync(natsSubject(e.event), e.line); err != nil {
+				failed = append(failed, e)
+			}
+		}
+
+		for i, future := range futures {
+			if future == nil {
+				continue
+			}
+			select {
+			case <-future.Ok():
+			case err = <-future.Err():
+				failed = append(failed, events[i])
+			case <-ctx.Done():
+				return append(failed, events[i:]...), ctx.Err()
+			}
+		}
+
+		events = failed
+	}
+
+	if len(events) == 0 {
+		return nil, nil
+	}
+	return events, err
+}
+
+// Returns NATS subject of event: subject prefix followed by pixel identifier,
+// with characters not allowed in subject tokens replaced.
+func natsSubject(e *event) string {
+	id := e.PixelID
+	if id == "" {
+		id = "none"
+	}
+
+	return *natsSubjectPrefix + "." + strings.Map(func(r rune) rune {
+		if r <= ' ' || r == '.' || r == '*' || r == '>' || r == 0x7f {
+			return '_'
+		}
+		return r
+	}, id)
+}
@@ -0,0 +1,11 @@
+package main
+
+import "testing"
+
+func TestNATSSinkRequiresURL(t *testing.T) {
+	parseFlags(t, "--sink=nats")
+
+	if _, err := newNATSSink(); err == nil || err.Error() != "nats url not given" {
+		t.Errorf("error %v, want nats url not given", err)
+	}
+}
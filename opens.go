@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Type of events of email opens.
+const openEventType = "open"
+
+// Query parameter of recipient hash of opened email.
+const recipientParam = "r"
+
+// Signatures of prefetch requests of image proxies of mail providers fetching
+// images ahead of, or regardless of, actual opens: substrings and exact values
+// of user agents, headers announcing prefetch or preview requests, and address
+// ranges of proxies.
+type prefetchSignatures struct {
+	userAgents      []string
+	exactUserAgents []string
+	headers         []string
+	proxyPrefixes   []netip.Prefix
+}
+
+// Signatures of Google and Yahoo image proxies, of Apple Mail Privacy
+// Protection, whose proxies send bare Mozilla/5.0 user agent, and of requests
+// announced as prefetch. In effect unless prefetch signatures file is given.
+var defaultPrefetchSignatures = &prefetchSignatures{
+	userAgents:      []string{"GoogleImageProxy", "ggpht.com", "YahooMailProxy"},
+	exactUserAgents: []string{"Mozilla/5.0"},
+	headers:         []string{"Purpose", "Sec-Purpose", "X-Purpose", "X-Moz"},
+}
+
+// Prefetch signatures in effect.
+var prefetchSignaturesInEffect atomic.Pointer[prefetchSignatures]
+
+// Loads prefetch signatures from configured file, reloaded whenever it
+// changes, default ones being in effect when file is not given.
+func initPrefetchSignatures() error {
+	prefetchSignaturesInEffect.Store(defaultPrefetchSignatures)
+
+	if *prefetchSignaturesFilePath == "" {
+		return nil
+	}
+
+	modTime, err := loadPrefetchSignatures(*prefetchSignaturesFilePath)
+	if err != nil {
+		return err
+	}
+
+	go watchFile(*prefetchSignaturesFilePath, modTime, loadPrefetchSignatures)
+
+	return nil
+}
+
+// Loads prefetch signatures from file, one per line as kind and value: ua
+// substring, ua-exact value, header name or cidr, skipping empty lines and
+// comments. Returned is modification time of loaded file.
+func loadPrefetchSignatures(path string) (time.Time, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	s := &prefetchSignatures{}
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		kind, value, _ := strings.Cut(line, " ")
+		value = strings.TrimSpace(value)
+		if value == "" {
+			return time.Time{}, fmt.Errorf("line %d: signature value not given", n)
+		}
+
+		switch kind {
+		case "ua":
+			s.userAgents = append(s.userAgents, value)
+		case "ua-exact":
+			s.exactUserAgents = append(s.exactUserAgents, value)
+		case "header":
+			s.headers = append(s.headers, value)
+		case "cidr":
+			prefixes, err := parsePrefixes([]string{value})
+			if err != nil {
+				return time.Time{}, fmt.Errorf("line %d: %w", n, err)
+			}
+			s.proxyPrefixes = append(s.proxyPrefixes, prefixes...)
+		default:
+			return time.Time{}, fmt.Errorf("line %d: unknown signature kind %q", n, kind)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return time.Time{}, err
+	}
+
+	prefetchSignaturesInEffect.Store(s)
+
+	slog.Info("track: Prefetch signatures loaded", "path", path, "user_agents", len(s.userAgents)+len(s.exactUserAgents),
+		"headers", len(s.headers), "proxy_cidrs", len(s.proxyPrefixes))
+
+	return info.ModTime(), nil
+}
+
+// Checks whether request looks like prefetch by image proxy of mail provider,
+// matching any of prefetch signatures in effect: of its user agent, of headers
+// with prefetch or preview value, or of real client address.
+func isPrefetch(r *http.Request) bool {
+	s := prefetchSignaturesInEffect.Load()
+	if s == nil {
+		s = defaultPrefetchSignatures
+	}
+
+	ua := r.UserAgent()
+	for _, exact := range s.exactUserAgents {
+		if ua == exact {
+			return true
+		}
+	}
+	for _, substring := range s.userAgents {
+		if strings.Contains(ua, substring) {
+			return true
+		}
+	}
+
+	for _, name := range s.headers {
+		value := strings.ToLower(r.Header.Get(name))
+		if strings.Contains(value, "prefetch") || strings.Contains(value, "preview") {
+			return true
+		}
+	}
+
+	if len(s.proxyPrefixes) > 0 {
+		if addr, ok := parseHostIP(realClientIP(r)); ok && prefixesContain(s.proxyPrefixes, addr) {
+			return true
+		}
+	}
+
+	return false
+}
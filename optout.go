@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+)
+
+// Value of opt-out cookie of clients opted out of tracking.
+const optOutCookieValue = "1"
+
+// Confirmation page of opt-out, served unless opt-out redirect URL is given.
+const optOutPage = `<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Opted out</title></head>
+<body><p>You have opted out of tracking.</p></body></html>
+`
+
+// Checks whether client opted out of tracking, with opt-out cookie.
+func optedOut(r *http.Request) bool {
+	c, err := r.Cookie(*optOutCookieName)
+	return err == nil && c.Value == optOutCookieValue
+}
+
+// Returns whether request is not to be tracked, counting it by reason:
+// client opted out, or asks not to be tracked and it is respected.
+func untrackedRequest(r *http.Request) bool {
+	switch {
+	case optedOut(r):
+		serveOptedOutRequests.Inc()
+	case trackingRefused(r):
+		serveImageDNTRequests.Inc()
+	default:
+		return false
+	}
+	return true
+}
+
+// Serves opt-out request: sets opt-out cookie, answering with confirmation
+// page or redirect to configured URL.
+func serveOptOut(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" {
+		methodNotAllowed(w, r, "GET", "POST")
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     *optOutCookieName,
+		Value:    optOutCookieValue,
+		Path:     "/",
+		Domain:   *optOutCookieDomain,
+		MaxAge:   int(optOutCookieMaxAge.Seconds()),
+		Secure:   *optOutCookieSecure,
+		HttpOnly: true,
+		SameSite: visitorCookieSameSites[*optOutCookieSameSite],
+	})
+
+	if *optOutRedirectURL != "" {
+		http.Redirect(w, r, *optOutRedirectURL, http.StatusFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if _, err := w.Write([]byte(optOutPage)); err != nil {
+		slog.DebugContext(r.Context(), "optout: Response not written", "path", r.URL.Path, "error", err)
+	}
+}
+
+// Serves opt-out status of client as JSON.
+func serveOptOutStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		methodNotAllowed(w, r, "GET", "HEAD")
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method == "HEAD" {
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(struct {
+		OptedOut bool `json:"opted_out"`
+	}{optedOut(r)}); err != nil {
+		slog.DebugContext(r.Context(), "optout: Response not written", "path", r.URL.Path, "error", err)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Maximum size in bytes of body of health override request.
+const overrideMaxBodyBytes = 4096
+
+// Override of service health, taking precedence over health checks until it
+// is cleared or expires.
+type healthOverride struct {
+	healthy bool
+	reason  string
+	since   time.Time
+	until   time.Time
+}
+
+// Override of service health, as served verbosely.
+type overrideRecord struct {
+	Healthy   bool      `json:"healthy"`
+	Reason    string    `json:"reason,omitempty"`
+	Since     time.Time `json:"since"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Override of service health, nil when health is not overridden.
+var override atomic.Pointer[healthOverride]
+
+// Returns override of service health unless it is not set or has expired.
+func activeOverride() *healthOverride {
+	o := override.Load()
+	if o == nil || time.Now().After(o.until) {
+		return nil
+	}
+	return o
+}
+
+// Clears override of service health once it has expired.
+func expireOverride() {
+	o := override.Load()
+	if o == nil || !time.Now().After(o.until) {
+		return
+	}
+	if override.CompareAndSwap(o, nil) {
+		slog.Warn("state: Health override expired", "healthy", o.healthy, "reason", o.reason, "since", o.since)
+	}
+}
+
+// Returns override as served verbosely, nil when it is nil.
+func (o *healthOverride) record() *overrideRecord {
+	if o == nil {
+		return nil
+	}
+	return &overrideRecord{Healthy: o.healthy, Reason: o.reason, Since: o.since, ExpiresAt: o.until}
+}
+
+// Returns methods of state path: GET and HEAD, with PUT and DELETE when given
+// credentials are required.
+func stateMethods(c credentials) []string {
+	if c.required() {
+		return []string{"GET", "HEAD", "PUT", "DELETE"}
+	}
+	return []string{"GET", "HEAD"}
+}
+
+// Returns handler of state path: service state is served to GET and HEAD
+// requests, while PUT and DELETE ones, requiring given credentials, override
+// service health and clear the override. Health is not overridden when no
+// credentials are required.
+func stateHandler(c credentials) http.Handler {
+	overrideHandler := requireAuth("state", c, http.HandlerFunc(serveHealthOverride))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if (r.Method == "PUT" || r.Method == "DELETE") && c.required() {
+			overrideHandler.ServeHTTP(w, r)
+			return
+		}
+		serveState(w, r)
+	})
+}
+
+// Serves override of service health: PUT of {"healthy": false, "reason":
+// "deploy"} overrides health for at most override max duration, DELETE clears
+// the override. Both are answered with http 204.
+func serveHealthOverride(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+
+	if r.Method == "DELETE" {
+		if o := override.Swap(nil); o != nil {
+			slog.InfoContext(r.Context(), "state: Health override cleared", "remote", realClientIP(r), "reason", o.reason)
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	var body struct {
+		Healthy *bool  `json:"healthy"`
+		Reason  string `json:"reason"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, overrideMaxBodyBytes)).Decode(&body); err != nil || body.Healthy == nil {
+		if err == nil {
+			err = errors.New("healthy not given")
+		}
+		slog.DebugContext(r.Context(), "state: Health override rejected", "remote", realClientIP(r), "error", err)
+		http.Error(w, "Error 400 (Malformed body)", http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	override.Store(&healthOverride{healthy: *body.Healthy, reason: body.Reason, since: now, until: now.Add(*overrideMaxDuration)})
+
+	slog.WarnContext(r.Context(), "state: Health overridden", "remote", realClientIP(r), "healthy", *body.Healthy, "reason", body.Reason, "until", now.Add(*overrideMaxDuration))
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bufio"
+	"log/slog"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Interval of checking reloaded files for changes.
+const fileReloadInterval = 10 * time.Second
+
+// Label of per pixel metric of pixel identifiers not allowed.
+const otherPixelID = "other"
+
+// Pixel identifiers labeled on their own in per pixel metric.
+var allowedPixelIDs atomic.Pointer[map[string]bool]
+
+// Loads pixel identifiers allowed in per pixel metric from configured file,
+// reloaded whenever it changes.
+func initPixelIDs() error {
+	if *pixelIDFilePath == "" {
+		return nil
+	}
+
+	modTime, err := loadPixelIDs(*pixelIDFilePath)
+	if err != nil {
+		return err
+	}
+
+	go watchFile(*pixelIDFilePath, modTime, loadPixelIDs)
+
+	return nil
+}
+
+// Reloads pixel identifiers, leaving ones loaded before in effect on failure.
+func reloadPixelIDs() {
+	if *pixelIDFilePath == "" {
+		return
+	}
+
+	if _, err := loadPixelIDs(*pixelIDFilePath); err != nil {
+		slog.Warn("track: Pixel identifiers not reloaded", "path", *pixelIDFilePath, "error", err)
+	}
+}
+
+// Loads pixel identifiers from file, one per line, skipping empty lines and
+// comments. Returned is modification time of loaded file.
+func loadPixelIDs(path string) (time.Time, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	ids := map[string]bool{}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		id := strings.TrimSpace(scanner.Text())
+		if id != "" && !strings.HasPrefix(id, "#") {
+			ids[id] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return time.Time{}, err
+	}
+
+	allowedPixelIDs.Store(&ids)
+
+	slog.Info("track: Pixel identifiers loaded", "path", path, "pixel_ids", len(ids))
+
+	return info.ModTime(), nil
+}
+
+// Returns label of pixel identifier in per pixel metric: the identifier when
+// allowed, other otherwise.
+func pixelIDLabel(id string) string {
+	if ids := allowedPixelIDs.Load(); ids != nil && (*ids)[id] {
+		return id
+	}
+	return otherPixelID
+}
+
+// Reloads file loaded at given modification time whenever it changes, at every
+// reload interval. Failures are logged, leaving file loaded before in effect.
+func watchFile(path string, modTime time.Time, load func(path string) (time.Time, error)) {
+	for range time.Tick(fileReloadInterval) {
+		info, err := os.Stat(path)
+		if err != nil {
+			slog.Warn("file: File not checked for changes", "path", path, "error", err)
+			continue
+		}
+		if info.ModTime().Equal(modTime) {
+			continue
+		}
+
+		if loaded, err := load(path); err != nil {
+			slog.Warn("file: File not reloaded", "path", path, "error", err)
+		} else {
+			modTime = loaded
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Maximum length of output of health check command kept as detail of the
+// check.
+const healthCommandMaxOutput = 1024
+
+// Result of health probe, as last run.
+type probeResult struct {
+	ok     bool
+	detail string
+}
+
+// Health probe run at health probe interval, failing once run reports failure
+// given number of consecutive times.
+type healthProbe struct {
+	name      string
+	threshold int
+	run       func(ctx context.Context) (bool, string)
+
+	failures int
+	result   atomic.Pointer[probeResult]
+}
+
+// Initializes health probes of health probe URL and health check command, when
+// given, adding critical health checks of their results.
+func initHealthProbes() error {
+	var probes []*healthProbe
+
+	if *healthProbeURL != "" {
+		if *healthProbeFailures < 1 {
+			return fmt.Errorf("health probe failures %d not positive", *healthProbeFailures)
+		}
+		client := &http.Client{Timeout: *healthProbeTimeout}
+		probes = append(probes, &healthProbe{name: "http", threshold: *healthProbeFailures, run: func(ctx context.Context) (bool, string) {
+			return probeURL(ctx, client, *healthProbeURL)
+		}})
+	}
+
+	if *healthCommand != "" {
+		args := strings.Fields(*healthCommand)
+		if _, err := exec.LookPath(args[0]); err != nil {
+			return err
+		}
+		probes = append(probes, &healthProbe{name: "command", threshold: 1, run: func(ctx context.Context) (bool, string) {
+			return runHealthCommand(ctx, args)
+		}})
+	}
+
+	if len(probes) == 0 {
+		return nil
+	}
+	if *healthProbeInterval <= 0 {
+		return fmt.Errorf("health probe interval %v not positive", *healthProbeInterval)
+	}
+
+	for _, p := range probes {
+		p.probe()
+		healthChecks = append(healthChecks, &healthCheck{name: "probe-" + p.name, critical: always, check: p.check})
+
+		go func() {
+			ticker := time.NewTicker(*healthProbeInterval)
+			defer ticker.Stop()
+
+			for range ticker.C {
+				p.probe()
+			}
+		}()
+	}
+
+	return nil
+}
+
+// Runs probe, recording its duration and its result, failed once failing
+// threshold consecutive times.
+func (p *healthProbe) probe() {
+	start := time.Now()
+	ok, detail := p.run(context.Background())
+
+	result := checkPass
+	if !ok {
+		result = checkFail
+	}
+	healthProbeDuration.WithLabelValues(p.name, result).Observe(time.Since(start).Seconds())
+
+	if ok {
+		p.failures = 0
+	} else {
+		p.failures++
+		slog.Debug("state: Health probe failed", "probe", p.name, "failures", p.failures, "detail", detail)
+	}
+
+	if !ok && p.failures < p.threshold {
+		if last := p.result.Load(); last != nil {
+			ok = last.ok
+		} else {
+			ok = true
+		}
+		detail = fmt.Sprintf("%s, %d of %d failures", detail, p.failures, p.threshold)
+	}
+
+	p.result.Store(&probeResult{ok: ok, detail: detail})
+}
+
+// Checks result of probe as last run.
+func (p *healthProbe) check() (bool, string) {
+	r := p.result.Load()
+	if r == nil {
+		return true, "not probed"
+	}
+	return r.ok, r.detail
+}
+
+// Probes URL with GET, passing on 2xx response.
+func probeURL(ctx context.Context, client *http.Client, url string) (bool, string) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return false, err.Error()
+	}
+	req.Header.Set("User-Agent", "serve-and-track/"+version)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err.Error()
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return false, url + " responded " + resp.Status
+	}
+	return true, url + " responded " + resp.Status
+}
+
+// Runs health check command without shell, killed on timeout, passing on zero
+// exit. Output of the command, limited in length, becomes the detail.
+func runHealthCommand(ctx context.Context, args []string) (bool, string) {
+	ctx, cancel := context.WithTimeout(ctx, *healthCommandTimeout)
+	defer cancel()
+
+	var out bytes.Buffer
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdout = &out
+	cmd.WaitDelay = time.Second
+
+	err := cmd.Run()
+
+	detail := strings.TrimSpace(string(out.Bytes()[:min(out.Len(), healthCommandMaxOutput)]))
+
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return false, fmt.Sprintf("timed out after %v", *healthCommandTimeout)
+	}
+	if err != nil {
+		if detail == "" {
+			detail = err.Error()
+		}
+		return false, detail
+	}
+	return true, detail
+}
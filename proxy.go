@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// Parses list of CIDRs, bare IP addresses being taken as single host ranges.
+func parsePrefixes(cidrs []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+
+		if !strings.Contains(cidr, "/") {
+			addr, err := netip.ParseAddr(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CIDR %q", cidr)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", cidr)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+
+	return prefixes, nil
+}
+
+// Checks whether address belongs to any of given ranges.
+func prefixesContain(prefixes []netip.Prefix, addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Parses IP address of remote address or forwarded hop, in any of ip, ip:port,
+// [ipv6] and [ipv6]:port forms, optionally quoted.
+func parseHostIP(s string) (netip.Addr, bool) {
+	s = strings.Trim(strings.TrimSpace(s), `"`)
+
+	if addrPort, err := netip.ParseAddrPort(s); err == nil {
+		return addrPort.Addr().Unmap(), true
+	}
+
+	addr, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(s, "["), "]"))
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+// Wraps handler so that remote address of requests coming from trusted proxies
+// is replaced with client address taken from Forwarded, X-Forwarded-For or
+// X-Real-IP headers. Headers of requests from other peers are ignored so that
+// client address cannot be spoofed. No-op when no trusted proxies are given.
+func proxyHeaders(next http.Handler, trusted []netip.Prefix) http.Handler {
+	if len(trusted) == 0 {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if peer, ok := parseHostIP(r.RemoteAddr); ok && prefixesContain(trusted, peer) {
+			if client, ok := forwardedClientIP(r.Header, trusted); ok {
+				r.RemoteAddr = client.String()
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Wraps handler so that remote address of requests coming from trusted peers is
+// replaced with client address taken from given header, e.g. CF-Connecting-IP.
+// Invalid header values are ignored and counted. No-op when header or trusted
+// peers are not given.
+func realIPHeader(next http.Handler, header string, trusted []netip.Prefix) http.Handler {
+	if header == "" || len(trusted) == 0 {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if peer, ok := parseHostIP(r.RemoteAddr); ok && prefixesContain(trusted, peer) {
+			if value := r.Header.Get(header); value != "" {
+				if client, err := netip.ParseAddr(strings.TrimSpace(value)); err == nil {
+					r.RemoteAddr = client.Unmap().String()
+				} else {
+					invalidRealIPHeaders.Inc()
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Returns client address from forwarding headers: the right-most hop which is
+// not a trusted proxy, or the left-most hop when all of them are trusted.
+func forwardedClientIP(h http.Header, trusted []netip.Prefix) (netip.Addr, bool) {
+	var hops []string
+
+	switch {
+	case h.Get("Forwarded") != "":
+		hops = forwardedForHops(h.Values("Forwarded"))
+	case h.Get("X-Forwarded-For") != "":
+		for _, xff := range h.Values("X-Forwarded-For") {
+			hops = append(hops, strings.Split(xff, ",")...)
+		}
+	case h.Get("X-Real-IP") != "":
+		hops = []string{h.Get("X-Real-IP")}
+	}
+
+	var client netip.Addr
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, ok := parseHostIP(hops[i])
+		if !ok {
+			break
+		}
+
+		client = addr
+		if !prefixesContain(trusted, addr) {
+			break
+		}
+	}
+
+	return client, client.IsValid()
+}
+
+// Returns "for" parameters of Forwarded headers (RFC 7239), in order.
+func forwardedForHops(values []string) []string {
+	var hops []string
+
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				name, hop, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(name, "for") {
+					hops = append(hops, hop)
+				}
+			}
+		}
+	}
+
+	return hops
+}
+
+// Returns client IP of request.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
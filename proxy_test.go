@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestProxyHeaders(t *testing.T) {
+	trusted, err := parsePrefixes([]string{"10.0.0.0/8", "192.0.2.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		header     string
+		value      string
+		want       string
+	}{
+		{"untrusted peer X-Forwarded-For ignored", "203.0.113.9:1234", "X-Forwarded-For", "198.51.100.1", "203.0.113.9"},
+		{"untrusted peer X-Real-IP ignored", "203.0.113.9:1234", "X-Real-IP", "198.51.100.1", "203.0.113.9"},
+		{"untrusted peer Forwarded ignored", "203.0.113.9:1234", "Forwarded", "for=198.51.100.1", "203.0.113.9"},
+		{"trusted peer without headers", "10.1.2.3:1234", "", "", "10.1.2.3"},
+		{"trusted peer X-Forwarded-For honoured", "10.1.2.3:1234", "X-Forwarded-For", "198.51.100.1", "198.51.100.1"},
+		{"trusted peer X-Real-IP honoured", "10.1.2.3:1234", "X-Real-IP", "198.51.100.1", "198.51.100.1"},
+		{"trusted peer Forwarded honoured", "10.1.2.3:1234", "Forwarded", `for="[2001:db8::1]:4711"`, "2001:db8::1"},
+		{"trusted hops skipped", "10.1.2.3:1234", "X-Forwarded-For", "198.51.100.1, 203.0.113.7, 192.0.2.1, 10.9.9.9", "203.0.113.7"},
+		{"spoofed hop left of untrusted one ignored", "10.1.2.3:1234", "X-Forwarded-For", "1.1.1.1, 198.51.100.1", "198.51.100.1"},
+		{"all hops trusted", "10.1.2.3:1234", "X-Forwarded-For", "10.0.0.1, 10.0.0.2", "10.0.0.1"},
+		{"invalid hop stops at valid one right of it", "10.1.2.3:1234", "X-Forwarded-For", "198.51.100.1, bogus, 10.0.0.2", "10.0.0.2"},
+		{"invalid only hop keeps peer", "10.1.2.3:1234", "X-Forwarded-For", "bogus", "10.1.2.3"},
+		{"IPv4-mapped trusted peer", "[::ffff:10.1.2.3]:1234", "X-Forwarded-For", "198.51.100.1", "198.51.100.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			h := proxyHeaders(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = clientIP(r)
+			}), trusted)
+
+			r := httptest.NewRequest("GET", "/track", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.header != "" {
+				r.Header.Set(tt.header, tt.value)
+			}
+			h.ServeHTTP(httptest.NewRecorder(), r)
+
+			if got != tt.want {
+				t.Errorf("client IP %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProxyHeadersWithoutTrustedProxies(t *testing.T) {
+	var got string
+	h := proxyHeaders(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = clientIP(r)
+	}), nil)
+
+	r := httptest.NewRequest("GET", "/track", nil)
+	r.RemoteAddr = "10.1.2.3:1234"
+	r.Header.Set("X-Forwarded-For", "198.51.100.1")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	if got != "10.1.2.3" {
+		t.Errorf("client IP %q, want 10.1.2.3", got)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// Type of tracking image hit events, as set in event attributes, events of
+// other types carry their own.
+const trackingEventType = "hit"
+
+// Creates Pub/Sub sink publishing events to configured topic, which has to
+// exist. Events are published in batches by the client, with attributes of
+// pixel identifier and event type.
+func newPubSubSink() (eventSink, error) {
+	if *pubsubProject == "" || *pubsubTopic == "" {
+		return nil, errors.New("pubsub project or topic not given")
+	}
+
+	ctx := context.Background()
+
+	client, err := pubsub.NewClient(ctx, *pubsubProject)
+	if err != nil {
+		return nil, err
+	}
+
+	topic := client.Topic(*pubsubTopic)
+	topic.PublishSettings.CountThreshold = *sinkBatchSize
+	topic.PublishSettings.DelayThreshold = 10 * time.Millisecond
+
+	existsCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	exists, err := topic.Exists(existsCtx)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	if !exists {
+		client.Close()
+		return nil, fmt.Errorf("pubsub topic %q of project %q does not exist", *pubsubTopic, *pubsubProject)
+	}
+
+	q, err := newEventQueue("pubsub", defaultQueueSettings(), func(ctx context.Context, batch []queuedEvent) ([]queuedEvent, error) {
+		results := make([]*pubsub.PublishResult, len(batch))
+		for i, e := range batch {
+			attributes := map[string]string{"event_type": cmp.Or(e.event.Type, trackingEventType)}
+			if id := e.event.PixelID; id != "" {
+				attributes["pixel_id"] = id
+			}
+			results[i] = topic.Publish(ctx, &pubsub.Message{Data: e.line, Attributes: attributes})
+		}
+
+		var failed []queuedEvent
+		var lastErr error
+		for i, result := range results {
+			if _, err := result.Get(ctx); err != nil {
+				failed, lastErr = append(failed, batch[i]), err
+			}
+		}
+
+		return failed, lastErr
+	}, func() error {
+		topic.Stop()
+		return client.Close()
+	})
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	slog.Info("pubsub: Publishing events", "project", *pubsubProject, "topic", *pubsubTopic)
+
+	return q, nil
+}
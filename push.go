@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Pusher of metrics, nil when push is disabled.
+var metricsPusher *pusher
+
+// Pusher of metrics of registry to Pushgateway, grouped by instance, and via
+// Prometheus remote write, whichever is given. Metrics are scraped still.
+type pusher struct {
+	registry *prometheus.Registry
+	client   *http.Client
+	gateway  *push.Pusher
+	instance string
+}
+
+// Initializes push of metrics of registry to Pushgateway or via remote write,
+// at every configured interval, when their URL is given.
+func initMetricsPush(registry *prometheus.Registry) error {
+	if *pushGatewayURL == "" && *remoteWriteURL == "" {
+		return nil
+	}
+
+	if *pushInterval <= 0 {
+		return errors.New("push interval not positive")
+	}
+
+	instance, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+
+	p := &pusher{
+		registry: registry,
+		client:   &http.Client{Timeout: *pushInterval},
+		instance: instance,
+	}
+
+	if *pushGatewayURL != "" {
+		p.gateway = push.New(*pushGatewayURL, *pushJob).
+			Client(p.client).
+			Gatherer(registry).
+			Grouping("instance", instance)
+	}
+
+	metricsPusher = p
+
+	go func() {
+		for range time.Tick(*pushInterval) {
+			p.push(context.Background())
+		}
+	}()
+
+	slog.Info("push: Pushing metrics", "push_gateway_url", *pushGatewayURL, "remote_write_url", *remoteWriteURL,
+		"interval", *pushInterval)
+
+	return nil
+}
+
+// Pushes metrics, logging and counting failures.
+func (p *pusher) push(ctx context.Context) {
+	if p.gateway != nil {
+		if err := p.gateway.PushContext(ctx); err != nil {
+			metricsPushErrors.WithLabelValues("pushgateway").Inc()
+			slog.Warn("push: Metrics not pushed to Pushgateway", "url", *pushGatewayURL, "error", err)
+		}
+	}
+
+	if *remoteWriteURL != "" {
+		if err := p.remoteWrite(ctx); err != nil {
+			metricsPushErrors.WithLabelValues("remote_write").Inc()
+			slog.Warn("push: Metrics not sent via remote write", "url", *remoteWriteURL, "error", err)
+		}
+	}
+}
+
+// Sends samples of metrics via remote write, encoded as snappy compressed
+// protobuf write request.
+func (p *pusher) remoteWrite(ctx context.Context) error {
+	families, err := p.registry.Gather()
+	if err != nil {
+		return err
+	}
+
+	body := snappy.Encode(nil, encodeWriteRequest(families, p.instance, time.Now().UnixMilli()))
+
+	req, err := http.NewRequestWithContext(ctx, "POST", *remoteWriteURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	req.Header.Set("User-Agent", "serve-and-track/"+version)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("remote write answered %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+
+	return nil
+}
+
+// Deletes metrics grouped by instance from Pushgateway, and sends them via
+// remote write one final time, within context deadline.
+func stopMetricsPush(ctx context.Context) {
+	if metricsPusher == nil {
+		return
+	}
+
+	if metricsPusher.gateway != nil {
+		if err := metricsPusher.gateway.Delete(); err != nil {
+			metricsPushErrors.WithLabelValues("pushgateway").Inc()
+			slog.Warn("push: Metrics not deleted from Pushgateway", "url", *pushGatewayURL, "error", err)
+		}
+	}
+
+	if *remoteWriteURL != "" {
+		if err := metricsPusher.remoteWrite(ctx); err != nil {
+			metricsPushErrors.WithLabelValues("remote_write").Inc()
+			slog.Warn("push: Metrics not sent via remote write", "url", *remoteWriteURL, "error", err)
+		}
+	}
+}
+
+// Label of remote write time series.
+type remoteLabel struct {
+	name, value string
+}
+
+// Encodes metric families as remote write request, of samples at given time
+// in milliseconds, with job and instance labels. Histograms and summaries are
+// sent as their classic series.
+func encodeWriteRequest(families []*dto.MetricFamily, instance string, timestamp int64) []byte {
+	var b []byte
+
+	series := func(name string, labels []remoteLabel, value float64) {
+		labels = append(slices.Clone(labels), remoteLabel{"__name__", name})
+		slices.SortFunc(labels, func(a, b remoteLabel) int { return strings.Compare(a.name, b.name) })
+
+		var ts []byte
+		for _, l := range labels {
+			var label []byte
+			label = protowire.AppendTag(label, 1, protowire.BytesType)
+			label = protowire.AppendString(label, l.name)
+			label = protowire.AppendTag(label, 2, protowire.BytesType)
+			label = protowire.AppendString(label, l.value)
+
+			ts = protowire.AppendTag(ts, 1, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, label)
+		}
+
+		var sample []byte
+		sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+		sample = protowire.AppendFixed64(sample, math.Float64bits(value))
+		sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+		sample = protowire.AppendVarint(sample, uint64(timestamp))
+
+		ts = protowire.AppendTag(ts, 2, protowire.BytesType)
+		ts = protowire.AppendBytes(ts, sample)
+
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, ts)
+	}
+
+	for _, family := range families {
+		name := family.GetName()
+
+		for _, m := range family.GetMetric() {
+			labels := []remoteLabel{{"job", *pushJob}, {"instance", instance}}
+			for _, l := range m.GetLabel() {
+				labels = append(labels, remoteLabel{l.GetName(), l.GetValue()})
+			}
+
+			switch family.GetType() {
+			case dto.MetricType_COUNTER:
+				series(name, labels, m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				series(name, labels, m.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				series(name, labels, m.GetUntyped().GetValue())
+			case dto.MetricType_SUMMARY:
+				s := m.GetSummary()
+				for _, q := range s.GetQuantile() {
+					series(name, append(labels, remoteLabel{"quantile", fmt.Sprint(q.GetQuantile())}), q.GetValue())
+				}
+				series(name+"_sum", labels, s.GetSampleSum())
+				series(name+"_count", labels, float64(s.GetSampleCount()))
+			case dto.MetricType_HISTOGRAM, dto.MetricType_GAUGE_HISTOGRAM:
+				h := m.GetHistogram()
+				for _, bucket := range h.GetBucket() {
+					series(name+"_bucket", append(labels, remoteLabel{"le", fmt.Sprint(bucket.GetUpperBound())}),
+						float64(bucket.GetCumulativeCount()))
+				}
+				series(name+"_bucket", append(labels, remoteLabel{"le", "+Inf"}), float64(h.GetSampleCount()))
+				series(name+"_sum", labels, h.GetSampleSum())
+				series(name+"_count", labels, float64(h.GetSampleCount()))
+			}
+		}
+	}
+
+	return b
+}
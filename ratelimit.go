@@ -0,0 +1,149 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/time/rate"
+)
+
+// Duration after which limiter of a client that made no requests is evicted.
+const rateLimiterIdleTimeout = 3 * time.Minute
+
+// Global rate limiter of tracking requests, nil when unlimited.
+var globalRateLimiter atomic.Pointer[rate.Limiter]
+
+// Initializes global rate limiter, with burst of one second worth of requests.
+func initGlobalRateLimiter() {
+	applyGlobalRateLimit(currentConfig().globalRateLimit)
+}
+
+// Sets global rate limit, 0 for unlimited, keeping limiter of unchanged one.
+func applyGlobalRateLimit(limit float64) {
+	if limit <= 0 {
+		globalRateLimiter.Store(nil)
+		return
+	}
+	if l := globalRateLimiter.Load(); l != nil && l.Limit() == rate.Limit(limit) {
+		return
+	}
+	globalRateLimiter.Store(rate.NewLimiter(rate.Limit(limit), int(math.Max(1, limit))))
+}
+
+// Checks whether request should be shed due to exceeding global rate limit.
+func shedLoad() bool {
+	l := globalRateLimiter.Load()
+	return l != nil && !l.Allow()
+}
+
+// Token bucket rate limiter keyed by client IP.
+type ipRateLimiter struct {
+	limit rate.Limit
+	burst int
+
+	mu       sync.Mutex
+	limiters map[string]*ipLimiter
+}
+
+// Limiter of a single client along with time it was last used.
+type ipLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// Creates rate limiter allowing given number of requests per second, with given
+// burst, per client IP. Idle clients are evicted periodically.
+func newIPRateLimiter(limit float64, burst int) *ipRateLimiter {
+	l := &ipRateLimiter{
+		limit:    rate.Limit(limit),
+		burst:    burst,
+		limiters: make(map[string]*ipLimiter),
+	}
+
+	go func() {
+		for range time.Tick(rateLimiterIdleTimeout) {
+			l.evict(time.Now().Add(-rateLimiterIdleTimeout))
+		}
+	}()
+
+	return l
+}
+
+// Reserves a request for given client, under given limit and burst, applied to
+// limiters of all clients when changed: zero if allowed now, duration after
+// which to retry otherwise.
+func (l *ipRateLimiter) reserve(ip string, limit float64, burst int) time.Duration {
+	now := time.Now()
+
+	l.mu.Lock()
+	if l.limit != rate.Limit(limit) || l.burst != burst {
+		l.limit, l.burst = rate.Limit(limit), burst
+		for _, v := range l.limiters {
+			v.limiter.SetLimitAt(now, l.limit)
+			v.limiter.SetBurstAt(now, l.burst)
+		}
+	}
+	v, ok := l.limiters[ip]
+	if !ok {
+		v = &ipLimiter{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.limiters[ip] = v
+	}
+	v.lastSeen = now
+	l.mu.Unlock()
+
+	r := v.limiter.ReserveN(now, 1)
+	if !r.OK() {
+		return time.Second
+	}
+
+	delay := r.DelayFrom(now)
+	if delay > 0 {
+		r.CancelAt(now)
+	}
+	return delay
+}
+
+// Evicts limiters of clients not seen since given time.
+func (l *ipRateLimiter) evict(since time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for ip, v := range l.limiters {
+		if v.lastSeen.Before(since) {
+			delete(l.limiters, ip)
+		}
+	}
+}
+
+// Returns middleware wrapping tracking handlers with per client IP rate
+// limiting by given limiter, shared by all of them, so that requests of a
+// client are limited across tracking routes: requests over the limit are
+// answered with http 429, those of tracking image counted as rate limited
+// tracking requests. Requests are not limited
+// while rate limit, reloadable, is not set.
+func rateLimitTracking(limiter *ipRateLimiter) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			c := currentConfig()
+			if c.rateLimit <= 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if delay := limiter.reserve(realClientIP(r), c.rateLimit, c.rateBurst); delay > 0 {
+				if route := mux.CurrentRoute(r); route != nil && route.GetName() == trackingRouteName {
+					countTrackingRequest(r, "rate_limited", responseMode(r))
+				}
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+				http.Error(w, "Error 429 (Too many requests)", http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
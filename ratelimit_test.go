@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRateLimitSharedByTrackingRoutes(t *testing.T) {
+	servers, _, _ := newTestServers(t, "--rate-limit=0.01", "--rate-burst=2")
+
+	counter := serveImageRequestsCount.WithLabelValues("rate_limited", *imageResponseMode)
+
+	for _, tt := range []struct {
+		path    string
+		status  int
+		counted float64
+	}{
+		{"/track", http.StatusOK, 0},
+		{"/open/message", http.StatusOK, 0},
+		{"/l/unknown", http.StatusTooManyRequests, 0},
+		{"/track.gif", http.StatusTooManyRequests, 1},
+	} {
+		before := testutil.ToFloat64(counter)
+
+		r := httptest.NewRequest("GET", tt.path, nil)
+		r.RemoteAddr = "198.51.100.7:1234"
+		w := httptest.NewRecorder()
+		servers[0].Handler.ServeHTTP(w, r)
+
+		if w.Code != tt.status {
+			t.Errorf("status %d of %s, want %d", w.Code, tt.path, tt.status)
+		}
+		if retry := w.Header().Get("Retry-After"); (tt.status == http.StatusTooManyRequests) != (retry == "100") {
+			t.Errorf("Retry-After %q of %s, want 100 when rate limited", retry, tt.path)
+		}
+		if got := testutil.ToFloat64(counter) - before; got != tt.counted {
+			t.Errorf("%v rate limited tracking requests counted of %s, want %v", got, tt.path, tt.counted)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/track", nil)
+	r.RemoteAddr = "198.51.100.8:1234"
+	w := httptest.NewRecorder()
+	servers[0].Handler.ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("status %d of other client, want 200", w.Code)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Path of recent requests, on admin listener.
+const recentRequestsURLPath = "/debug/requests"
+
+// Recent requests, nil when not recorded.
+var recentRequests *requestRing
+
+// Request recorded in ring of recent requests.
+type recentRequest struct {
+	Timestamp  time.Time `json:"timestamp"`
+	Method     string    `json:"method"`
+	URI        string    `json:"uri"`
+	RemoteAddr string    `json:"remote_addr"`
+	UserAgent  string    `json:"user_agent"`
+	Status     int       `json:"status"`
+	DurationMs float64   `json:"duration_ms"`
+
+	path string
+}
+
+// Circular buffer of most recent requests, overwriting oldest ones. Safe for
+// concurrent use.
+type requestRing struct {
+	mu       sync.Mutex
+	requests []recentRequest
+	next     int
+	full     bool
+}
+
+// Initializes recording of configured number of recent requests, unless it
+// is zero.
+func initRecentRequests() {
+	if *debugRingSize <= 0 {
+		return
+	}
+	recentRequests = &requestRing{requests: make([]recentRequest, *debugRingSize)}
+}
+
+// Records served request, of query as scrubbed, unless it is of recent
+// requests themselves.
+func (ring *requestRing) record(lr *loggedRequest) {
+	if ring == nil || lr.path == recentRequestsURLPath {
+		return
+	}
+
+	ring.mu.Lock()
+	defer ring.mu.Unlock()
+
+	ring.requests[ring.next] = recentRequest{
+		Timestamp:  lr.start,
+		Method:     lr.request.Method,
+		URI:        lr.uri,
+		RemoteAddr: clientIP(lr.request),
+		UserAgent:  lr.request.UserAgent(),
+		Status:     lr.response.status,
+		DurationMs: float64(lr.duration.Microseconds()) / 1000,
+		path:       lr.path,
+	}
+
+	ring.next = (ring.next + 1) % len(ring.requests)
+	if ring.next == 0 {
+		ring.full = true
+	}
+}
+
+// Returns recorded requests of given path prefix, or of all when not given,
+// newest first.
+func (ring *requestRing) list(path string) []recentRequest {
+	ring.mu.Lock()
+	defer ring.mu.Unlock()
+
+	n := ring.next
+	if ring.full {
+		n = len(ring.requests)
+	}
+
+	requests := make([]recentRequest, 0, n)
+	for i := 1; i <= n; i++ {
+		rr := ring.requests[(ring.next-i+len(ring.requests))%len(ring.requests)]
+		if strings.HasPrefix(rr.path, path) {
+			requests = append(requests, rr)
+		}
+	}
+	return requests
+}
+
+// Serves recent requests as JSON, newest first, of path prefix given by path
+// query parameter only.
+func serveRecentRequests(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		methodNotAllowed(w, r, "GET", "HEAD")
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, recentRequests.list(r.URL.Query().Get("path")))
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"slices"
+
+	"github.com/gorilla/mux"
+)
+
+// Methods labeled on their own in per method metrics, others labeled as other.
+var knownMethods = map[string]bool{
+	"GET": true, "HEAD": true, "POST": true, "PUT": true, "PATCH": true,
+	"DELETE": true, "CONNECT": true, "OPTIONS": true, "TRACE": true,
+}
+
+// Returns label of request method in per method metrics.
+func methodLabel(method string) string {
+	if knownMethods[method] {
+		return method
+	}
+	return "other"
+}
+
+// Answers request not matching any route with http 404, counting it by method.
+func notFound(w http.ResponseWriter, r *http.Request) {
+	unmatchedRequests.WithLabelValues(methodLabel(r.Method)).Inc()
+	http.Error(w, "Error 404 (Not found)", http.StatusNotFound)
+}
+
+// Returns handler answering requests of methods not allowed by routes of
+// router matching their path with http 405, naming methods of those routes in
+// Allow header. Requests of tracking routes are counted as tracking requests.
+func routeMethodNotAllowed(router *mux.Router) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var methods []string
+		var tracking bool
+
+		router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+			var match mux.RouteMatch
+			if route.Match(r, &match) || match.MatchErr != mux.ErrMethodMismatch {
+				return nil
+			}
+			allowed, _ := route.GetMethods()
+			for _, m := range allowed {
+				if !slices.Contains(methods, m) {
+					methods = append(methods, m)
+				}
+			}
+			tracking = tracking || route.GetName() == trackingRouteName
+			return nil
+		})
+
+		if tracking {
+			countTrackingRequest(r, "method_not_allowed", responseMode(r))
+		}
+		methodNotAllowed(w, r, methods...)
+	})
+}
+
+// Wraps handler with recovery of panics: panics are logged with their stack
+// and counted, and requests answered with http 500. Aborted handlers are
+// left to the server.
+func recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+
+			handlerPanics.Inc()
+			slog.ErrorContext(r.Context(), "http: Handler panicked", "method", r.Method, "path", r.URL.Path, "panic", v,
+				"stack", string(debug.Stack()))
+
+			http.Error(w, "Error 500 (Internal server error)", http.StatusInternalServerError)
+		}()
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestUnmatchedRequestNotFound(t *testing.T) {
+	servers, _, _ := newTestServers(t)
+
+	before := testutil.ToFloat64(unmatchedRequests.WithLabelValues("GET"))
+
+	w := httptest.NewRecorder()
+	servers[0].Handler.ServeHTTP(w, httptest.NewRequest("GET", "/bogus/path", nil))
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("status %d, want 404", w.Code)
+	}
+	if got := testutil.ToFloat64(unmatchedRequests.WithLabelValues("GET")) - before; got != 1 {
+		t.Errorf("%v unmatched requests counted, want 1", got)
+	}
+}
+
+func TestPanickingHandlerRecovered(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/panic", func(w http.ResponseWriter, r *http.Request) { panic("boom") })
+	mux.HandleFunc("/ok", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("OK")) })
+
+	srv := httptest.NewServer(recoverPanics(mux))
+	defer srv.Close()
+
+	before := testutil.ToFloat64(handlerPanics)
+
+	resp, err := http.Get(srv.URL + "/panic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("status of panicking handler %d, want 500", resp.StatusCode)
+	}
+	if got := testutil.ToFloat64(handlerPanics) - before; got != 1 {
+		t.Errorf("%v panics counted, want 1", got)
+	}
+
+	resp, err = http.Get(srv.URL + "/ok")
+	if err != nil {
+		t.Fatalf("server not serving after panic: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status after panic %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	tests := []struct {
+		args   []string
+		method string
+		path   string
+		allow  string
+	}{
+		{nil, "POST", "/track", "GET, HEAD"},
+		{nil, "DELETE", "/track.gif", "GET, HEAD"},
+		{nil, "PUT", "/track/pixel", "GET, HEAD"},
+		{nil, "POST", "/open/message", "GET, HEAD"},
+		{nil, "POST", "/click", "GET, HEAD"},
+		{nil, "POST", "/l/link", "GET, HEAD"},
+		{nil, "GET", "/collect", "POST, OPTIONS"},
+		{nil, "PUT", "/collect/batch", "POST, OPTIONS"},
+		{nil, "POST", "/metrics", "GET, HEAD"},
+		{nil, "PUT", "/state", "GET, HEAD"},
+		{[]string{"--metrics-bearer-token=secret"}, "GET", "/-/reload", "POST"},
+		{[]string{"--cors-allowed-origin=https://example.com"}, "POST", "/track", "GET, HEAD, OPTIONS"},
+		{[]string{"--cors-allowed-origin=https://example.com"}, "POST", "/click", "GET, HEAD, OPTIONS"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			servers, _, _ := newTestServers(t, tt.args...)
+
+			w := httptest.NewRecorder()
+			servers[0].Handler.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+
+			if w.Code != http.StatusMethodNotAllowed {
+				t.Errorf("status %d, want 405", w.Code)
+			}
+			if got := w.Header().Get("Allow"); got != tt.allow {
+				t.Errorf("Allow header %q, want %q", got, tt.allow)
+			}
+		})
+	}
+}
+
+func TestMethodNotAllowedCountedAsTrackingRequest(t *testing.T) {
+	servers, _, _ := newTestServers(t)
+
+	counter := serveImageRequestsCount.WithLabelValues("method_not_allowed", *imageResponseMode)
+	before := testutil.ToFloat64(counter)
+
+	for _, path := range []string{"/track", "/click"} {
+		servers[0].Handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", path, nil))
+	}
+
+	if got := testutil.ToFloat64(counter) - before; got != 1 {
+		t.Errorf("%v tracking requests counted as method not allowed, want 1", got)
+	}
+}
+
+func TestHandlersAnswerMethodNotAllowed(t *testing.T) {
+	parseFlags(t)
+
+	tests := []struct {
+		handler http.HandlerFunc
+		method  string
+		allow   string
+	}{
+		{serveCollect, "GET", "POST, OPTIONS"},
+		{serveCollectBatch, "HEAD", "POST, OPTIONS"},
+	}
+
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		tt.handler(w, httptest.NewRequest(tt.method, "/", nil))
+
+		if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != tt.allow {
+			t.Errorf("status %d and Allow header %q of %s request, want 405 and %q", w.Code, w.Header().Get("Allow"), tt.method, tt.allow)
+		}
+	}
+}
+
+func TestHeadRequestsPassedToHandlers(t *testing.T) {
+	servers, _, _ := newTestServers(t)
+
+	for path, want := range map[string]int{"/track": http.StatusOK, "/l/unknown": http.StatusNotFound} {
+		w := httptest.NewRecorder()
+		servers[0].Handler.ServeHTTP(w, httptest.NewRequest("HEAD", path, nil))
+
+		if w.Code != want {
+			t.Errorf("status %d of HEAD %s, want %d", w.Code, path, want)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	kingpin "gopkg.in/alecthomas/kingpin.v2"
+)
+
+// Settings changeable without restart, read by handlers from snapshot swapped
+// atomically on reload.
+type reloadableConfig struct {
+	rateLimit           float64
+	rateBurst           int
+	globalRateLimit     float64
+	accessLogSampleRate float64
+	healthFall          int
+	healthRise          int
+	stateFileMaxAge     time.Duration
+	maxMemoryBytes      uint64
+	maxGoroutines       int
+}
+
+// Parsers of reloadable settings by flag name, setting them in snapshot.
+var reloadableSettings = map[string]func(c *reloadableConfig, value string) error{
+	"rate-limit": func(c *reloadableConfig, v string) (err error) { c.rateLimit, err = strconv.ParseFloat(v, 64); return },
+	"rate-burst": func(c *reloadableConfig, v string) (err error) { c.rateBurst, err = strconv.Atoi(v); return },
+	"global-rate-limit": func(c *reloadableConfig, v string) (err error) {
+		c.globalRateLimit, err = strconv.ParseFloat(v, 64)
+		return
+	},
+	"access-log-sample-rate": func(c *reloadableConfig, v string) (err error) {
+		c.accessLogSampleRate, err = strconv.ParseFloat(v, 64)
+		return
+	},
+	"health-fall": func(c *reloadableConfig, v string) (err error) { c.healthFall, err = strconv.Atoi(v); return },
+	"health-rise": func(c *reloadableConfig, v string) (err error) { c.healthRise, err = strconv.Atoi(v); return },
+	"state-file-max-age": func(c *reloadableConfig, v string) (err error) {
+		c.stateFileMaxAge, err = time.ParseDuration(v)
+		return
+	},
+	"max-memory-bytes": func(c *reloadableConfig, v string) (err error) {
+		c.maxMemoryBytes, err = strconv.ParseUint(v, 10, 64)
+		return
+	},
+	"max-goroutines": func(c *reloadableConfig, v string) (err error) { c.maxGoroutines, err = strconv.Atoi(v); return },
+}
+
+var (
+	// Reloadable settings in effect, nil until initialized.
+	reloadable atomic.Pointer[reloadableConfig]
+
+	// Values of configuration file as last loaded, to tell keys changed on
+	// reload.
+	loadedConfigFile map[string]any
+
+	// Serializes reloads of SIGHUP and of reload requests.
+	reloadMu sync.Mutex
+)
+
+// Initializes reloadable settings from flags.
+func initReloadableConfig() error {
+	c := flagConfig()
+	if err := c.validate(); err != nil {
+		return err
+	}
+
+	reloadable.Store(c)
+	return nil
+}
+
+// Returns reloadable settings of flags.
+func flagConfig() *reloadableConfig {
+	return &reloadableConfig{
+		rateLimit:           *rateLimit,
+		rateBurst:           *rateBurst,
+		globalRateLimit:     *globalRateLimit,
+		accessLogSampleRate: *accessLogSampleRate,
+		healthFall:          *healthFall,
+		healthRise:          *healthRise,
+		stateFileMaxAge:     *stateFileMaxAge,
+		maxMemoryBytes:      *maxMemoryBytes,
+		maxGoroutines:       *maxGoroutines,
+	}
+}
+
+// Returns reloadable settings in effect, of flags until initialized.
+func currentConfig() *reloadableConfig {
+	if c := reloadable.Load(); c != nil {
+		return c
+	}
+	return flagConfig()
+}
+
+// Validates reloadable settings.
+func (c *reloadableConfig) validate() error {
+	switch {
+	case c.rateLimit < 0 || c.globalRateLimit < 0:
+		return fmt.Errorf("rate limits %v and %v not both non-negative", c.rateLimit, c.globalRateLimit)
+	case c.rateLimit > 0 && c.rateBurst < 1:
+		return fmt.Errorf("rate burst %d not positive", c.rateBurst)
+	case c.accessLogSampleRate < 0 || c.accessLogSampleRate > 1:
+		return fmt.Errorf("access log sample rate %v out of range [0, 1]", c.accessLogSampleRate)
+	case c.healthFall < 1 || c.healthRise < 1:
+		return fmt.Errorf("health fall %d and rise %d not both positive", c.healthFall, c.healthRise)
+	case c.stateFileMaxAge < 0:
+		return fmt.Errorf("state file max age %v negative", c.stateFileMaxAge)
+	case c.maxGoroutines < 0:
+		return fmt.Errorf("max goroutines %d negative", c.maxGoroutines)
+	}
+	return nil
+}
+
+// Reloads configuration: re-reads configuration file, when given, applying
+// reloadable settings not overridden by flags or environment, and reloads
+// source lists, redirect allowlist, pixel identifiers and links from their
+// files. Reload is rejected as a whole when the file is invalid, keeping
+// settings in effect. Changed keys are logged.
+func reloadConfig() error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	if err := applyConfigFile(); err != nil {
+		configReloads.WithLabelValues("failure").Inc()
+		slog.Warn("config: Configuration not reloaded", "path", *configFile, "error", err)
+		return err
+	}
+
+	reloadSources()
+	reloadRedirectAllowlist()
+	reloadPixelIDs()
+	reloadLinks()
+
+	configReloads.WithLabelValues("success").Inc()
+	return nil
+}
+
+// Re-reads configuration file and applies its reloadable settings. Keys of
+// other settings changed are logged as requiring restart.
+func applyConfigFile() error {
+	if *configFile == "" {
+		return nil
+	}
+
+	values, err := readConfigFile(*configFile)
+	if err != nil {
+		return err
+	}
+
+	c := *currentConfig()
+	var unknown, changed, restart []string
+
+	for key, value := range values {
+		if kingpin.CommandLine.GetFlag(key) == nil || key == "config-file" || key == "help" || key == "version" {
+			unknown = append(unknown, key)
+			continue
+		}
+		if _, given := argFlags[key]; given || slices.Contains(envFlags, key) {
+			continue
+		}
+		if reflect.DeepEqual(value, loadedConfigFile[key]) {
+			continue
+		}
+
+		set, ok := reloadableSettings[key]
+		if !ok {
+			restart = append(restart, key)
+			continue
+		}
+
+		defaults, err := configValues(value)
+		if err == nil && len(defaults) != 1 {
+			err = errors.New("single value expected")
+		}
+		if err == nil {
+			err = set(&c, defaults[0])
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %s: %w", *configFile, key, err)
+		}
+		old, ok := loadedConfigFile[key]
+		if !ok {
+			old = flagValue(key)
+		}
+		changed = append(changed, fmt.Sprintf("%s: %v -> %v", key, old, value))
+	}
+
+	// Keys removed from the file keep their values in effect until restart.
+	for key := range loadedConfigFile {
+		if _, ok := values[key]; !ok {
+			restart = append(restart, key)
+		}
+	}
+
+	if len(unknown) > 0 {
+		slices.Sort(unknown)
+		return fmt.Errorf("%s: unknown keys %s", *configFile, strings.Join(unknown, ", "))
+	}
+	if err := c.validate(); err != nil {
+		return err
+	}
+
+	reloadable.Store(&c)
+	loadedConfigFile = values
+	applyGlobalRateLimit(c.globalRateLimit)
+
+	slices.Sort(changed)
+	slices.Sort(restart)
+	slog.Info("config: Configuration reloaded", "path", *configFile, "changed", strings.Join(changed, ", "))
+	if len(restart) > 0 {
+		slog.Warn("config: Settings not reloaded, requiring restart", "keys", strings.Join(restart, ", "))
+	}
+
+	return nil
+}
+
+// Serves reload request: reloads configuration, answering http 200, or http
+// 400 with the error when reload is rejected.
+func serveReload(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+
+	if err := reloadConfig(); err != nil {
+		http.Error(w, "Error 400 (Configuration not reloaded): "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("OK"))
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReloadRouteRequiresCredentials(t *testing.T) {
+	tests := []struct {
+		args          []string
+		authorization string
+		status        int
+	}{
+		{nil, "", http.StatusNotFound},
+		{[]string{"--metrics-bearer-token=secret"}, "", http.StatusUnauthorized},
+		{[]string{"--metrics-bearer-token=secret"}, "Bearer secret", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		servers, _, _ := newTestServers(t, tt.args...)
+
+		r := httptest.NewRequest("POST", "/-/reload", nil)
+		if tt.authorization != "" {
+			r.Header.Set("Authorization", tt.authorization)
+		}
+		w := httptest.NewRecorder()
+		servers[0].Handler.ServeHTTP(w, r)
+
+		if w.Code != tt.status {
+			t.Errorf("status %d of reload with %q and authorization %q, want %d", w.Code, tt.args, tt.authorization, tt.status)
+		}
+	}
+}
+
+func TestReloadRouteOfAdminListener(t *testing.T) {
+	servers, _, _ := newTestServers(t, "--admin-listen-address=localhost:0")
+
+	for i, want := range []int{http.StatusNotFound, http.StatusOK} {
+		w := httptest.NewRecorder()
+		servers[i].Handler.ServeHTTP(w, httptest.NewRequest("POST", "/-/reload", nil))
+
+		if w.Code != want {
+			t.Errorf("status %d of reload on server %d, want %d", w.Code, i, want)
+		}
+	}
+}
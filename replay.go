@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// Dead letter entry being replayed, with its line kept as is unless replay of
+// its event fails again.
+type replayedLetter struct {
+	line   []byte
+	letter deadLetter
+	event  *event
+}
+
+// Replays events of dead letter file through configured event sinks, each
+// event through the sink it failed in, and rewrites the file with entries
+// still failing, and ones of sinks not configured or not parsed, in order.
+func replayDeadLetters() error {
+	if *deadLetterFilePath == "" {
+		return errors.New("dead letter path not given")
+	}
+
+	letters, err := readDeadLetters(*deadLetterFilePath)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	names := sinkNames()
+	if len(names) == 0 {
+		return errors.New("no event sinks given")
+	}
+
+	bySink := map[string][]*replayedLetter{}
+	for _, l := range letters {
+		if l.event != nil {
+			bySink[l.letter.Sink] = append(bySink[l.letter.Sink], l)
+		}
+	}
+
+	var replayed, failed int
+
+	for _, name := range names {
+		if len(bySink[name]) == 0 {
+			continue
+		}
+
+		s, err := newEventSink(name)
+		if err != nil {
+			return err
+		}
+		q := s.(*eventQueue)
+
+		pending := bySink[name]
+		for len(pending) > 0 && ctx.Err() == nil {
+			chunk := pending[:min(q.batchSize, len(pending))]
+			pending = pending[len(chunk):]
+
+			batch := make([]queuedEvent, len(chunk))
+			byEvent := map[*event]*replayedLetter{}
+			for i, l := range chunk {
+				batch[i] = queuedEvent{event: l.event, line: l.letter.Event}
+				byEvent[l.event] = l
+			}
+
+			notDelivered, err := q.deliverBatch(ctx, batch)
+			if err != nil {
+				slog.Warn("replay: Events not delivered", "sink", name, "events", len(notDelivered), "error", err)
+			}
+
+			timestamp := time.Now().Format(time.RFC3339Nano)
+			for _, e := range notDelivered {
+				l := byEvent[e.event]
+				l.letter.Timestamp = timestamp
+				if err != nil {
+					l.letter.Reason = err.Error()
+				}
+				l.line = nil
+				delete(byEvent, e.event)
+			}
+			for _, l := range byEvent {
+				l.line, l.event = nil, nil
+			}
+
+			replayed += len(chunk) - len(notDelivered)
+			failed += len(notDelivered)
+		}
+
+		closeCtx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		err = s.Close(closeCtx)
+		cancel()
+		if err != nil {
+			slog.Warn("replay: Sink not closed", "error", err)
+		}
+	}
+
+	if err := writeReplayedLetters(*deadLetterFilePath, letters); err != nil {
+		return err
+	}
+
+	slog.Info("replay: Dead letters replayed", "path", *deadLetterFilePath, "replayed", replayed, "failed", failed,
+		"remaining", len(letters)-replayed)
+
+	return ctx.Err()
+}
+
+// Reads entries of dead letter file. Entries not parsed are kept without
+// event, so that they are not replayed.
+func readDeadLetters(path string) ([]*replayedLetter, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var letters []*replayedLetter
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		l := &replayedLetter{line: append([]byte(nil), line...)}
+
+		var e event
+		if err := json.Unmarshal(line, &l.letter); err == nil && json.Unmarshal(l.letter.Event, &e) == nil {
+			e.line = l.letter.Event
+			l.event = &e
+		} else {
+			slog.Warn("replay: Dead letter not parsed", "path", path, "line", len(letters)+1)
+		}
+
+		letters = append(letters, l)
+	}
+
+	return letters, scanner.Err()
+}
+
+// Rewrites dead letter file, replacing it atomically, with entries not
+// replayed.
+func writeReplayedLetters(path string, letters []*replayedLetter) error {
+	var b []byte
+	for _, l := range letters {
+		if l.line == nil && l.event == nil {
+			continue
+		}
+
+		line := l.line
+		if line == nil {
+			var err error
+			if line, err = json.Marshal(l.letter); err != nil {
+				return err
+			}
+		}
+		b = append(append(b, line...), '\n')
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, info.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
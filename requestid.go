@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"time"
+)
+
+// Maximum length of request identifiers accepted from trusted peers.
+const maxRequestIDLength = 128
+
+// Crockford's base32 alphabet of ULIDs.
+const ulidAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// Returns request identifier of request of given context, empty when request
+// identifiers are disabled.
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// Wraps handler with identification of requests: identifier is taken from
+// request identifier header of requests of trusted peers, otherwise a ULID
+// is generated, stored in request context and returned in the same header of
+// response. No-op when header is not given.
+func requestIDs(next http.Handler, trusted []netip.Prefix) http.Handler {
+	if *requestIDHeader == "" {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := ""
+		if peer, ok := parseHostIP(r.RemoteAddr); ok && prefixesContain(trusted, peer) {
+			if value := r.Header.Get(*requestIDHeader); validRequestID(value) {
+				id = value
+			}
+		}
+		if id == "" {
+			id = newULID(time.Now())
+		}
+
+		w.Header().Set(*requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey, id)))
+	})
+}
+
+// Checks whether request identifier is non-empty, at most of maximum length,
+// of printable ASCII characters only.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] >= 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns ULID of given time: 48 bits of milliseconds since epoch followed by
+// 80 random bits, encoded as 26 characters of Crockford's base32.
+func newULID(t time.Time) string {
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[:8], uint64(t.UnixMilli())<<16)
+	rand.Read(b[6:])
+
+	hi, lo := binary.BigEndian.Uint64(b[:8]), binary.BigEndian.Uint64(b[8:])
+
+	var s [26]byte
+	for i := 25; i >= 0; i-- {
+		s[i] = ulidAlphabet[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(s[:])
+}
+
+// Service log handler adding request identifier of context of records, if
+// any, logged by handlers of requests.
+type requestIDLogHandler struct {
+	slog.Handler
+}
+
+// Handles record, with request identifier of context.
+func (h requestIDLogHandler) Handle(ctx context.Context, rec slog.Record) error {
+	if id := requestID(ctx); id != "" {
+		rec.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, rec)
+}
+
+// Returns handler of given attributes, adding request identifier still.
+func (h requestIDLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestIDLogHandler{h.Handler.WithAttrs(attrs)}
+}
+
+// Returns handler of given group, adding request identifier still.
+func (h requestIDLogHandler) WithGroup(name string) slog.Handler {
+	return requestIDLogHandler{h.Handler.WithGroup(name)}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Minimum free disk space, either in bytes or as fraction of filesystem size.
+type diskLimit struct {
+	bytes uint64
+	ratio float64
+}
+
+// Checks whether limit is given.
+func (l diskLimit) set() bool {
+	return l.bytes > 0 || l.ratio > 0
+}
+
+// Parses minimum free disk space: bytes, with optional K, M, G or T suffix of
+// powers of 1024, or percent of filesystem size with % suffix. Empty one is
+// not set.
+func parseDiskLimit(s string) (diskLimit, error) {
+	if s == "" {
+		return diskLimit{}, nil
+	}
+
+	if percent, ok := strings.CutSuffix(s, "%"); ok {
+		v, err := strconv.ParseFloat(percent, 64)
+		if err != nil || v < 0 || v > 100 {
+			return diskLimit{}, fmt.Errorf("invalid minimum free disk %q", s)
+		}
+		return diskLimit{ratio: v / 100}, nil
+	}
+
+	number, multiplier := strings.TrimSuffix(strings.ToUpper(s), "B"), uint64(1)
+	for i, suffix := range []string{"K", "M", "G", "T"} {
+		if n, ok := strings.CutSuffix(number, suffix); ok {
+			number, multiplier = n, 1<<(10*(i+1))
+			break
+		}
+	}
+
+	v, err := strconv.ParseUint(number, 10, 64)
+	if err != nil {
+		return diskLimit{}, fmt.Errorf("invalid minimum free disk %q", s)
+	}
+	return diskLimit{bytes: v * multiplier}, nil
+}
+
+// Measured use of resources: free disk space on filesystem of access log,
+// memory and number of goroutines.
+type resourceSample struct {
+	dir        string
+	diskFree   uint64
+	diskTotal  uint64
+	diskErr    error
+	memory     uint64
+	memorySrc  string
+	goroutines int
+}
+
+var (
+	// Configured minimum free disk space.
+	minFreeDisk diskLimit
+
+	// Last measured use of resources, read by health checks.
+	resources atomic.Pointer[resourceSample]
+)
+
+// Initializes checks of resources: parses minimum free disk space, measures
+// use of resources right away and then at every resource check interval.
+func initResourceChecks() error {
+	limit, err := parseDiskLimit(*minFreeDiskLimit)
+	if err != nil {
+		return err
+	}
+	minFreeDisk = limit
+
+	if *resourceInterval <= 0 {
+		return fmt.Errorf("resource check interval %v not positive", *resourceInterval)
+	}
+
+	measureResources()
+
+	ticker := time.NewTicker(*resourceInterval)
+	go func() {
+		defer ticker.Stop()
+
+		for range ticker.C {
+			measureResources()
+		}
+	}()
+
+	return nil
+}
+
+// Measures use of resources, storing it for health checks and setting its
+// gauges.
+func measureResources() {
+	s := &resourceSample{dir: ".", goroutines: runtime.NumGoroutine()}
+	if *accessLogFilePath != "" {
+		s.dir = filepath.Dir(*accessLogFilePath)
+	}
+
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(s.dir, &st); err != nil {
+		s.diskErr = err
+	} else {
+		s.diskFree, s.diskTotal = st.Bavail*uint64(st.Bsize), st.Blocks*uint64(st.Bsize)
+		diskFreeBytes.Set(float64(s.diskFree))
+		if s.diskTotal > 0 {
+			diskFreeRatio.Set(float64(s.diskFree) / float64(s.diskTotal))
+		}
+	}
+
+	s.memory, s.memorySrc = residentMemory(), "resident"
+	if s.memory == 0 {
+		var ms runtime.MemStats
+		runtime.ReadMemStats(&ms)
+		s.memory, s.memorySrc = ms.HeapAlloc, "heap"
+	}
+	memoryBytes.Set(float64(s.memory))
+
+	goroutines.Set(float64(s.goroutines))
+
+	resources.Store(s)
+}
+
+// Returns resident memory of process in bytes, 0 where it is not known, i.e.
+// other than on Linux.
+func residentMemory() uint64 {
+	b, err := os.ReadFile("/proc/self/statm")
+	if err != nil {
+		return 0
+	}
+
+	fields := strings.Fields(string(b))
+	if len(fields) < 2 {
+		return 0
+	}
+
+	pages, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return pages * uint64(os.Getpagesize())
+}
+
+// Checks that filesystem of access log, or of working directory when not
+// logged to file, has space available, at least minimum free disk space when
+// given.
+func checkDiskSpace() (bool, string) {
+	s := resources.Load()
+	if s == nil {
+		return true, "not measured"
+	}
+	if s.diskErr != nil {
+		return false, s.diskErr.Error()
+	}
+
+	detail := fmt.Sprintf("%d bytes free on %s", s.diskFree, s.dir)
+	switch {
+	case s.diskFree < minFreeDisk.bytes:
+		return false, fmt.Sprintf("%s, below minimum of %d", detail, minFreeDisk.bytes)
+	case s.diskTotal > 0 && float64(s.diskFree)/float64(s.diskTotal) < minFreeDisk.ratio:
+		return false, fmt.Sprintf("%s, below minimum of %g%%", detail, minFreeDisk.ratio*100)
+	}
+	return s.diskFree > 0, detail
+}
+
+// Checks that memory of process does not exceed maximum memory when given.
+func checkMemory() (bool, string) {
+	s := resources.Load()
+	if s == nil {
+		return true, "not measured"
+	}
+
+	detail := fmt.Sprintf("%d bytes %s", s.memory, s.memorySrc)
+	if limit := currentConfig().maxMemoryBytes; limit > 0 && s.memory > limit {
+		return false, fmt.Sprintf("%s, above maximum of %d", detail, limit)
+	}
+	return true, detail
+}
+
+// Checks that number of goroutines does not exceed maximum when given.
+func checkGoroutines() (bool, string) {
+	s := resources.Load()
+	if s == nil {
+		return true, "not measured"
+	}
+
+	detail := fmt.Sprintf("%d goroutines", s.goroutines)
+	if limit := currentConfig().maxGoroutines; limit > 0 && s.goroutines > limit {
+		return false, fmt.Sprintf("%s, above maximum of %d", detail, limit)
+	}
+	return true, detail
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// Robots exclusion served unless robots file is given, disallowing all paths.
+const defaultRobotsTxt = "User-agent: *\nDisallow: /\n"
+
+// Robots exclusion served.
+var robotsTxt = []byte(defaultRobotsTxt)
+
+// Loads robots exclusion from configured file.
+func initRobots() error {
+	if *robotsFilePath == "" {
+		return nil
+	}
+
+	b, err := os.ReadFile(*robotsFilePath)
+	if err != nil {
+		return err
+	}
+	robotsTxt = b
+
+	return nil
+}
+
+// Serves robots exclusion, so that crawlers are kept off tracking paths.
+func serveRobots(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		methodNotAllowed(w, r, "GET", "HEAD")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(len(robotsTxt)))
+
+	if r.Method == "HEAD" {
+		return
+	}
+
+	if _, err := w.Write(robotsTxt); err != nil {
+		slog.DebugContext(r.Context(), "robots: Response not written", "path", r.URL.Path, "error", err)
+	}
+}
+
+// Answers favicon requests with no content.
+func serveFavicon(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusNoContent)
+}
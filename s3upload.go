@@ -0,0 +1,218 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// Uploader of rotated event logs to S3, nil when upload is disabled.
+var eventLogUploader *s3Uploader
+
+// Uploader of rotated log files to S3 bucket, under keys partitioned by date
+// and hour of rotation, uploading at every interval until stopped.
+type s3Uploader struct {
+	client   *s3.Client
+	bucket   string
+	prefix   string
+	hostname string
+
+	ctx     context.Context
+	stop    context.CancelFunc
+	stopped chan struct{}
+
+	mu  sync.Mutex
+	seq int
+}
+
+// Initializes upload of event log to S3, rotated and uploaded at every
+// configured interval, when bucket is given.
+func initS3Upload() error {
+	if *s3Bucket == "" {
+		return nil
+	}
+
+	if eventLogFile == nil {
+		return errors.New("s3 upload requires event log path")
+	}
+
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		return err
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := context.WithCancel(context.Background())
+	eventLogUploader = &s3Uploader{
+		client:   s3.NewFromConfig(cfg),
+		bucket:   *s3Bucket,
+		prefix:   strings.Trim(*s3Prefix, "/"),
+		hostname: hostname,
+		ctx:      ctx,
+		stop:     stop,
+		stopped:  make(chan struct{}),
+	}
+
+	go eventLogUploader.run(eventLogFile, *s3UploadInterval)
+
+	slog.Info("s3: Uploading event logs", "bucket", *s3Bucket, "prefix", *s3Prefix, "interval", *s3UploadInterval)
+
+	return nil
+}
+
+// Uploads log file at every interval until stopped.
+func (u *s3Uploader) run(f *logFile, interval time.Duration) {
+	defer close(u.stopped)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			u.upload(u.ctx, f)
+		case <-u.ctx.Done():
+			return
+		}
+	}
+}
+
+// Rotates log file and uploads its backups, compressed, deleting uploaded
+// ones. Failed uploads are retried on next upload.
+func (u *s3Uploader) upload(ctx context.Context, f *logFile) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if info, err := os.Stat(f.path); err == nil && info.Size() > 0 {
+		if err := f.Rotate(); err != nil {
+			slog.Warn("s3: Log file not rotated", "path", f.path, "error", err)
+		}
+	}
+
+	paths, times, err := logBackups(f.path)
+	if err != nil {
+		slog.Warn("s3: Rotated log files not listed", "path", f.path, "error", err)
+		return
+	}
+
+	for i, p := range paths {
+		// Backup is being compressed by rotation still.
+		if !strings.HasSuffix(p, ".gz") && i+1 < len(paths) && paths[i+1] == p+".gz" {
+			continue
+		}
+
+		if err := u.uploadFile(ctx, p, times[i]); err != nil {
+			s3UploadErrors.Inc()
+			slog.Warn("s3: Rotated log file not uploaded", "path", p, "error", err)
+			continue
+		}
+
+		s3Uploads.Inc()
+	}
+}
+
+// Uploads rotated log file, compressed unless already, and deletes it.
+func (u *s3Uploader) uploadFile(ctx context.Context, p string, rotated time.Time) error {
+	if !strings.HasSuffix(p, ".gz") {
+		compressed, err := compressFile(p)
+		if err != nil {
+			return err
+		}
+		p = compressed
+	}
+
+	file, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// Sequence numbers of uploads follow start time of process, so that keys
+	// of restarted processes do not collide.
+	u.seq++
+	rotated = rotated.UTC()
+	key := fmt.Sprintf("dt=%s/hour=%s/%s-%d-%d.json.gz",
+		rotated.Format("2006-01-02"), rotated.Format("15"), u.hostname, startTime.Unix(), u.seq)
+	if u.prefix != "" {
+		key = path.Join(u.prefix, key)
+	}
+
+	if _, err := u.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:          aws.String(u.bucket),
+		Key:             aws.String(key),
+		Body:            file,
+		ContentType:     aws.String("application/json"),
+		ContentEncoding: aws.String("gzip"),
+	}); err != nil {
+		return err
+	}
+
+	slog.Info("s3: Rotated log file uploaded", "path", p, "key", key)
+
+	return os.Remove(p)
+}
+
+// Compresses file with gzip, replacing it with compressed one. Returned is
+// path to compressed file.
+func compressFile(p string) (string, error) {
+	src, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(p+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return "", err
+	}
+
+	gz := gzip.NewWriter(dst)
+	_, err = io.Copy(gz, src)
+	if err == nil {
+		err = gz.Close()
+	}
+	if err == nil {
+		err = dst.Close()
+	} else {
+		dst.Close()
+	}
+	if err != nil {
+		os.Remove(p + ".gz")
+		return "", err
+	}
+
+	return p + ".gz", os.Remove(p)
+}
+
+// Stops periodic upload of event log, then rotates and uploads it one final
+// time, within context deadline.
+func uploadEventLogs(ctx context.Context) {
+	if eventLogUploader == nil {
+		return
+	}
+
+	eventLogUploader.stop()
+	select {
+	case <-eventLogUploader.stopped:
+	case <-ctx.Done():
+		return
+	}
+
+	eventLogUploader.upload(ctx, eventLogFile)
+}
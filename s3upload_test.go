@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// Starts S3 endpoint accepting uploads, returning uploader of it and function
+// returning paths of uploaded objects.
+func newTestS3Uploader(t *testing.T) (*s3Uploader, func() []string) {
+	t.Helper()
+
+	var mu sync.Mutex
+	var paths []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.URL.Path)
+		mu.Unlock()
+	}))
+	t.Cleanup(srv.Close)
+
+	ctx, stop := context.WithCancel(context.Background())
+	u := &s3Uploader{
+		client: s3.New(s3.Options{
+			BaseEndpoint: aws.String(srv.URL),
+			Region:       "us-east-1",
+			UsePathStyle: true,
+			Credentials:  aws.AnonymousCredentials{},
+		}),
+		bucket:   "events",
+		hostname: "host",
+		ctx:      ctx,
+		stop:     stop,
+		stopped:  make(chan struct{}),
+	}
+
+	return u, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return slices.Clone(paths)
+	}
+}
+
+func TestS3UploadKeysOfSameRotationTimeDiffer(t *testing.T) {
+	u, uploaded := newTestS3Uploader(t)
+
+	dir := t.TempDir()
+	rotated := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	for _, name := range []string{"events-1.log", "events-2.log"} {
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, []byte("{}\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := u.uploadFile(context.Background(), p, rotated); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	paths := uploaded()
+	if len(paths) != 2 || paths[0] == paths[1] {
+		t.Errorf("objects %q uploaded, want two of different keys", paths)
+	}
+	for _, p := range paths {
+		if dir, _ := filepath.Split(p); dir != "/events/dt=2026-03-01/hour=12/" {
+			t.Errorf("object %q not partitioned by rotation date and hour", p)
+		}
+	}
+}
+
+func TestS3UploadStopped(t *testing.T) {
+	u, _ := newTestS3Uploader(t)
+
+	f := openTestLogFile(t, filepath.Join(t.TempDir(), "events.log"))
+	go u.run(f, time.Millisecond)
+
+	u.stop()
+	select {
+	case <-u.stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("upload not stopped")
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Tracking script firing tracking image, with endpoint and pixel identifier
+// placeholders.
+//
+//go:embed tracker.js
+var trackerScript []byte
+
+// Serves tracking script, with endpoint and pixel identifier of query
+// parameters, of configuration otherwise, cached by browsers for configured
+// duration. Endpoint defaults to tracking path of requested host.
+func serveScript(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		methodNotAllowed(w, r, "GET", "HEAD")
+		return
+	}
+
+	query := r.URL.Query()
+
+	endpoint := query.Get("endpoint")
+	if endpoint == "" {
+		endpoint = *scriptEndpoint
+	}
+	if endpoint == "" {
+		endpoint = "//" + r.Host + *trackingURLPath
+	}
+	if u, err := url.Parse(endpoint); err != nil || (u.Scheme != "" && u.Scheme != "http" && u.Scheme != "https") {
+		http.Error(w, "Error 400 (Invalid endpoint)", http.StatusBadRequest)
+		return
+	}
+
+	pixelID := query.Get("pixel")
+	if pixelID == "" {
+		pixelID = *scriptPixelID
+	}
+
+	script := renderScript(endpoint, strings.TrimSuffix(pixelID, "/"))
+
+	h := fnv.New64a()
+	h.Write(script)
+	etag := `"` + strconv.FormatUint(h.Sum64(), 36) + `"`
+
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(scriptMaxAge.Seconds())))
+	w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+	w.Header().Set("ETag", etag)
+	w.Header().Add("Vary", "Accept-Encoding")
+
+	if match := r.Header.Get("If-None-Match"); match != "" && etagMatches(match, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+		var b bytes.Buffer
+		gz := gzip.NewWriter(&b)
+		gz.Write(script)
+		gz.Close()
+
+		script = b.Bytes()
+		w.Header().Set("Content-Encoding", "gzip")
+	}
+
+	w.Header().Set("Content-Length", strconv.Itoa(len(script)))
+
+	if r.Method == "HEAD" {
+		return
+	}
+	w.Write(script)
+}
+
+// Returns tracking script with endpoint and pixel identifier placeholders
+// replaced by JSON string literals, safe to embed in script.
+func renderScript(endpoint, pixelID string) []byte {
+	literal := func(s string) []byte {
+		b, _ := json.Marshal(s)
+		return b
+	}
+
+	script := bytes.Replace(trackerScript, []byte(`"%ENDPOINT%"`), literal(endpoint), 1)
+	return bytes.Replace(script, []byte(`"%PIXEL_ID%"`), literal(pixelID), 1)
+}
+
+// Checks whether If-None-Match header matches entity tag, weakly.
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// Wraps handler with setting of enabled security headers on every response:
+// X-Content-Type-Options, Referrer-Policy and, for requests over TLS,
+// Strict-Transport-Security. No-op when security headers are not enabled.
+func securityHeaders(next http.Handler) http.Handler {
+	if !*securityHeadersEnabled {
+		return next
+	}
+
+	hsts := ""
+	if seconds := int64(hstsMaxAge.Seconds()); seconds > 0 {
+		hsts = "max-age=" + strconv.FormatInt(seconds, 10)
+		if *hstsIncludeSubdomains {
+			hsts += "; includeSubDomains"
+		}
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hsts != "" && r.TLS != nil {
+			w.Header().Set("Strict-Transport-Security", hsts)
+		}
+		if *contentTypeNosniff {
+			w.Header().Set("X-Content-Type-Options", "nosniff")
+		}
+		if *referrerPolicy != "" {
+			w.Header().Set("Referrer-Policy", *referrerPolicy)
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
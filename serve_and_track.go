@@ -10,36 +10,311 @@ and service metrics (via use of Prometheus client library).
 package main
 
 import (
+	"cmp"
 	"context"
-	"log"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
-	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/crypto/acme/autocert"
 
 	kingpin "gopkg.in/alecthomas/kingpin.v2"
 )
 
+// Commands
+var (
+	serveCommand  = kingpin.Command("serve", "Serve tracking image (default).").Default()
+	replayCommand = kingpin.Command("replay", "Replay events of --dead-letter-path through --sink, each through the sink it failed in, keeping still failing ones.")
+	signCommand   = kingpin.Command("sign", "Print tracking URL signed with --signing-secret.")
+	checkCommand  = kingpin.Command("check", "Validate configuration of flags, environment and configuration file, printing problems found, without serving.")
+
+	signURLArg = signCommand.Arg("url", "Tracking URL or path, with query parameters, to sign.").Required().String()
+	signTTL    = signCommand.Flag("ttl", "Duration for which signed URL is valid.").Default("720h").Duration()
+)
+
 // Command line configuration options
 var (
-	listenAddress = kingpin.Flag("listen-address", "Address on which to expose metrics and web interface.").Default(":8080").String()
+	configFile         = kingpin.Flag("config-file", "YAML (.yaml or .yml) or TOML (.toml) file of configuration, keyed by names of flags, overridden by flags and by SERVE_AND_TRACK_ prefixed environment variables named after flags. Rate limits, access log sample rate, health fall and rise, state file max age and resource limits are reloaded on SIGHUP and on POST /-/reload of admin listener, served when admin listen address or metrics credentials are given.").String()
+	listenAddress      = kingpin.Flag("listen-address", "Address on which to expose metrics and web interface, unix:///path for Unix domain socket.").Default(":8080").String()
+	adminListenAddress = kingpin.Flag("admin-listen-address", "Address on which to expose metrics and state separately from tracking image.").String()
+	socketMode         = kingpin.Flag("socket-mode", "File mode of Unix domain socket, in octal.").Default("0660").String()
+	systemdSocket      = kingpin.Flag("systemd-socket", "Serve tracking image on socket passed by systemd socket activation instead of listen address.").Bool()
+
+	enableProxyProtocol         = kingpin.Flag("enable-proxy-protocol", "Parse PROXY protocol v1 and v2 headers of connections to listen address.").Bool()
+	proxyProtocolAllowedSources = kingpin.Flag("proxy-protocol-allowed-source", "Address or CIDR allowed to send PROXY protocol header, any when none given (repeatable).").Strings()
+
+	readTimeout       = kingpin.Flag("read-timeout", "Maximum duration for reading entire request.").Default("5s").Duration()
+	readHeaderTimeout = kingpin.Flag("read-header-timeout", "Maximum duration for reading request headers.").Default("2s").Duration()
+	writeTimeout      = kingpin.Flag("write-timeout", "Maximum duration for writing response.").Default("10s").Duration()
+	idleTimeout       = kingpin.Flag("idle-timeout", "Maximum duration to wait for next request on keep-alive connection.").Default("60s").Duration()
+
+	rateLimit       = kingpin.Flag("rate-limit", "Maximum rate of tracking requests per client IP, per second, 0 for unlimited.").Default("0").Float64()
+	rateBurst       = kingpin.Flag("rate-burst", "Maximum burst of tracking requests per client IP.").Default("10").Int()
+	globalRateLimit = kingpin.Flag("global-rate-limit", "Maximum rate of tracking requests in total, per second, over which load is shed, 0 for unlimited.").Default("0").Float64()
+
+	realIPHeaderName   = kingpin.Flag("real-ip-header", "Request header carrying client address as set by a CDN, e.g. CF-Connecting-IP or True-Client-IP.").String()
+	realIPTrustedCIDRs = kingpin.Flag("real-ip-trusted-cidr", "CIDR of CDN peers whose real IP header determines client address (repeatable).").Strings()
+
+	anonymizeIP = kingpin.Flag("anonymize-ip", "Anonymization of client IPs in logs and events: none, truncate (last octet, last 80 bits of IPv6) or hash (HMAC-SHA256).").Default("none").Enum("none", "truncate", "hash")
+	ipHashSalt  = kingpin.Flag("ip-hash-salt", "Salt of client IP hashes, secret from which salt is derived in daily rotation mode.").String()
+
+	ipHashSaltRotation = kingpin.Flag("ip-hash-salt-rotation", "Rotation of client IP hash salt: none or daily (derived from current UTC date, rotated at midnight).").Default("none").Enum("none", "daily")
+
+	blockCIDRFilePath = kingpin.Flag("block-cidr-file", "File with addresses or CIDRs of sources blocked from tracking and collect paths, one per line. Reloaded on SIGHUP.").String()
+	allowCIDRFilePath = kingpin.Flag("allow-cidr-file", "File with addresses or CIDRs of sources allowed to reach metrics and state, one per line, any allowed when not given. Reloaded on SIGHUP.").String()
+
+	trustedProxyCIDRs = kingpin.Flag("trusted-proxy-cidr", "CIDR of trusted proxies whose Forwarded, X-Forwarded-For and X-Real-IP headers determine client address (repeatable).").Strings()
+
+	shutdownTimeout = kingpin.Flag("shutdown-timeout", "Maximum duration to wait for open requests on shutdown.").Default("8s").Duration()
+	upgradeTimeout  = kingpin.Flag("upgrade-timeout", "Maximum duration to wait for the new process to get ready on upgrade (SIGUSR2).").Default("30s").Duration()
+	shutdownDelay   = kingpin.Flag("shutdown-delay", "Duration to keep serving, reporting service unhealthy, before shutdown.").Default("0s").Duration()
+
+	maxConnections = kingpin.Flag("max-connections", "Maximum number of concurrently open connections per listener, 0 for unlimited.").Default("0").Int()
+
+	trackingURLPath            = kingpin.Flag("tracking-url-path", "Path under which to expose tracking image, also with pixel identifier as last path segment, and with .gif, .png or .webp extension for image of that format.").Default("/track").String()
+	signingSecret              = kingpin.Flag("signing-secret", "Secret with which tracking URLs are signed, requests not signed are counted as unsigned and not recorded as events.").String()
+	signedParams               = kingpin.Flag("signed-param", "Query parameter of tracking URLs covered by signature (repeatable).").Strings()
+	dedupWindow                = kingpin.Flag("dedup-window", "Duration for which nonce (n query parameter) of tracking request is remembered, repeated requests marked as duplicate, 0 to disable.").Default("1h").Duration()
+	dedupMaxEntries            = kingpin.Flag("dedup-max-entries", "Maximum number of remembered nonces, over which oldest ones are forgotten early.").Default("100000").Int()
+	openURLPath                = kingpin.Flag("open-url-path", "Path under which to expose tracking image of email opens, followed by message identifier as last path segment.").Default("/open").String()
+	clickURLPath               = kingpin.Flag("click-url-path", "Path under which to expose click redirects, to destination in url query parameter.").Default("/click").String()
+	collectURLPath             = kingpin.Flag("collect-url-path", "Path under which to collect events posted as JSON, form-encoded or plain text bodies, e.g. by navigator.sendBeacon.").Default("/collect").String()
+	maxBodyBytes               = kingpin.Flag("max-body-bytes", "Maximum size in bytes of bodies of collect requests.").Default("65536").Int64()
+	maxBatchEvents             = kingpin.Flag("max-batch-events", "Maximum number of events posted at once as JSON array to batch collect path, under collect path.").Default("100").Int()
+	linkURLPath                = kingpin.Flag("link-url-path", "Path under which to expose short links, followed by link identifier as last path segment.").Default("/l").String()
+	imageResponseMode          = kingpin.Flag("response-mode", "Response to tracking requests: gif, serving tracking image, or 204, serving no content, overridden per request by r query parameter unless on open path.").Default("gif").Enum(gifResponseMode, noContentResponseMode)
+	cacheMode                  = kingpin.Flag("cache-mode", "Caching of tracking image: no-store, fetching it on every view, or revalidate, revalidating it with entity tag and modification time, answered with 304 when not modified.").Default("no-store").Enum(noStoreCacheMode, revalidateCacheMode)
+	imageFilePath              = kingpin.Flag("image-path", "File with image to serve as tracking image under tracking path, e.g. logo, instead of transparent one, served when file is not loaded. Reloaded on change.").String()
+	prefetchSignaturesFilePath = kingpin.Flag("prefetch-signatures-file", "File with signatures of prefetches by image proxies of mail providers, one per line: ua substring, ua-exact user agent, header name or cidr of proxy addresses, replacing built-in ones. Reloaded on change.").String()
+	geoIPDBPath                = kingpin.Flag("geoip-db-path", "MaxMind GeoIP2 or GeoLite2 City database locating client addresses of tracking requests, by country, region and city in events and by country in per country metric. Reloaded on change.").String()
+	pixelIDFilePath            = kingpin.Flag("pixel-id-file", "File with pixel and link identifiers, one per line, labeled on their own in per pixel and per link metrics, others labeled as other. Reloaded on change.").String()
+	serveRobotsEnabled         = kingpin.Flag("serve-robots", "Serve /robots.txt and answer /favicon.ico with no content, --no-serve-robots to leave them unmatched.").Default("true").Bool()
+	robotsFilePath             = kingpin.Flag("robots-path", "File with robots exclusion served as /robots.txt, disallowing all paths when not given.").String()
+	metricNamespace            = kingpin.Flag("metric-namespace", "Namespace prefixing names of all metrics, e.g. namespace_tracking_requests_count_total.").String()
+	enableGoMetrics            = kingpin.Flag("enable-go-metrics", "Expose Go runtime metrics, go_*.").Bool()
+	enableProcessMetrics       = kingpin.Flag("enable-process-metrics", "Expose process metrics, process_*.").Bool()
+	pushGatewayURL             = kingpin.Flag("push-gateway-url", "URL of Prometheus Pushgateway to push metrics to, grouped by instance, deleted on shutdown.").String()
+	remoteWriteURL             = kingpin.Flag("remote-write-url", "URL of Prometheus remote write endpoint to send metrics to.").String()
+	pushInterval               = kingpin.Flag("push-interval", "Interval of pushing metrics to Pushgateway or via remote write.").Default("15s").Duration()
+	pushJob                    = kingpin.Flag("push-job", "Job label of pushed metrics.").Default("serve-and-track").String()
+	statsdAddress              = kingpin.Flag("statsd-address", "Address of StatsD or DogStatsD to mirror request count, duration and size metrics to, udp://host:8125 or unixgram:///path for Unix domain socket.").String()
+	statsdPrefix               = kingpin.Flag("statsd-prefix", "Prefix of names of StatsD metrics.").Default("serve_and_track").String()
+	statsdBufferSize           = kingpin.Flag("statsd-buffer-size", "Maximum number of StatsD metrics buffered for sending, others being dropped.").Default("4096").Int()
+	requestIDHeader            = kingpin.Flag("request-id-header", "Header of request identifiers, taken from requests of trusted proxies or generated, returned in responses and logged, empty disabling them.").Default("X-Request-ID").String()
+	otlpEndpoint               = kingpin.Flag("otlp-endpoint", "OTLP endpoint to export traces of requests and event deliveries to, grpc://host:4317, grpcs://host:4317 or http(s)://host:4318.").String()
+	traceSampleRatio           = kingpin.Flag("trace-sample-ratio", "Ratio of traces sampled, unless sampled by parent of W3C traceparent header.").Default("1").Float64()
+	metricsURLPath             = kingpin.Flag("metrics-url-path", "Path under which to expose service metrics.").Default("/metrics").String()
+	durationBuckets            = kingpin.Flag("duration-buckets", "Buckets of request duration histogram, comma-separated seconds.").Default("0.0001,0.00025,0.0005,0.001,0.0025,0.005,0.01,0.025,0.05,0.1,0.25,0.5,1").String()
+	nativeHistogramFactor      = kingpin.Flag("native-histogram-bucket-factor", "Growth factor of buckets of native request duration histogram, exposed alongside classic buckets, 0 disabling it.").Default("1.1").Float64()
+	exemplarThreshold          = kingpin.Flag("exemplar-threshold", "Request duration above which trace or request identifier is attached as exemplar to observation, when tracing or request identifiers are enabled.").Default("100ms").Duration()
+	legacySummary              = kingpin.Flag("legacy-summary", "Expose deprecated request duration summary of tracking requests alongside histogram, to be removed in next release.").Bool()
+	debugRingSize              = kingpin.Flag("debug-ring-size", "Number of most recent requests kept and exposed under /debug/requests, with admin listen address if given, requiring metrics credentials, 0 disabling them.").Default("100").Int()
+	enablePprof                = kingpin.Flag("enable-pprof", "Expose profiling under /debug/pprof/ and expvar under /debug/vars, with admin listen address if given, requiring metrics credentials.").Bool()
+	metricsUsername            = kingpin.Flag("metrics-username", "Username of basic authentication required by metrics, together with --metrics-password.").String()
+	metricsPassword            = kingpin.Flag("metrics-password", "Password of basic authentication required by metrics.").String()
+	metricsBearerToken         = kingpin.Flag("metrics-bearer-token", "Bearer token required by metrics, accepted alongside basic authentication when both are given.").String()
+	statsURLPath               = kingpin.Flag("stats-url-path", "Path under which to expose stats of tracking requests and service as JSON, empty disabling them.").Default("/stats").String()
+	enableDashboard            = kingpin.Flag("enable-dashboard", "Serve dashboard page of stats under dashboard path, requiring metrics credentials.").Bool()
+	dashboardURLPath           = kingpin.Flag("dashboard-url-path", "Path under which to expose dashboard page.").Default("/dashboard").String()
+	topWindow                  = kingpin.Flag("top-window", "Sliding window over which top referer domains, user agents and pixel identifiers are served under stats path.").Default("15m").Duration()
+	topCapacity                = kingpin.Flag("top-capacity", "Number of values of each field counted by sketch of top values, bounding memory use and accuracy.").Default("1000").Int()
+	stateURLPath               = kingpin.Flag("state-url-path", "Path under which to expose service state.").Default("/state").String()
+	livenessURLPath            = kingpin.Flag("liveness-url-path", "Path under which to expose liveness of service, failing only when event pipeline is wedged, empty disabling it.").Default("/healthz/live").String()
+	readinessURLPath           = kingpin.Flag("readiness-url-path", "Path under which to expose readiness of service, failing as soon as service is draining or when critical health checks fail, empty disabling it.").Default("/healthz/ready").String()
+	deadlockThreshold          = kingpin.Flag("deadlock-threshold", "Duration of event pipeline making no progress with events pending, after which service is reported not alive.").Default("2m").Duration()
+	enableEventStream          = kingpin.Flag("enable-event-stream", "Stream tracking events as server-sent events under stream path, under events path, requiring metrics credentials.").Bool()
+	eventStreamMaxClients      = kingpin.Flag("event-stream-max-clients", "Maximum number of concurrent clients of event stream.").Default("10").Int()
+	eventsURLPath              = kingpin.Flag("events-url-path", "Path under which to expose events stored in SQLite database.").Default("/events").String()
+
+	metricLabelParams        = kingpin.Flag("metric-label-param", "Query parameter to partition tracking requests by in per parameter metric, e.g. utm_campaign (repeatable).").Strings()
+	metricLabelAllowlistFile = kingpin.Flag("metric-label-allowlist-file", "File with allowed values of metric label parameters, one param=value per line, other values of given parameters labeled as other. Reloaded on change.").String()
+	metricLabelMaxValues     = kingpin.Flag("metric-label-max-values", "Maximum number of distinct values per metric label parameter, over which values are labeled as other.").Default("100").Int()
 
-	trackingURLPath = kingpin.Flag("tracking-url-path", "Path under which to expose tracking image.").Default("/track").String()
-	metricsURLPath  = kingpin.Flag("metrics-url-path", "Path under which to expose service metrics.").Default("/metrics").String()
-	stateURLPath    = kingpin.Flag("state-url-path", "Path under which to expose service state.").Default("/state").String()
+	linkMapFile    = kingpin.Flag("link-map-file", "YAML file (.yaml or .yml) mapping link identifiers to destination URLs, or to url and status (301 or 302), or CSV file of id,url[,status] records. Reloaded on change and on SIGHUP.").String()
+	scriptURLPath  = kingpin.Flag("script-url-path", "Path under which to expose tracking script firing tracking image.").Default("/t.js").String()
+	scriptEndpoint = kingpin.Flag("script-endpoint", "URL of tracking image fired by tracking script, unless given in endpoint query parameter, tracking path of requested host when not given.").String()
+	scriptPixelID  = kingpin.Flag("script-pixel-id", "Pixel identifier of tracking image fired by tracking script, unless given in pixel query parameter.").String()
+	scriptMaxAge   = kingpin.Flag("script-max-age", "Duration for which browsers may cache tracking script.").Default("24h").Duration()
 
-	stateFilePath = kingpin.Flag("state-file-path", "File path which indicates service state.").Default("./state").String()
+	respectDNT                = kingpin.Flag("respect-dnt", "Serve requests with DNT or Sec-GPC header without tracking them: with no events, no visitor cookie, and client address redacted in access log.").Bool()
+	visitorCookieName         = kingpin.Flag("visitor-cookie-name", "Name of cookie identifying visitors across tracking requests, recorded in events, disabled when not given.").String()
+	visitorCookieMaxAge       = kingpin.Flag("visitor-cookie-max-age", "Duration for which visitor cookie is kept by browsers.").Default("8760h").Duration()
+	visitorCookieDomain       = kingpin.Flag("visitor-cookie-domain", "Domain of visitor cookie, host of tracking requests when not given.").String()
+	visitorCookieSecure       = kingpin.Flag("visitor-cookie-secure", "Send visitor cookie over HTTPS only.").Bool()
+	visitorCookieSameSite     = kingpin.Flag("visitor-cookie-same-site", "SameSite attribute of visitor cookie: lax, strict or none, the latter requiring --visitor-cookie-secure.").Default("lax").Enum("lax", "strict", "none")
+	visitorCookieDisableOnDNT = kingpin.Flag("visitor-cookie-disable-on-dnt", "Neither read nor set visitor cookie of requests with DNT or Sec-GPC header.").Bool()
+
+	optOutURLPath        = kingpin.Flag("optout-url-path", "Path under which to opt clients out of tracking with opt-out cookie, with opt-out status under it, empty to disable.").Default("/optout").String()
+	optOutRedirectURL    = kingpin.Flag("optout-redirect-url", "URL to redirect clients to once opted out, confirmation page served when not given.").String()
+	optOutCookieName     = kingpin.Flag("optout-cookie-name", "Name of cookie of clients opted out of tracking.").Default("optout").String()
+	optOutCookieMaxAge   = kingpin.Flag("optout-cookie-max-age", "Duration for which opt-out cookie is kept by browsers.").Default("43800h").Duration()
+	optOutCookieDomain   = kingpin.Flag("optout-cookie-domain", "Domain of opt-out cookie, host of opt-out requests when not given.").String()
+	optOutCookieSecure   = kingpin.Flag("optout-cookie-secure", "Send opt-out cookie over HTTPS only.").Bool()
+	optOutCookieSameSite = kingpin.Flag("optout-cookie-same-site", "SameSite attribute of opt-out cookie: lax, strict or none, the latter requiring --optout-cookie-secure.").Default("lax").Enum("lax", "strict", "none")
+
+	responseHeaderValues  = kingpin.Flag("response-header", "Header set on tracking image responses, as Name: value, e.g. X-Cache-Key: pixel (repeatable).").Strings()
+	responseHeadersGlobal = kingpin.Flag("response-header-global", "Set response headers on every response, not only on tracking image ones.").Bool()
+
+	serverHeaderEnabled    = kingpin.Flag("server-header", "Set Server header of service name and version on every response.").Bool()
+	securityHeadersEnabled = kingpin.Flag("security-headers", "Set security headers on every response: Strict-Transport-Security over TLS, X-Content-Type-Options and Referrer-Policy.").Bool()
+	hstsMaxAge             = kingpin.Flag("hsts-max-age", "Duration for which clients are to use TLS only, in Strict-Transport-Security header, 0 to disable it.").Default("8760h").Duration()
+	hstsIncludeSubdomains  = kingpin.Flag("hsts-include-subdomains", "Apply Strict-Transport-Security header to subdomains.").Bool()
+	contentTypeNosniff     = kingpin.Flag("content-type-nosniff", "Set X-Content-Type-Options header to nosniff, --no-content-type-nosniff to disable it.").Default("true").Bool()
+	referrerPolicy         = kingpin.Flag("referrer-policy", "Value of Referrer-Policy header, empty to disable it.").Default("strict-origin-when-cross-origin").String()
+
+	corsAllowedOrigins = kingpin.Flag("cors-allowed-origin", "Origin allowed to make cross-origin tracking and collect requests, *.example.com for subdomains or * for any origin without credentials (repeatable).").Strings()
+	corsAllowedMethods = kingpin.Flag("cors-allowed-methods", "Method allowed in cross-origin tracking and collect requests (repeatable).").Default("GET", "POST").Strings()
+	corsMaxAge         = kingpin.Flag("cors-max-age", "Duration for which browsers may cache responses to CORS preflight requests.").Default("10m").Duration()
+
+	redirectAllowlistFile = kingpin.Flag("redirect-allowlist-file", "File with domains or URL prefixes, one per line, clicks are allowed to redirect to, others rejected. Reloaded on change.").String()
+
+	stateFilePath        = kingpin.Flag("state-file-path", "File path which indicates service state.").Default("./state").String()
+	stateFileMaxAge      = kingpin.Flag("state-file-max-age", "Age of modification time of state file above which service is reported unhealthy, 0 disabling the check.").Default("0s").Duration()
+	minFreeDiskLimit     = kingpin.Flag("min-free-disk", "Minimum free space on filesystem of access log, in bytes with optional K, M, G or T suffix or in percent with % suffix, below which service is reported unhealthy.").String()
+	maxMemoryBytes       = kingpin.Flag("max-memory-bytes", "Maximum resident memory of process in bytes, or Go heap where it is not known, above which service is reported unhealthy, 0 disabling the check.").Default("0").Uint64()
+	maxGoroutines        = kingpin.Flag("max-goroutines", "Maximum number of goroutines above which service is reported unhealthy, 0 disabling the check.").Default("0").Int()
+	resourceInterval     = kingpin.Flag("resource-check-interval", "Interval at which free disk space, memory and goroutines are measured.").Default("10s").Duration()
+	healthProbeURL       = kingpin.Flag("health-http-probe-url", "URL of downstream service probed with GET at health probe interval, service being reported unhealthy after consecutive failures.").String()
+	healthProbeTimeout   = kingpin.Flag("health-http-probe-timeout", "Timeout of GET of health probe URL.").Default("2s").Duration()
+	healthProbeFailures  = kingpin.Flag("health-http-probe-failures", "Number of consecutive failures of health probe URL after which service is reported unhealthy.").Default("3").Int()
+	healthCommand        = kingpin.Flag("health-check-command", "Command run at health probe interval, split on spaces and run without shell, service being reported unhealthy on its non-zero exit, its output becoming detail of the check.").String()
+	healthCommandTimeout = kingpin.Flag("health-check-command-timeout", "Timeout after which health check command is killed and the check failed.").Default("5s").Duration()
+	healthProbeInterval  = kingpin.Flag("health-probe-interval", "Interval of health probe URL and health check command.").Default("10s").Duration()
+	healthInterval       = kingpin.Flag("health-interval", "Interval at which health checks are evaluated in background, service state being served as last evaluated.").Default("2s").Duration()
+	healthFall           = kingpin.Flag("health-fall", "Number of consecutive unhealthy evaluations after which service is reported unhealthy.").Default("1").Int()
+	healthRise           = kingpin.Flag("health-rise", "Number of consecutive healthy evaluations after which unhealthy service is reported healthy again.").Default("1").Int()
+	overrideMaxDuration  = kingpin.Flag("override-max-duration", "Duration after which override of service health, by PUT of state path with admin listen address if given, requiring metrics credentials, expires unless cleared before.").Default("1h").Duration()
+	stateFileContent     = kingpin.Flag("state-file-content", "Drive service state by first line of state file, when it is either ok or fail: <reason>, rather than by its presence only.").Bool()
 
 	accessLogFilePath  = kingpin.Flag("access-log-path", "File path where requests will be logged.").String()
 	serviceLogFilePath = kingpin.Flag("service-log-path", "File path where requests will be logged.").String()
+
+	accessLogSampleRate = kingpin.Flag("access-log-sample-rate", "Fraction of successful (2xx) requests logged to access log, other requests are always logged.").Default("1").Float64()
+	scrubQueryParams    = kingpin.Flag("scrub-query-param", "Query parameter whose values are redacted in access log (repeatable).").Strings()
+
+	logLevel  = kingpin.Flag("log-level", "Minimum level of service log records: debug, info, warn or error.").Default("info").Enum("debug", "info", "warn", "error")
+	logFormat = kingpin.Flag("log-format", "Format of service log records: text or json.").Default("text").Enum("text", "json")
+
+	accessLogFormat   = kingpin.Flag("access-log-format", "Format of access log: combined (Apache combined log format) or json.").Default("combined").Enum("combined", "json")
+	accessLogTemplate = kingpin.Flag("access-log-template", `Template of access log lines, overriding format, with placeholders like %h %t %r %s %b %D %{Host}i %{SSL_PROTOCOL}x.`).String()
+
+	accessLogMaxSizeMB   = kingpin.Flag("access-log-max-size-mb", "Size in megabytes at which access log is rotated, 0 to disable rotation.").Default("0").Int()
+	accessLogMaxBackups  = kingpin.Flag("access-log-max-backups", "Number of rotated access logs to retain, 0 to retain all.").Default("0").Int()
+	accessLogCompress    = kingpin.Flag("access-log-compress", "Compress rotated access logs with gzip.").Bool()
+	serviceLogMaxSizeMB  = kingpin.Flag("service-log-max-size-mb", "Size in megabytes at which service log is rotated, 0 to disable rotation.").Default("0").Int()
+	serviceLogMaxBackups = kingpin.Flag("service-log-max-backups", "Number of rotated service logs to retain, 0 to retain all.").Default("0").Int()
+	serviceLogCompress   = kingpin.Flag("service-log-compress", "Compress rotated service logs with gzip.").Bool()
+
+	logBufferSize       = kingpin.Flag("log-buffer-size", "Number of access log lines buffered to be written asynchronously, 0 for synchronous writes.").Default("0").Int()
+	logFlushInterval    = kingpin.Flag("log-flush-interval", "Maximum interval between writes of buffered access log lines.").Default("1s").Duration()
+	logBufferFullPolicy = kingpin.Flag("log-buffer-full-policy", "Handling of access log lines when buffer is full: block or drop.").Default("block").Enum("block", "drop")
+
+	eventLogFilePath   = kingpin.Flag("event-log-path", "File path where tracking events will be logged as JSON lines.").String()
+	eventLogMaxSizeMB  = kingpin.Flag("event-log-max-size-mb", "Size in megabytes at which event log is rotated, 0 to disable rotation.").Default("0").Int()
+	eventLogMaxBackups = kingpin.Flag("event-log-max-backups", "Number of rotated event logs to retain, 0 to retain all.").Default("0").Int()
+	eventLogCompress   = kingpin.Flag("event-log-compress", "Compress rotated event logs with gzip.").Bool()
+
+	s3Bucket         = kingpin.Flag("s3-bucket", "S3 bucket to upload rotated event logs to.").String()
+	s3Prefix         = kingpin.Flag("s3-prefix", "Prefix of S3 keys of uploaded event logs.").String()
+	s3UploadInterval = kingpin.Flag("s3-upload-interval", "Interval of rotating and uploading event logs to S3.").Default("1h").Duration()
+
+	eventFieldToggles   = kingpin.Flag("event-field", "Built-in field of tracking events to include, or to exclude when prefixed with -: ip, ua, referer, query, host, tls or vars (repeatable).").Strings()
+	eventIncludeHeaders = kingpin.Flag("event-include-header", "Request header to include in tracking events (repeatable).").Strings()
+
+	visitorIDParam = kingpin.Flag("visitor-id-param", "Query parameter identifying visitor, client address identifies visitor when not given.").Default("vid").String()
+
+	sinkBufferSize    = kingpin.Flag("sink-buffer-size", "Number of events buffered per event sink, over which --sink-overflow applies.").Default("10000").Int()
+	sinkBatchSize     = kingpin.Flag("sink-batch-size", "Maximum number of events delivered to event sink at once.").Default("100").Int()
+	sinkFlushInterval = kingpin.Flag("sink-flush-interval", "Maximum interval between deliveries of buffered events.").Default("1s").Duration()
+	sinkOverflow      = kingpin.Flag("sink-overflow", "Policy when event sink buffer is full: block until buffered, drop-new or drop-old event.").Default("drop-new").Enum("block", "drop-new", "drop-old")
+
+	sinkBreakerThreshold = kingpin.Flag("sink-breaker-threshold", "Number of consecutive failed deliveries to event sink opening its circuit, 0 to disable.").Default("5").Int()
+	sinkBreakerBackoff   = kingpin.Flag("sink-breaker-backoff", "Duration of open circuit of event sink before delivery is probed again.").Default("30s").Duration()
+
+	sinks              = kingpin.Flag("sink", "Event sink to write events to: log, kafka, sqlite, firehose, pubsub, nats, webhook, clickhouse or fluent (repeatable).").Enums("log", "kafka", "sqlite", "firehose", "pubsub", "nats", "webhook", "clickhouse", "fluent")
+	spoolDir           = kingpin.Flag("spool-dir", "Directory where events not delivered to event sinks are spooled until sinks recover.").String()
+	spoolMaxMB         = kingpin.Flag("spool-max-mb", "Maximum size in megabytes of spooled events per sink, over which oldest events are dropped.").Default("1024").Int()
+	deadLetterFilePath = kingpin.Flag("dead-letter-path", "File path where events not delivered to event sink will be written as JSON lines.").String()
+
+	kafkaBrokers  = kingpin.Flag("kafka-brokers", "Comma separated addresses of Kafka brokers to produce events to.").String()
+	kafkaTopic    = kingpin.Flag("kafka-topic", "Kafka topic to produce events to.").String()
+	kafkaClientID = kingpin.Flag("kafka-client-id", "Client ID of Kafka producer.").Default("serve-and-track").String()
+
+	sqlitePath          = kingpin.Flag("sqlite-path", "File path of SQLite database where events will be stored.").String()
+	sqliteBatchSize     = kingpin.Flag("sqlite-batch-size", "Maximum number of events stored in a single transaction.").Default("100").Int()
+	sqliteFlushInterval = kingpin.Flag("sqlite-flush-interval", "Maximum interval between transactions storing buffered events.").Default("500ms").Duration()
+	sqliteRetentionDays = kingpin.Flag("sqlite-retention-days", "Number of days for which events are stored, 0 to store forever.").Default("0").Int()
+
+	firehoseStreamName = kingpin.Flag("firehose-stream-name", "Name of Firehose delivery stream to put events to, with --sink=firehose.").String()
+
+	pubsubProject = kingpin.Flag("pubsub-project", "Google Cloud project of Pub/Sub topic, with --sink=pubsub.").String()
+	pubsubTopic   = kingpin.Flag("pubsub-topic", "Pub/Sub topic to publish events to, with --sink=pubsub.").String()
+
+	natsURL           = kingpin.Flag("nats-url", "URL of NATS server to publish events to, e.g. nats://127.0.0.1:4222, with --sink=nats.").String()
+	natsSubjectPrefix = kingpin.Flag("nats-subject-prefix", "Prefix of NATS subjects, followed by pixel identifier.").Default("track.events").String()
+	natsJetStream     = kingpin.Flag("nats-jetstream", "Publish events to JetStream, with acknowledgements and retries.").Bool()
+
+	webhookURL           = kingpin.Flag("webhook-url", "URL to post batches of events to as JSON arrays, with --sink=webhook.").String()
+	webhookBatchSize     = kingpin.Flag("webhook-batch-size", "Maximum number of events posted to webhook at once.").Default("100").Int()
+	webhookFlushInterval = kingpin.Flag("webhook-flush-interval", "Maximum interval between posts of buffered events to webhook.").Default("5s").Duration()
+	webhookAuthHeader    = kingpin.Flag("webhook-auth-header", "Header authenticating posts to webhook, e.g. \"Authorization: Bearer token\".").String()
+	webhookConcurrency   = kingpin.Flag("webhook-concurrency", "Maximum number of concurrent posts to webhook.").Default("4").Int()
+	webhookMaxRetries    = kingpin.Flag("webhook-max-retries", "Maximum number of retries of failed post to webhook, before events are dead lettered.").Default("5").Int()
+
+	clickHouseURL       = kingpin.Flag("clickhouse-url", "URL of ClickHouse HTTP interface to insert events to, with --sink=clickhouse.").String()
+	clickHouseTable     = kingpin.Flag("clickhouse-table", "ClickHouse table to insert events to.").String()
+	clickHouseBatchRows = kingpin.Flag("clickhouse-batch-rows", "Maximum number of events inserted to ClickHouse at once.").Default("1000").Int()
+
+	fluentAddress        = kingpin.Flag("fluent-address", "Address of Fluentd forward input to send events to, unix:///path for Unix domain socket, with --sink=fluent.").String()
+	fluentTag            = kingpin.Flag("fluent-tag", "Fluentd tag of events.").Default("serve-and-track.events").String()
+	fluentRequireAck     = kingpin.Flag("fluent-require-ack", "Require Fluentd to acknowledge forwarded events.").Bool()
+	fluentBufferOverflow = kingpin.Flag("fluent-buffer-overflow", "Event dropped when Fluentd buffer is full: drop-newest or drop-oldest, overriding --sink-overflow.").Enum("drop-newest", "drop-oldest")
+
+	logFailoverThreshold = kingpin.Flag("log-failover-threshold", "Number of consecutive access log write failures after which access log is written to stderr.").Default("3").Int()
+	logReopenInterval    = kingpin.Flag("log-reopen-interval", "Interval of reopening failed or removed access log file.").Default("10s").Duration()
+	failHealthOnLogError = kingpin.Flag("fail-health-on-log-error", "Report service unhealthy while access log file is failed.").Bool()
+
+	accessLogSyslogAddress  = kingpin.Flag("access-log-syslog-address", "Syslog address where requests will be logged instead of file, e.g. udp://host:514, tcp://host:514 or unixgram:///dev/log.").String()
+	accessLogSyslogTag      = kingpin.Flag("access-log-syslog-tag", "Syslog tag of access log.").Default("serve-and-track").String()
+	serviceLogSyslogAddress = kingpin.Flag("service-log-syslog-address", "Syslog address where service events will be logged instead of file.").String()
+	serviceLogSyslogTag     = kingpin.Flag("service-log-syslog-tag", "Syslog tag of service log.").Default("serve-and-track").String()
+
+	tlsCertFilePath = kingpin.Flag("tls-cert-path", "File path of TLS certificate, enables HTTPS together with --tls-key-path.").String()
+	tlsKeyFilePath  = kingpin.Flag("tls-key-path", "File path of TLS private key, enables HTTPS together with --tls-cert-path.").String()
+
+	acmeHosts             = kingpin.Flag("acme-host", "Host name to obtain certificate for via ACME, enables HTTPS (repeatable).").Strings()
+	acmeCacheDir          = kingpin.Flag("acme-cache-dir", "Directory where ACME certificates are cached.").Default("./acme").String()
+	acmeHTTPListenAddress = kingpin.Flag("acme-http-listen-address", "Address on which to answer ACME HTTP-01 challenges.").Default(":80").String()
 )
 
+// Whether service is draining, i.e. about to shut down.
+var draining atomic.Bool
+
+// Whether service is in drain mode, toggled by SIGUSR1: reported unhealthy,
+// while still serving tracking requests.
+var drainMode atomic.Bool
+
+// Time of last tracking request served in nanoseconds since epoch, stored
+// rather than set on gauge to keep lock off the hot path.
+var lastTrackingRequest atomic.Int64
+
 // GIF transparent image to serve as a tracking image
 var GIF = []byte{
 	71, 73, 70, 56, 57, 97, 1, 0, 1, 0, 128, 0, 0, 0, 0, 0,
@@ -47,154 +322,1373 @@ var GIF = []byte{
 	1, 0, 1, 0, 0, 2, 1, 68, 0, 59,
 }
 
+// PNG transparent image to serve as a tracking image
+var PNG = []byte{
+	137, 80, 78, 71, 13, 10, 26, 10, 0, 0, 0, 13, 73, 72, 68, 82,
+	0, 0, 0, 1, 0, 0, 0, 1, 8, 6, 0, 0, 0, 31, 21, 196,
+	137, 0, 0, 0, 11, 73, 68, 65, 84, 120, 218, 99, 96, 0, 2, 0,
+	0, 5, 0, 1, 233, 250, 220, 216, 0, 0, 0, 0, 73, 69, 78, 68,
+	174, 66, 96, 130,
+}
+
+// WebP transparent image to serve as a tracking image
+var WebP = []byte{
+	82, 73, 70, 70, 26, 0, 0, 0, 87, 69, 66, 80, 86, 80, 56, 76,
+	13, 0, 0, 0, 47, 0, 0, 0, 16, 7, 16, 17, 17, 136, 136, 254,
+	7, 0,
+}
+
 // Monitoring metrics
 var (
-	serveImageRequestDuration = prometheus.NewSummary(prometheus.SummaryOpts{
-		Name:       "tracking_request_duration",
-		Help:       "Duration of requests.",
-		Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001},
-	})
+	// Created by initMetrics, of configured buckets.
+	serveRequestDuration *prometheus.HistogramVec
 
-	serveImageRequestsSize = prometheus.NewCounter(prometheus.CounterOpts{
-		Name: "tracking_requests_size_total",
-		Help: "Size of requests, total.",
-	})
+	serveImageRequestDuration = prometheus.NewSummaryVec(
+		prometheus.SummaryOpts{
+			Name:       "tracking_request_duration",
+			Help:       "Duration of requests partitioned by response mode (gif or 204), deprecated in favour of tracking_request_duration_seconds.",
+			Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001},
+		},
+		[]string{"mode"},
+	)
 
 	serveImageRequestsCount = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "tracking_requests_count_total",
-			Help: "Number of requests served partitioned by status (failure or success).",
+			Help: "Number of requests served partitioned by status (failure, success, prefetch, not_modified, rate_limited, unsigned or method_not_allowed) and response mode (gif or 204).",
+		},
+		[]string{"status", "mode"},
+	)
+
+	serveImageRequestsByPixel = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tracking_requests_by_pixel_total",
+			Help: "Number of requests served with pixel identifier partitioned by pixel_id, other unless allowed.",
+		},
+		[]string{"pixel_id"},
+	)
+
+	serveImageRequestsByCountry = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tracking_requests_by_country_total",
+			Help: "Number of requests served partitioned by ISO code of country of client address, unknown when not located.",
+		},
+		[]string{"country_code"},
+	)
+
+	serveImageRequestsByDevice = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tracking_requests_by_device_total",
+			Help: "Number of requests served partitioned by device_class (desktop, mobile, tablet, bot or other) and browser_family (chrome, firefox, safari, edge, opera, samsung, ie or other) of user agent.",
+		},
+		[]string{"device_class", "browser_family"},
+	)
+
+	serveImageRequestsByFormat = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tracking_requests_by_format_total",
+			Help: "Number of requests served partitioned by format of served image (gif, png, webp or custom).",
+		},
+		[]string{"format"},
+	)
+
+	serveImageOpens = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tracking_opens_total",
+			Help: "Number of email opens served partitioned by prefetch (true when fetched by image proxy of mail provider).",
+		},
+		[]string{"prefetch"},
+	)
+
+	serveClicks = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tracking_clicks_total",
+			Help: "Number of clicks served partitioned by status (redirected, rejected, invalid or unsigned).",
+		},
+		[]string{"status"},
+	)
+
+	serveLinkClicks = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tracking_link_clicks_total",
+			Help: "Number of short link clicks served partitioned by link_id, other unless in link map.",
+		},
+		[]string{"link_id"},
+	)
+
+	serveLinksNotFound = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "tracking_links_not_found_total",
+		Help: "Number of short link requests of unknown link identifiers.",
+	})
+
+	serveCollectRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tracking_collect_requests_total",
+			Help: "Number of collect requests partitioned by status (accepted, too_large, malformed, unsupported or too_many_events).",
 		},
 		[]string{"status"},
 	)
+
+	serveCollectEvents = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tracking_collect_batch_events_total",
+			Help: "Number of events posted in batches partitioned by status (accepted or rejected).",
+		},
+		[]string{"status"},
+	)
+
+	serveImageDNTRequests = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "tracking_requests_dnt_total",
+		Help: "Number of tracking requests not tracked as asked by client with DNT or Sec-GPC header.",
+	})
+
+	serveOptedOutRequests = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "tracking_requests_opted_out_total",
+		Help: "Number of tracking requests not tracked as client opted out.",
+	})
+
+	serveImageDuplicateRequests = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "tracking_duplicate_requests_total",
+		Help: "Number of requests served repeating earlier ones of the same nonce within deduplication window.",
+	})
+
+	serveImageRequestsShed = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "tracking_requests_shed_total",
+		Help: "Number of requests shed due to exceeding global rate limit.",
+	})
+
+	startTimeSeconds = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "serve_and_track_start_time_seconds",
+		Help: "Start time of service in seconds since epoch.",
+	})
+
+	lastTrackingRequestSeconds = prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "serve_and_track_last_tracking_request_timestamp_seconds",
+			Help: "Time of last tracking request served in seconds since epoch, 0 when none was.",
+		},
+		func() float64 { return float64(lastTrackingRequest.Load()) / 1e9 },
+	)
+
+	buildInfo = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "serve_and_track_build_info",
+			Help: "Build information of service, of value 1, with version, commit and goversion labels.",
+		},
+		[]string{"version", "commit", "goversion"},
+	)
+
+	statsdDroppedMetrics = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "serve_and_track_statsd_dropped_metrics_total",
+		Help: "Number of StatsD metrics dropped due to full buffer.",
+	})
+
+	statsdSendErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "serve_and_track_statsd_send_errors_total",
+		Help: "Number of failures to send packets of StatsD metrics.",
+	})
+
+	streamClients = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "serve_and_track_event_stream_clients",
+		Help: "Number of currently connected clients of event stream.",
+	})
+
+	streamDroppedClients = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "serve_and_track_event_stream_dropped_clients_total",
+		Help: "Number of clients of event stream dropped for falling behind.",
+	})
+
+	metricsPushErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "serve_and_track_metrics_push_errors_total",
+			Help: "Number of failures to push metrics partitioned by mode (pushgateway or remote_write).",
+		},
+		[]string{"mode"},
+	)
+
+	authFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "serve_and_track_auth_failures_total",
+			Help: "Number of requests failing authentication partitioned by realm.",
+		},
+		[]string{"realm"},
+	)
+
+	blockedRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "blocked_requests_total",
+			Help: "Number of requests answered with 403 partitioned by reason (blocked, of blocked source on tracking paths, or not_allowed, of source not allowed on metrics and state).",
+		},
+		[]string{"reason"},
+	)
+
+	unmatchedRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "http_requests_unmatched_total",
+			Help: "Number of requests not matching any route partitioned by method, other unless standard.",
+		},
+		[]string{"method"},
+	)
+
+	httpInFlightRequests = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "http_in_flight_requests",
+		Help: "Number of requests currently being served.",
+	})
+
+	httpRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "http_requests_total",
+			Help: "Number of requests served partitioned by handler, method and status code.",
+		},
+		[]string{"handler", "method", "code"},
+	)
+
+	httpRequestSize = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "http_request_size_bytes",
+			Help:    "Size of requests in bytes, of headers and body, partitioned by handler.",
+			Buckets: prometheus.ExponentialBuckets(64, 4, 8),
+		},
+		[]string{"handler"},
+	)
+
+	httpResponseSize = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "http_response_size_bytes",
+			Help:    "Size of response bodies in bytes, as written, partitioned by handler.",
+			Buckets: prometheus.ExponentialBuckets(16, 4, 8),
+		},
+		[]string{"handler"},
+	)
+
+	httpRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "http_request_duration_seconds",
+			Help:    "Duration of serving requests in seconds partitioned by handler, method and status code.",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"handler", "method", "code"},
+	)
+
+	handlerPanics = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "http_panics_total",
+		Help: "Number of panics of request handlers recovered from.",
+	})
+
+	invalidRealIPHeaders = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "serve_and_track_invalid_real_ip_headers_total",
+		Help: "Number of requests from trusted peers with invalid real IP header.",
+	})
+
+	syslogDroppedLines = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "serve_and_track_syslog_dropped_lines_total",
+			Help: "Number of log lines not sent to syslog while disconnected partitioned by log (access or service).",
+		},
+		[]string{"log"},
+	)
+
+	logDroppedLines = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "serve_and_track_log_dropped_lines_total",
+		Help: "Number of access log lines dropped due to full buffer.",
+	})
+
+	logSampledOutLines = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "serve_and_track_log_sampled_out_lines_total",
+		Help: "Number of access log lines suppressed by sampling.",
+	})
+
+	logWriteErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "serve_and_track_log_write_errors_total",
+		Help: "Number of failed writes to access log file.",
+	})
+
+	imageLoadErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "serve_and_track_image_load_errors_total",
+		Help: "Number of failed loads of tracking image file, embedded images served instead.",
+	})
+
+	eventWriteErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "serve_and_track_event_write_errors_total",
+		Help: "Number of tracking events not recorded due to errors.",
+	})
+
+	sinkDeliveredEvents = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "serve_and_track_sink_delivered_events_total",
+			Help: "Number of events delivered partitioned by sink.",
+		},
+		[]string{"sink"},
+	)
+
+	sinkDeliveryErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "serve_and_track_sink_delivery_errors_total",
+			Help: "Number of events not delivered due to errors partitioned by sink.",
+		},
+		[]string{"sink"},
+	)
+
+	sinkRetries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "serve_and_track_sink_retries_total",
+			Help: "Number of retried deliveries partitioned by sink.",
+		},
+		[]string{"sink"},
+	)
+
+	spoolBytes = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "serve_and_track_spool_bytes",
+			Help: "Size of spooled events partitioned by sink.",
+		},
+		[]string{"sink"},
+	)
+
+	spoolDroppedEvents = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "serve_and_track_spool_dropped_events_total",
+			Help: "Number of spooled events dropped due to exceeding maximum spool size partitioned by sink.",
+		},
+		[]string{"sink"},
+	)
+
+	sinkDeadLetterEvents = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "serve_and_track_sink_dead_letter_events_total",
+			Help: "Number of events written to dead letter file partitioned by sink.",
+		},
+		[]string{"sink"},
+	)
+
+	sinkQueuedEvents = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "serve_and_track_sink_queued_events",
+			Help: "Number of events queued for delivery partitioned by sink.",
+		},
+		[]string{"sink"},
+	)
+
+	sinkDeliveryDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name: "serve_and_track_sink_delivery_duration_seconds",
+			Help: "Duration of deliveries of event batches partitioned by sink.",
+		},
+		[]string{"sink"},
+	)
+
+	sinkCircuitState = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "serve_and_track_sink_circuit_state",
+			Help: "State of circuit breaker partitioned by sink: closed (0), open (1) or half-open (2).",
+		},
+		[]string{"sink"},
+	)
+
+	sinkDroppedEvents = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "serve_and_track_sink_dropped_events_total",
+			Help: "Number of events dropped due to full buffer partitioned by sink.",
+		},
+		[]string{"sink"},
+	)
+
+	s3Uploads = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "serve_and_track_s3_uploads_total",
+		Help: "Number of rotated event logs uploaded to S3.",
+	})
+
+	s3UploadErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "serve_and_track_s3_upload_errors_total",
+		Help: "Number of failed uploads of rotated event logs to S3.",
+	})
+
+	natsConnected = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "serve_and_track_nats_connected",
+		Help: "Whether NATS sink is connected (1) or not (0).",
+	})
+
+	openConnections = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "serve_and_track_open_connections",
+		Help: "Number of currently open connections.",
+	})
+
+	queuedConnections = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "serve_and_track_queued_connections_total",
+		Help: "Number of connections queued due to reaching maximum number of connections.",
+	})
+
+	proxyProtocolErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "serve_and_track_proxy_protocol_errors_total",
+		Help: "Number of connections closed due to malformed or disallowed PROXY protocol header.",
+	})
+
+	connectionTimeouts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "serve_and_track_connection_timeouts_total",
+			Help: "Number of connections terminated by timeout partitioned by operation (read or write).",
+		},
+		[]string{"operation"},
+	)
+
+	serviceDraining = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "serve_and_track_draining",
+		Help: "Whether service is draining before shutdown (1) or not (0).",
+	})
+
+	serviceDrainMode = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "serve_and_track_drain_mode",
+		Help: "Whether service is in drain mode toggled by SIGUSR1 (1) or not (0).",
+	})
+
+	diskFreeBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "serve_and_track_disk_free_bytes",
+		Help: "Free space in bytes on filesystem of access log, as last measured.",
+	})
+
+	diskFreeRatio = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "serve_and_track_disk_free_ratio",
+		Help: "Fraction of space free on filesystem of access log, as last measured.",
+	})
+
+	memoryBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "serve_and_track_memory_bytes",
+		Help: "Resident memory of process in bytes, or Go heap where it is not known, as last measured.",
+	})
+
+	goroutines = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "serve_and_track_goroutines",
+		Help: "Number of goroutines, as last measured.",
+	})
+
+	healthOverrideActive = prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "serve_and_track_health_override_active",
+			Help: "Whether service health is overridden (1) or not (0).",
+		},
+		func() float64 {
+			if activeOverride() != nil {
+				return 1
+			}
+			return 0
+		},
+	)
+
+	configReloads = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "serve_and_track_config_reloads_total",
+			Help: "Number of reloads of configuration partitioned by result (success or failure).",
+		},
+		[]string{"result"},
+	)
+
+	healthTransitions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "serve_and_track_health_transitions_total",
+			Help: "Number of transitions of service health partitioned by direction (up or down).",
+		},
+		[]string{"direction"},
+	)
+
+	healthProbeDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name: "serve_and_track_health_probe_duration_seconds",
+			Help: "Duration of health probes in seconds partitioned by probe (http or command) and result (pass or fail).",
+		},
+		[]string{"probe", "result"},
+	)
+
+	acmeCertificateErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "serve_and_track_acme_certificate_errors_total",
+		Help: "Number of failures to obtain or renew ACME certificate.",
+	})
 )
 
-// Initializes service metrics.
-func initMetrics() {
-	prometheus.MustRegister(serveImageRequestDuration)
-	prometheus.MustRegister(serveImageRequestsCount)
-	prometheus.MustRegister(serveImageRequestsSize)
+// Initializes service metrics, registered to new registry returned, so that
+// every call starts afresh, together with Go runtime and process metrics when
+// enabled.
+func initMetrics() *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+	reg := metricsRegisterer(registry)
+
+	if *enableGoMetrics {
+		reg.MustRegister(collectors.NewGoCollector())
+	}
+	if *enableProcessMetrics {
+		reg.MustRegister(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	}
+
+	buildInfo.WithLabelValues(version, commit, runtime.Version()).Set(1)
+
+	reg.MustRegister(buildInfo)
+	reg.MustRegister(startTimeSeconds)
+	reg.MustRegister(lastTrackingRequestSeconds)
+
+	buckets, err := parseDurationBuckets(*durationBuckets)
+	if err != nil {
+		fatal("metrics: Invalid duration buckets", "error", err)
+	}
+
+	serveRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:                            "tracking_request_duration_seconds",
+			Help:                            "Duration of requests in seconds partitioned by handler.",
+			Buckets:                         buckets,
+			NativeHistogramBucketFactor:     *nativeHistogramFactor,
+			NativeHistogramMaxBucketNumber:  160,
+			NativeHistogramMinResetDuration: time.Hour,
+		},
+		[]string{"handler"},
+	)
+
+	reg.MustRegister(serveRequestDuration)
+	if *legacySummary {
+		reg.MustRegister(serveImageRequestDuration)
+	}
+	reg.MustRegister(serveImageRequestsCount)
+	reg.MustRegister(serveImageRequestsByPixel)
+	reg.MustRegister(serveImageRequestsByFormat)
+	reg.MustRegister(serveImageRequestsByCountry)
+	reg.MustRegister(serveImageRequestsByDevice)
+	reg.MustRegister(serveImageOpens)
+	reg.MustRegister(serveClicks)
+	reg.MustRegister(serveLinkClicks)
+	reg.MustRegister(serveLinksNotFound)
+	reg.MustRegister(serveCollectRequests)
+	reg.MustRegister(serveCollectEvents)
+	reg.MustRegister(serveImageDuplicateRequests)
+	reg.MustRegister(serveImageDNTRequests)
+	reg.MustRegister(serveOptedOutRequests)
+	reg.MustRegister(serveImageRequestsShed)
+	reg.MustRegister(metricsPushErrors)
+	reg.MustRegister(streamClients)
+	reg.MustRegister(streamDroppedClients)
+	reg.MustRegister(statsdDroppedMetrics)
+	reg.MustRegister(statsdSendErrors)
+	reg.MustRegister(authFailures)
+	reg.MustRegister(blockedRequests)
+	reg.MustRegister(unmatchedRequests)
+	reg.MustRegister(handlerPanics)
+	reg.MustRegister(httpInFlightRequests)
+	reg.MustRegister(httpRequests)
+	reg.MustRegister(httpRequestDuration)
+	reg.MustRegister(httpRequestSize)
+	reg.MustRegister(httpResponseSize)
+	reg.MustRegister(invalidRealIPHeaders)
+	reg.MustRegister(syslogDroppedLines)
+	reg.MustRegister(logDroppedLines)
+	reg.MustRegister(logSampledOutLines)
+	reg.MustRegister(logWriteErrors)
+	reg.MustRegister(imageLoadErrors)
+	reg.MustRegister(eventWriteErrors)
+	reg.MustRegister(sinkDeliveredEvents)
+	reg.MustRegister(sinkDeliveryErrors)
+	reg.MustRegister(sinkRetries)
+	reg.MustRegister(sinkCircuitState)
+	reg.MustRegister(spoolBytes)
+	reg.MustRegister(spoolDroppedEvents)
+	reg.MustRegister(sinkDeadLetterEvents)
+	reg.MustRegister(sinkQueuedEvents)
+	reg.MustRegister(sinkDeliveryDuration)
+	reg.MustRegister(sinkDroppedEvents)
+	reg.MustRegister(s3Uploads)
+	reg.MustRegister(s3UploadErrors)
+	reg.MustRegister(natsConnected)
+	reg.MustRegister(openConnections)
+	reg.MustRegister(queuedConnections)
+	reg.MustRegister(proxyProtocolErrors)
+	reg.MustRegister(connectionTimeouts)
+	reg.MustRegister(serviceDraining)
+	reg.MustRegister(serviceDrainMode)
+	reg.MustRegister(acmeCertificateErrors)
+	reg.MustRegister(diskFreeBytes)
+	reg.MustRegister(diskFreeRatio)
+	reg.MustRegister(memoryBytes)
+	reg.MustRegister(goroutines)
+	reg.MustRegister(healthProbeDuration)
+	reg.MustRegister(healthTransitions)
+	reg.MustRegister(configReloads)
+	reg.MustRegister(healthOverrideActive)
+
+	return registry
 }
 
-// Initializes the http server.
-func initServer() *http.Server {
+// Returns registerer of registry, prefixing names of metrics registered with
+// metric namespace when given, as Namespace of their options would.
+func metricsRegisterer(registry *prometheus.Registry) prometheus.Registerer {
+	if *metricNamespace == "" {
+		return registry
+	}
+	return prometheus.WrapRegistererWithPrefix(*metricNamespace+"_", registry)
+}
+
+// Name of routes serving tracking image, whose requests of methods not allowed
+// are counted as tracking requests.
+const trackingRouteName = "track"
+
+// Initializes the http servers: the main one, the admin one when admin listen
+// address is given and, in ACME mode, the one answering HTTP-01 challenges.
+// Returned with them is lifecycle of resources opened, closed on shutdown.
+func initServer(registry *prometheus.Registry) ([]*http.Server, *lifecycle) {
 	r := mux.NewRouter()
 
-	r.HandleFunc(*trackingURLPath, serveImage)
-	r.HandleFunc(*stateURLPath, serveState)
-	r.Handle(*metricsURLPath, promhttp.Handler())
+	r.MethodNotAllowedHandler = instrument("method_not_allowed", routeMethodNotAllowed(r))
+	r.NotFoundHandler = instrument("not_found", http.HandlerFunc(notFound))
 
-	if serviceLog, err := os.OpenFile(*serviceLogFilePath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600); err != nil {
-		log.SetOutput(os.Stderr)
-	} else {
-		log.SetOutput(serviceLog)
+	admin := r
+	if *adminListenAddress != "" {
+		admin = mux.NewRouter()
+		admin.MethodNotAllowedHandler = instrument("method_not_allowed", routeMethodNotAllowed(admin))
+		admin.NotFoundHandler = r.NotFoundHandler
+	}
+
+	if err := initReloadableConfig(); err != nil {
+		fatal("config: Invalid configuration", "error", err)
+	}
+	initGlobalRateLimiter()
+
+	c := currentConfig()
+	limitRate := rateLimitTracking(newIPRateLimiter(c.rateLimit, c.rateBurst))
+
+	image := instrument("track", blockSources(corsTracking(limitRate(http.HandlerFunc(serveImage)))))
+	r.Handle(*trackingURLPath, image).Methods(corsMethods("GET", "HEAD")...).Name(trackingRouteName)
+	r.Handle(strings.TrimSuffix(*trackingURLPath, "/")+".{format:gif|png|webp}", image).Methods(corsMethods("GET", "HEAD")...).Name(trackingRouteName)
+	r.Handle(strings.TrimSuffix(*trackingURLPath, "/")+"/{pixel_id}", image).Methods(corsMethods("GET", "HEAD")...).Name(trackingRouteName)
+	r.Handle(strings.TrimSuffix(*openURLPath, "/")+"/{message_id}", instrument("open", blockSources(corsTracking(limitRate(http.HandlerFunc(serveImage)))))).Methods(corsMethods("GET", "HEAD")...).Name(trackingRouteName)
+	r.Handle(*scriptURLPath, instrument("script", blockSources(http.HandlerFunc(serveScript)))).Methods("GET", "HEAD")
+	r.Handle(*clickURLPath, instrument("click", blockSources(corsTracking(limitRate(http.HandlerFunc(serveClick)))))).Methods(corsMethods("GET", "HEAD")...)
+	r.Handle(*collectURLPath, instrument("collect", blockSources(corsTracking(limitRate(http.HandlerFunc(serveCollect)))))).Methods("POST", "OPTIONS")
+	r.Handle(strings.TrimSuffix(*collectURLPath, "/")+"/batch", instrument("collect_batch", blockSources(corsTracking(limitRate(http.HandlerFunc(serveCollectBatch)))))).Methods("POST", "OPTIONS")
+	r.Handle(strings.TrimSuffix(*linkURLPath, "/")+"/{link_id}", instrument("link", blockSources(corsTracking(limitRate(http.HandlerFunc(serveLink)))))).Methods(corsMethods("GET", "HEAD")...)
+	if *optOutURLPath != "" {
+		r.Handle(*optOutURLPath, instrument("optout", http.HandlerFunc(serveOptOut))).Methods("GET", "POST")
+		r.Handle(strings.TrimSuffix(*optOutURLPath, "/")+"/status", instrument("optout_status", corsTracking(http.HandlerFunc(serveOptOutStatus)))).Methods(corsMethods("GET", "HEAD")...)
+	}
+	if *serveRobotsEnabled {
+		r.Handle("/robots.txt", instrument("robots", http.HandlerFunc(serveRobots))).Methods("GET", "HEAD")
+		r.Handle("/favicon.ico", instrument("favicon", http.HandlerFunc(serveFavicon))).Methods("GET", "HEAD")
+	}
+	if err := initResourceChecks(); err != nil {
+		fatal("state: Invalid resource checks", "error", err)
+	}
+	if err := initHealthProbes(); err != nil {
+		fatal("state: Invalid health probes", "error", err)
+	}
+	if err := initHealthEvaluation(); err != nil {
+		fatal("state: Invalid health evaluation", "error", err)
+	}
+	if *livenessURLPath != "" {
+		admin.Handle(*livenessURLPath, instrument("liveness", allowSources(http.HandlerFunc(serveLiveness)))).Methods("GET", "HEAD")
+	}
+	if *readinessURLPath != "" {
+		admin.Handle(*readinessURLPath, instrument("readiness", allowSources(http.HandlerFunc(serveReadiness)))).Methods("GET", "HEAD")
+	}
+
+	metricsAuth, err := metricsCredentials()
+	if err != nil {
+		fatal("auth: Invalid metrics credentials", "error", err)
+	}
+	admin.Handle(*stateURLPath, instrument("state", allowSources(stateHandler(metricsAuth)))).Methods(stateMethods(metricsAuth)...)
+	// Reloads are not exposed on the tracking listener without credentials.
+	if *adminListenAddress != "" || metricsAuth.required() {
+		admin.Handle("/-/reload", instrument("reload", allowSources(requireAuth("metrics", metricsAuth, http.HandlerFunc(serveReload))))).Methods("POST")
+	}
+	admin.Handle(*metricsURLPath, instrument("metrics", allowSources(requireAuth("metrics", metricsAuth, metricsHandler(registry))))).Methods("GET", "HEAD")
+	if *statsURLPath != "" {
+		if err := initTopValues(); err != nil {
+			fatal("stats: Invalid top values configuration", "error", err)
+		}
+		admin.Handle(*statsURLPath, instrument("stats", allowSources(http.HandlerFunc(serveStats)))).Methods("GET", "HEAD")
+		admin.Handle(strings.TrimSuffix(*statsURLPath, "/")+"/top", instrument("stats_top", allowSources(requireAuth("metrics", metricsAuth, http.HandlerFunc(serveTopValues))))).Methods("GET", "HEAD")
+	}
+	if *enableDashboard {
+		if *statsURLPath == "" {
+			fatal("dashboard: Dashboard requires stats path")
+		}
+		admin.Handle(*dashboardURLPath, instrument("dashboard", allowSources(requireAuth("metrics", metricsAuth, http.HandlerFunc(serveDashboard))))).Methods("GET", "HEAD")
+	}
+	initDebug(admin, func(h http.Handler) http.Handler {
+		return instrument("debug", allowSources(requireAuth("debug", metricsAuth, h)))
+	})
+	initRecentRequests()
+	if recentRequests != nil {
+		admin.Handle(recentRequestsURLPath, instrument("debug_requests", allowSources(requireAuth("debug", metricsAuth, http.HandlerFunc(serveRecentRequests))))).Methods("GET", "HEAD")
+	}
+
+	accessLogWriter, err := initLogs()
+	if err != nil {
+		fatal("log: Logs not initialized", "error", err)
+	}
+	logEffectiveConfig()
+
+	accessLog, err := newAccessLogger(accessLogWriter)
+	if err != nil {
+		fatal("log: Invalid access log configuration", "error", err)
+	}
+
+	initImage()
+
+	if err := initSources(); err != nil {
+		fatal("source: Source list not loaded", "error", err)
+	}
+
+	if err := initCookies(); err != nil {
+		fatal("track: Invalid cookie configuration", "error", err)
+	}
+
+	if err := initResponseHeaders(); err != nil {
+		fatal("http: Invalid response header", "error", err)
+	}
+
+	if err := initRobots(); err != nil {
+		fatal("robots: Robots exclusion not loaded", "error", err)
+	}
+
+	if err := initPrefetchSignatures(); err != nil {
+		fatal("track: Prefetch signatures not loaded", "error", err)
+	}
+
+	if err := initGeoIP(); err != nil {
+		fatal("geoip: Database not loaded", "error", err)
+	}
+
+	if err := initPixelIDs(); err != nil {
+		fatal("track: Pixel identifiers not loaded", "error", err)
+	}
+
+	if err := initMetricLabels(metricsRegisterer(registry)); err != nil {
+		fatal("track: Metric labels not initialized", "error", err)
+	}
+
+	initDedup()
+
+	if err := initRedirectAllowlist(); err != nil {
+		fatal("click: Redirect allowlist not loaded", "error", err)
+	}
+
+	if err := initLinks(); err != nil {
+		fatal("link: Link map not loaded", "error", err)
+	}
+
+	if err := initEventFields(); err != nil {
+		fatal("event: Invalid event configuration", "error", err)
+	}
+
+	if err := initSinks(); err != nil {
+		fatal("sink: Event sinks not initialized", "error", err)
+	}
+
+	initEventStream()
+
+	if err := initS3Upload(); err != nil {
+		fatal("s3: S3 upload not initialized", "error", err)
+	}
+
+	if err := initTracing(); err != nil {
+		fatal("trace: Tracing not initialized", "error", err)
+	}
+
+	if err := initStatsD(); err != nil {
+		fatal("statsd: StatsD not initialized", "error", err)
+	}
+
+	if err := initMetricsPush(registry); err != nil {
+		fatal("push: Metrics push not initialized", "error", err)
+	}
+
+	lc := &lifecycle{}
+	lc.add("sinks", func(ctx context.Context) error { closeSinks(ctx); return nil })
+	lc.add("event log upload", func(ctx context.Context) error { uploadEventLogs(ctx); return nil })
+	lc.add("metrics push", func(ctx context.Context) error { stopMetricsPush(ctx); return nil })
+	lc.add("tracing", func(ctx context.Context) error { stopTracing(ctx); return nil })
+	lc.add("statsd", func(ctx context.Context) error { return statsd.close() })
+	lc.add("log buffers", func(ctx context.Context) error { flushLogs(); return nil })
+	lc.add("logs", func(ctx context.Context) error { return closeLogs() })
+
+	if eventStore != nil {
+		admin.Handle(*eventsURLPath, instrument("events", allowSources(http.HandlerFunc(serveEvents)))).Methods("GET")
+	}
+	if eventStream != nil {
+		admin.Handle(strings.TrimSuffix(*eventsURLPath, "/")+"/stream", instrument("events_stream", allowSources(requireAuth("metrics", metricsAuth, http.HandlerFunc(serveEventStream))))).Methods("GET")
+	}
+
+	acmeManager, err := initACME()
+	if err != nil {
+		fatal("acme: ACME not initialized", "error", err)
+	}
+
+	tlsConfig, err := initTLS(acmeManager)
+	if err != nil {
+		fatal("tls: TLS not initialized", "error", err)
+	}
+
+	trustedProxies, err := parsePrefixes(*trustedProxyCIDRs)
+	if err != nil {
+		fatal("proxy: Invalid trusted proxy CIDR", "error", err)
+	}
+
+	realIPTrusted, err := parsePrefixes(*realIPTrustedCIDRs)
+	if err != nil {
+		fatal("proxy: Invalid real IP trusted CIDR", "error", err)
 	}
 
-	accessLog, err := os.OpenFile(*accessLogFilePath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	anonymizer, err := newIPAnonymizer()
 	if err != nil {
-		accessLog = os.Stdout
+		fatal("anonymize: Invalid IP anonymization", "error", err)
 	}
 
+	// Client address is established, and anonymized or redacted, before requests
+	// get logged, panics recovered from, as answered, logged too.
+	handler := func(h http.Handler) http.Handler {
+		h = recoverPanics(h)
+		h = globalResponseHeaders(h)
+		h = securityHeaders(h)
+		h = serverHeader(h)
+		h = accessLog.handler(h)
+		h = traceRequests(h)
+		h = redactDoNotTrack(h)
+		h = anonymizeClientAddress(h, anonymizer)
+		h = realIPHeader(h, *realIPHeaderName, realIPTrusted)
+		h = proxyHeaders(h, trustedProxies)
+		return requestIDs(h, slices.Concat(trustedProxies, realIPTrusted))
+	}
+
+	srv := newServer(*listenAddress, handler(r))
+	srv.TLSConfig = tlsConfig
+
+	servers := []*http.Server{srv}
+
+	if *adminListenAddress != "" {
+		servers = append(servers, newServer(*adminListenAddress, handler(admin)))
+	}
+
+	if acmeManager != nil {
+		servers = append(servers, newServer(*acmeHTTPListenAddress, accessLog.handler(acmeManager.HTTPHandler(nil))))
+	}
+
+	if err := checkAddressCollisions(servers); err != nil {
+		fatal("http: Invalid listen addresses", "error", err)
+	}
+
+	return servers, lc
+}
+
+// Creates http server with configured timeouts, tracking states of connections
+// to count their timeouts.
+func newServer(addr string, handler http.Handler) *http.Server {
 	return &http.Server{
-		Addr:    *listenAddress,
-		Handler: handlers.CombinedLoggingHandler(accessLog, r)}
+		ConnState:         trackConnState,
+		Addr:              addr,
+		Handler:           handler,
+		ReadTimeout:       *readTimeout,
+		ReadHeaderTimeout: *readHeaderTimeout,
+		WriteTimeout:      *writeTimeout,
+		IdleTimeout:       *idleTimeout,
+	}
+}
+
+// Checks that no two servers are to listen on the same address.
+func checkAddressCollisions(servers []*http.Server) error {
+	for i := range servers {
+		for j := i + 1; j < len(servers); j++ {
+			if addressesCollide(servers[i].Addr, servers[j].Addr) {
+				return fmt.Errorf("http: listen addresses %q and %q collide", servers[i].Addr, servers[j].Addr)
+			}
+		}
+	}
+	return nil
+}
+
+// Checks whether two listen addresses would bind the same port, treating empty
+// and unspecified hosts as matching any host.
+func addressesCollide(a, b string) bool {
+	hostA, portA, errA := net.SplitHostPort(a)
+	hostB, portB, errB := net.SplitHostPort(b)
+	if errA != nil || errB != nil {
+		return a == b
+	}
+
+	if portA != portB {
+		return false
+	}
+
+	wildcard := func(host string) bool {
+		ip := net.ParseIP(host)
+		return host == "" || (ip != nil && ip.IsUnspecified())
+	}
+
+	return hostA == hostB || wildcard(hostA) || wildcard(hostB)
+}
+
+// Initializes ACME certificate manager: nil when ACME mode is not enabled,
+// error when it is combined with static certificate.
+func initACME() (*autocert.Manager, error) {
+	if len(*acmeHosts) == 0 {
+		return nil, nil
+	}
+
+	if *tlsCertFilePath != "" || *tlsKeyFilePath != "" {
+		return nil, errors.New("acme: --acme-host cannot be combined with --tls-cert-path or --tls-key-path")
+	}
+
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(*acmeHosts...),
+		Cache:      autocert.DirCache(*acmeCacheDir),
+	}, nil
 }
 
-// Starts the http server.
+// Initializes TLS configuration: nil when TLS is not enabled, error when only
+// one of certificate and key is given or they cannot be loaded.
+func initTLS(acmeManager *autocert.Manager) (*tls.Config, error) {
+	if acmeManager != nil {
+		tlsConfig := acmeManager.TLSConfig()
+		getCertificate := tlsConfig.GetCertificate
+		tlsConfig.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert, err := getCertificate(hello)
+			if err != nil {
+				acmeCertificateErrors.Inc()
+				slog.Warn("acme: Certificate not obtained", "server_name", hello.ServerName, "error", err)
+			}
+			return cert, err
+		}
+		return tlsConfig, nil
+	}
+
+	if *tlsCertFilePath == "" && *tlsKeyFilePath == "" {
+		return nil, nil
+	}
+
+	if *tlsCertFilePath == "" || *tlsKeyFilePath == "" {
+		return nil, errors.New("tls: both --tls-cert-path and --tls-key-path are required")
+	}
+
+	cert, err := tls.LoadX509KeyPair(*tlsCertFilePath, *tlsKeyFilePath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+}
+
+// Starts the http server: binds the listener and serves in background.
 func startServer(srv *http.Server) {
-	log.Println("INFO http: Server started", *listenAddress)
+	listener, err := listenServer(srv)
+	if err != nil {
+		fatal("http: Server not started", "addr", srv.Addr, "error", err)
+	}
+
+	go func() {
+		var err error
 
-	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
-		log.Fatal("ERROR ", err)
+		if srv.TLSConfig != nil {
+			slog.Info("http: Server started", "addr", srv.Addr, "tls", true, "version", version)
+			err = srv.ServeTLS(listener, "", "")
+		} else {
+			slog.Info("http: Server started", "addr", srv.Addr, "tls", false, "version", version)
+			err = srv.Serve(listener)
+		}
+
+		if err != http.ErrServerClosed {
+			fatal("http: Server failed", "addr", srv.Addr, "error", err)
+		}
+	}()
+}
+
+// Toggles drain mode, in which service is reported unhealthy while still
+// serving, logging the resulting mode.
+func toggleDrain() {
+	enabled := !drainMode.Load()
+	drainMode.Store(enabled)
+
+	if enabled {
+		serviceDrainMode.Set(1)
+		slog.Warn("http: Drain mode enabled, service reported unhealthy")
+	} else {
+		serviceDrainMode.Set(0)
+		slog.Info("http: Drain mode disabled, service health reported")
 	}
 }
 
-// Stops the http server.
-func stopServer(srv *http.Server) {
-	ctx, cancel := context.WithTimeout(context.Background(), 8*time.Second)
+// Stops the http servers: first drains, i.e. reports service unhealthy while
+// still serving for the shutdown delay, then shuts all of them down and closes
+// resources of given lifecycle within the same shutdown timeout.
+func stopServer(servers []*http.Server, lc *lifecycle) {
+	draining.Store(true)
+	serviceDraining.Set(1)
+
+	notifySystemdStopping()
+
+	stopEventStream()
+
+	if *shutdownDelay > 0 {
+		slog.Info("http: Server draining", "delay", *shutdownDelay)
+		time.Sleep(*shutdownDelay)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
 	defer cancel()
 
-	log.Println("INFO http: Server stopping")
+	var wg sync.WaitGroup
 
-	if err := srv.Shutdown(ctx); err != nil {
-		log.Println("INFO http: Server stopped forcefully")
-	} else {
-		log.Println("INFO http: Server stopped gracefully")
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+
+			slog.Info("http: Server stopping", "addr", srv.Addr)
+
+			if err := srv.Shutdown(ctx); err != nil {
+				slog.Info("http: Server stopped forcefully", "addr", srv.Addr, "error", err)
+			} else {
+				slog.Info("http: Server stopped gracefully", "addr", srv.Addr)
+			}
+		}(srv)
 	}
+
+	wg.Wait()
+
+	lc.close(ctx)
 }
 
-// Measures function execution time.
-func trackServeImageDuration(start time.Time, id string) {
+// Measures function execution time, labeled by handler identifier, and by
+// response mode in legacy summary when given. Observations above exemplar
+// threshold carry exemplar of request of given context, if any.
+func trackServeImageDuration(ctx context.Context, start time.Time, id, mode string) {
 	elapsed := time.Since(start)
-	serveImageRequestDuration.Observe(float64(elapsed.Seconds()))
+
+	observer := serveRequestDuration.WithLabelValues(id)
+	if exemplar := requestExemplar(ctx); exemplar != nil && elapsed > *exemplarThreshold {
+		observer.(prometheus.ExemplarObserver).ObserveWithExemplar(elapsed.Seconds(), exemplar)
+	} else {
+		observer.Observe(elapsed.Seconds())
+	}
+	statsd.timing("request_duration", elapsed, "handler:"+id)
+	if *legacySummary && mode != "" {
+		serveImageRequestDuration.WithLabelValues(mode).Observe(elapsed.Seconds())
+	}
+}
+
+// Counts tracking request by status and response mode, in stats as well, and
+// mirrored to StatsD when enabled, with pixel identifier, if any.
+func countTrackingRequest(r *http.Request, status, mode string) {
+	serveImageRequestsCount.WithLabelValues(status, mode).Inc()
+	trackingStats.count(time.Now(), status)
+
+	if statsd != nil {
+		tags := []string{"status:" + status, "mode:" + mode}
+		if id := mux.Vars(r)["pixel_id"]; id != "" {
+			tags = append(tags, "pixel_id:"+pixelIDLabel(id))
+		}
+		statsd.count("requests", 1, tags...)
+	}
+}
+
+// Returns exemplar labels of request of given context: its trace identifier
+// when sampled, otherwise its request identifier, if any.
+func requestExemplar(ctx context.Context) prometheus.Labels {
+	if sc := trace.SpanContextFromContext(ctx); sc.IsSampled() {
+		return prometheus.Labels{"trace_id": sc.TraceID().String()}
+	}
+	if id := requestID(ctx); id != "" {
+		return prometheus.Labels{"request_id": id}
+	}
+	return nil
 }
 
-// Serves tracking image.
+// Parses comma-separated bucket upper bounds in seconds, in increasing order.
+func parseDurationBuckets(s string) ([]float64, error) {
+	var buckets []float64
+	for _, field := range strings.Split(s, ",") {
+		bucket, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil {
+			return nil, err
+		}
+		if n := len(buckets); n > 0 && bucket <= buckets[n-1] {
+			return nil, fmt.Errorf("bucket %v not above preceding %v", bucket, buckets[n-1])
+		}
+		buckets = append(buckets, bucket)
+	}
+	return buckets, nil
+}
+
+// Serves tracking image, or no content in 204 response mode.
 func serveImage(w http.ResponseWriter, r *http.Request) {
-	defer trackServeImageDuration(time.Now(), "serveImage")
+	mode := responseMode(r)
+	defer trackServeImageDuration(r.Context(), time.Now(), "track", mode)
 
-	if r.Method != "GET" {
-		http.NotFound(w, r)
+	if r.Method != "GET" && r.Method != "HEAD" {
+		countTrackingRequest(r, "method_not_allowed", mode)
+		methodNotAllowed(w, r, "GET", "HEAD")
 		return
 	}
 
-	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
-	w.Header().Set("Content-Type", "image/gif")
+	if shedLoad() {
+		serveImageRequestsShed.Inc()
+		w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+		http.Error(w, "Error 503 (Service overloaded)", http.StatusServiceUnavailable)
+		return
+	}
+
+	lastTrackingRequest.Store(time.Now().UnixNano())
+
+	if *cacheMode == revalidateCacheMode {
+		w.Header().Set("Cache-Control", "no-cache")
+	} else {
+		w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	}
+	setResponseHeaders(w.Header())
+
+	visitor := visitorCookie(w, r)
+
+	var image *trackingImage
+
+	status := "success"
+
+	if mode == noContentResponseMode {
+		w.WriteHeader(http.StatusNoContent)
+		if r.Method == "HEAD" {
+			return
+		}
+	} else {
+		image = requestedImage(r)
+
+		w.Header().Set("Content-Type", image.contentType)
+		w.Header().Set("Content-Length", strconv.Itoa(len(image.body)))
+
+		// Clients revalidating their cached image are tracked as well,
+		// answered without it when it is not modified.
+		if *cacheMode == revalidateCacheMode {
+			w.Header().Set("ETag", image.etag)
+			w.Header().Set("Last-Modified", image.modTime.UTC().Format(http.TimeFormat))
+			if mux.Vars(r)["format"] == "" {
+				w.Header().Add("Vary", "Accept")
+			}
+
+			if notModified(r, image) {
+				status = "not_modified"
+				w.Header().Del("Content-Length")
+				w.WriteHeader(http.StatusNotModified)
+			}
+		}
+
+		// Requests of headers only are not tracked, as no image is fetched.
+		if r.Method == "HEAD" {
+			return
+		}
 
-	if _, err := w.Write(GIF); err != nil {
-		serveImageRequestsCount.WithLabelValues("failure").Inc()
+		if status == "success" {
+			if _, err := w.Write(image.body); err != nil {
+				countTrackingRequest(r, "failure", mode)
+				slog.DebugContext(r.Context(), "track: Image not served", "remote", clientIP(r), "path", r.URL.Path, "error", err)
+				return
+			}
+		}
+	}
+
+	slog.DebugContext(r.Context(), "track: Image served", "remote", clientIP(r), "path", r.URL.Path, "query", scrubQuery(r.URL.RawQuery),
+		"referer", r.Referer(), "user_agent", r.UserAgent())
+
+	// Requests not signed get the image still, so that it is not shown as
+	// broken, but are not recorded.
+	if !signedRequest(r) {
+		countTrackingRequest(r, "unsigned", mode)
 		return
 	}
 
-	serveImageRequestsCount.WithLabelValues("success").Inc()
-	serveImageRequestsSize.Add(float64(len(GIF)))
+	duplicate := duplicateRequest(r)
+	if duplicate {
+		serveImageDuplicateRequests.Inc()
+	}
+
+	untracked := untrackedRequest(r)
+
+	// Prefetches by image proxies are counted on their own, not as views.
+	prefetch := isPrefetch(r)
+	if prefetch && status == "success" {
+		status = "prefetch"
+	}
+
+	var location geoLocation
+	var located bool
+	if !untracked {
+		location, located = locateClient(r)
+	}
+
+	if len(eventSinks) > 0 && !untracked {
+		e := newEvent(r)
+		e.VisitorID = visitor
+		e.Prefetch = prefetch
+		e.CountryCode, e.Region, e.City = location.countryCode, location.region, location.city
+		e.Duplicate = duplicate
+		recordEvent(r.Context(), e)
+	}
+
+	countTrackingRequest(r, status, mode)
+	if image != nil {
+		serveImageRequestsByFormat.WithLabelValues(image.format).Inc()
+	}
+
+	class := classifyUserAgent(r.UserAgent())
+	serveImageRequestsByDevice.WithLabelValues(class.device, class.browser).Inc()
+
+	if located {
+		serveImageRequestsByCountry.WithLabelValues(cmp.Or(location.countryCode, unknownCountry)).Inc()
+	}
+
+	// Clients opted out are not counted per pixel either.
+	if !optedOut(r) {
+		if id := mux.Vars(r)["pixel_id"]; id != "" {
+			label := pixelIDLabel(id)
+			serveImageRequestsByPixel.WithLabelValues(label).Inc()
+			trackingStats.countPixel(label)
+		}
+		countTopValues(r)
+		if id := mux.Vars(r)["message_id"]; id != "" {
+			serveImageOpens.WithLabelValues(strconv.FormatBool(prefetch)).Inc()
+		}
+		countRequestByParams(r)
+	}
 }
 
 // Checks service state: true if service is healthy, false otherwise. Service is
-// considered healthy when stateFilePath is present.
+// considered healthy when none of critical health checks fails, as last
+// evaluated in background and damped: it is not draining, stateFilePath is
+// present, nor is access log failed when configured to fail health on log
+// errors. Draining service is unhealthy right away.
 func serviceHealthy() bool {
-	_, err := os.Stat(*stateFilePath)
-	return err == nil
+	if draining.Load() || drainMode.Load() {
+		return false
+	}
+	if o := activeOverride(); o != nil {
+		return o.healthy
+	}
+	return currentHealth().healthy
 }
 
-// Serves service state: http 200 when healthy, http 503 otherwise.
+// Serves service state: http 200 when healthy, http 503 otherwise, as plain
+// text, or with results of health checks as JSON when asked verbosely.
 func serveState(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "GET" {
-		http.NotFound(w, r)
+	defer trackServeImageDuration(r.Context(), time.Now(), "state", "")
+
+	w.Header().Add("Vary", "Accept")
+
+	if verboseState(r) {
+		serveVerboseState(w, r)
 		return
 	}
 
+	writeState(w, r, serviceHealthy())
+}
+
+// Writes service state as plain text: http 200 when healthy, http 503
+// otherwise.
+func writeState(w http.ResponseWriter, r *http.Request, healthy bool) {
 	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
-	w.Header().Set("Content-Type", "text/html")
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 
-	if !serviceHealthy() {
-		w.WriteHeader(503)
-		if _, err := w.Write([]byte("Error 503 (Service not available)")); err != nil {
-			log.Println("WARNING", err)
-		}
+	status, body := http.StatusOK, "OK"
+	if !healthy {
+		status, body = http.StatusServiceUnavailable, "Error 503 (Service not available)"
+	}
+
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(status)
+
+	if r.Method == "HEAD" {
 		return
 	}
 
-	if _, err := w.Write([]byte("OK")); err != nil {
-		log.Println("WARNING", err)
+	if _, err := w.Write([]byte(body)); err != nil {
+		slog.WarnContext(r.Context(), "state: Response not written", "path", r.URL.Path, "error", err)
+	}
+}
+
+// Answers request of method other than given ones with http 405, naming them
+// in Allow header.
+func methodNotAllowed(w http.ResponseWriter, r *http.Request, methods ...string) {
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	http.Error(w, "Error 405 (Method not allowed)", http.StatusMethodNotAllowed)
+}
+
+// Replays dead letters, exiting on failure.
+func replay() {
+	if err := initServiceLog(); err != nil {
+		fatal("log: Logs not initialized", "error", err)
+	}
+
+	if err := replayDeadLetters(); err != nil {
+		fatal("replay: Dead letters not replayed", "error", err)
 	}
 }
 
+// Logs error and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
 func main() {
-	kingpin.Parse()
+	kingpin.Version(versionString())
 
-	terminateServer := make(chan os.Signal)
+	if err := loadConfig(os.Args[1:]); err != nil {
+		fatal("config: Configuration not loaded", "error", err)
+	}
+
+	switch kingpin.Parse() {
+	case replayCommand.FullCommand():
+		replay()
+		return
+	case signCommand.FullCommand():
+		sign()
+		return
+	case checkCommand.FullCommand():
+		check()
+		return
+	}
+
+	terminateServer := make(chan os.Signal, 1)
 	signal.Notify(terminateServer, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
 
-	initMetrics()
+	upgradeServer := make(chan os.Signal, 1)
+	signal.Notify(upgradeServer, syscall.SIGUSR2)
 
-	srv := initServer()
+	reopenLogFiles := make(chan os.Signal, 1)
+	signal.Notify(reopenLogFiles, syscall.SIGHUP)
 
-	go func() {
+	toggleDrainMode := make(chan os.Signal, 1)
+	signal.Notify(toggleDrainMode, syscall.SIGUSR1)
+
+	registry := initMetrics()
+	startTimeSeconds.Set(float64(startTime.UnixNano()) / 1e9)
+
+	servers, lc := initServer(registry)
+
+	for _, srv := range servers {
 		startServer(srv)
-	}()
+	}
 
-	<-terminateServer
+	notifySystemdReady()
+	notifyUpgradeReady()
+	startSystemdWatchdog()
 
-	stopServer(srv)
+	for {
+		select {
+		case <-terminateServer:
+			stopServer(servers, lc)
+			return
+		case <-upgradeServer:
+			if err := upgrade(); err != nil {
+				slog.Warn("upgrade: Process not upgraded", "error", err)
+				continue
+			}
+			stopServer(servers, lc)
+			return
+		case <-toggleDrainMode:
+			toggleDrain()
+		case <-reopenLogFiles:
+			reopenLogs()
+			reloadConfig()
+		}
+	}
 }
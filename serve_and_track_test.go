@@ -0,0 +1,385 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	kingpin "gopkg.in/alecthomas/kingpin.v2"
+)
+
+// Repeatable flags, reset before parsing, as kingpin appends to their values.
+var repeatableFlags = []*[]string{
+	proxyProtocolAllowedSources,
+	realIPTrustedCIDRs,
+	trustedProxyCIDRs,
+	signedParams,
+	metricLabelParams,
+	responseHeaderValues,
+	corsAllowedOrigins,
+	corsAllowedMethods,
+	scrubQueryParams,
+	eventFieldToggles,
+	eventIncludeHeaders,
+	sinks,
+	acmeHosts,
+}
+
+// Values of flags before parsing, to which flags without defaults are reset,
+// and defaults of flags, restored once tests changing them end.
+var (
+	initialFlagValues   = map[string]string{}
+	initialFlagDefaults = map[string][]string{}
+)
+
+// Flags given by parseFlags ahead of flags of tests, unless tests give them.
+var testFlags = []string{"listen-address", "access-log-path", "state-file-path", "health-interval"}
+
+func TestMain(m *testing.M) {
+	for _, f := range kingpin.CommandLine.Model().Flags {
+		initialFlagValues[f.Name] = f.Value.String()
+		initialFlagDefaults[f.Name] = f.Default
+	}
+	os.Exit(m.Run())
+}
+
+// Parses given flags, others getting their defaults or initial values, with
+// access log and state file in temporary directory, and health evaluated only
+// when tests update it. Flag defaults changed by configuration file or
+// environment, and health of service, are reset once test ends.
+func parseFlags(t *testing.T, args ...string) {
+	t.Helper()
+
+	for _, values := range repeatableFlags {
+		*values = nil
+	}
+	// Enum without default cannot be set to its empty initial value.
+	*fluentBufferOverflow = ""
+
+	var repeatable int
+	for _, m := range kingpin.CommandLine.Model().Flags {
+		if cumulative(m) {
+			repeatable++
+		} else if m.Value.String() != initialFlagValues[m.Name] {
+			if err := m.Value.Set(initialFlagValues[m.Name]); err != nil && len(m.Default) == 0 {
+				t.Fatalf("flag %s not reset: %v", m.Name, err)
+			}
+		}
+	}
+	if repeatable != len(repeatableFlags) {
+		t.Fatalf("%d repeatable flags, %d reset", repeatable, len(repeatableFlags))
+	}
+	t.Cleanup(func() {
+		for name, values := range initialFlagDefaults {
+			kingpin.CommandLine.GetFlag(name).Default(values...)
+		}
+		envFlags, argFlags, loadedConfigFile = nil, nil, nil
+		reloadable.Store(nil)
+		health.Store(nil)
+		healthStreak = 0
+		draining.Store(false)
+		drainMode.Store(false)
+	})
+
+	dir := t.TempDir()
+	stateFile := filepath.Join(dir, "state")
+	if err := os.WriteFile(stateFile, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var given []string
+	for i, value := range []string{"127.0.0.1:0", filepath.Join(dir, "access.log"), stateFile, "1h"} {
+		if !slices.ContainsFunc(args, func(arg string) bool { return strings.HasPrefix(arg, "--"+testFlags[i]+"=") }) {
+			given = append(given, "--"+testFlags[i]+"="+value)
+		}
+	}
+	args = append(given, args...)
+
+	if _, err := kingpin.CommandLine.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Initializes servers of given flags, with metrics of their own registry.
+// Returned with them is function closing their resources, e.g. to flush events,
+// called once test ends otherwise.
+func newTestServers(t *testing.T, args ...string) ([]*http.Server, *prometheus.Registry, func()) {
+	t.Helper()
+
+	parseFlags(t, args...)
+
+	registry := initMetrics()
+	servers, lc := initServer(registry)
+
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			lc.close(ctx)
+		})
+	}
+	t.Cleanup(stop)
+
+	return servers, registry, stop
+}
+
+// Starts given server, returning address it listens on.
+func startTestServer(t *testing.T, srv *http.Server) string {
+	t.Helper()
+
+	startServer(srv)
+	t.Cleanup(func() { srv.Close() })
+
+	serverListenersMu.Lock()
+	defer serverListenersMu.Unlock()
+	return serverListeners[srv.Addr].Addr().String()
+}
+
+// Writes self-signed certificate and key of localhost to temporary directory,
+// returning their paths and the certificate.
+func writeCertificate(t *testing.T) (string, string, *x509.Certificate) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return certPath, keyPath, cert
+}
+
+// Fetches tracking image of given URL, failing unless it is GIF one.
+func fetchGIF(t *testing.T, client *http.Client, url string) {
+	t.Helper()
+
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d, want 200", resp.StatusCode)
+	}
+	if contentType := resp.Header.Get("Content-Type"); contentType != "image/gif" {
+		t.Errorf("content type %q, want image/gif", contentType)
+	}
+	if !strings.HasPrefix(string(body), "GIF8") {
+		t.Errorf("body %q is not GIF image", body)
+	}
+}
+
+func TestServeGIFOverHTTP(t *testing.T) {
+	servers, _, _ := newTestServers(t)
+	if servers[0].TLSConfig != nil {
+		t.Fatal("TLS enabled without certificate")
+	}
+
+	addr := startTestServer(t, servers[0])
+
+	fetchGIF(t, http.DefaultClient, "http://"+addr+"/track")
+}
+
+func TestServeGIFOverHTTPS(t *testing.T) {
+	certPath, keyPath, cert := writeCertificate(t)
+
+	servers, _, _ := newTestServers(t, "--tls-cert-path="+certPath, "--tls-key-path="+keyPath)
+	addr := startTestServer(t, servers[0])
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+
+	fetchGIF(t, client, "https://"+addr+"/track")
+
+	resp, err := http.Get("http://" + addr + "/track")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("plain http request answered with status %d, want 400", resp.StatusCode)
+	}
+}
+
+// Scrapes metrics of main server, returning their text exposition.
+func scrapeMetrics(t *testing.T, srv *http.Server) string {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(w, httptest.NewRequest("GET", *metricsURLPath, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("metrics status %d, want 200", w.Code)
+	}
+	return w.Body.String()
+}
+
+// Returns value of metric sample of given name and labels in text exposition,
+// failing when it is not exposed.
+func metricValue(t *testing.T, exposition, sample string) float64 {
+	t.Helper()
+
+	for _, line := range strings.Split(exposition, "\n") {
+		if value, ok := strings.CutPrefix(line, sample+" "); ok {
+			v, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return v
+		}
+	}
+	t.Fatalf("metric %s not exposed", sample)
+	return 0
+}
+
+func TestStartAndLastTrackingRequestMetrics(t *testing.T) {
+	servers, _, _ := newTestServers(t)
+	startTimeSeconds.Set(float64(startTime.UnixNano()) / 1e9)
+
+	metrics := scrapeMetrics(t, servers[0])
+	if got := metricValue(t, metrics, "serve_and_track_start_time_seconds"); got != float64(startTime.UnixNano())/1e9 {
+		t.Errorf("start time %v, want %v", got, float64(startTime.UnixNano())/1e9)
+	}
+	metricValue(t, metrics, "serve_and_track_last_tracking_request_timestamp_seconds")
+
+	before := float64(time.Now().UnixNano()) / 1e9
+	servers[0].Handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/track", nil))
+	after := float64(time.Now().UnixNano()) / 1e9
+
+	got := metricValue(t, scrapeMetrics(t, servers[0]), "serve_and_track_last_tracking_request_timestamp_seconds")
+	if got < before || got > after {
+		t.Errorf("last tracking request timestamp %v, want between %v and %v", got, before, after)
+	}
+}
+
+// Returns sum of values of metric samples of given name with given label, e.g.
+// status="success", in text exposition.
+func metricSum(t *testing.T, exposition, name, label string) float64 {
+	t.Helper()
+
+	var sum float64
+	for _, line := range strings.Split(exposition, "\n") {
+		sample, value, ok := strings.Cut(line, " ")
+		if !ok || !strings.HasPrefix(sample, name+"{") || !strings.Contains(sample, label) {
+			continue
+		}
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sum += v
+	}
+	return sum
+}
+
+func TestHandlersWithFreshRegistries(t *testing.T) {
+	for i := 0; i < 2; i++ {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			servers, registry, _ := newTestServers(t)
+
+			if _, err := registry.Gather(); err != nil {
+				t.Fatal(err)
+			}
+
+			before := metricSum(t, scrapeMetrics(t, servers[0]), "tracking_requests_count_total", `status="success"`)
+
+			w := httptest.NewRecorder()
+			servers[0].Handler.ServeHTTP(w, httptest.NewRequest("GET", "/track", nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d, want 200", w.Code)
+			}
+
+			after := metricSum(t, scrapeMetrics(t, servers[0]), "tracking_requests_count_total", `status="success"`)
+			if after-before != 1 {
+				t.Errorf("%v successful tracking requests counted, want 1", after-before)
+			}
+		})
+	}
+}
+
+func TestMetricNamespace(t *testing.T) {
+	servers, _, _ := newTestServers(t, "--metric-namespace=acme")
+
+	servers[0].Handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/track", nil))
+	metrics := scrapeMetrics(t, servers[0])
+
+	if metricSum(t, metrics, "acme_tracking_requests_count_total", `status="success"`) == 0 {
+		t.Error("tracking requests not counted in metric of namespace")
+	}
+	if strings.Contains(metrics, "\ntracking_requests_count_total{") {
+		t.Error("metric exposed without namespace")
+	}
+}
+
+func TestRuntimeMetricsOptIn(t *testing.T) {
+	servers, _, _ := newTestServers(t)
+	if metrics := scrapeMetrics(t, servers[0]); strings.Contains(metrics, "go_goroutines") || strings.Contains(metrics, "process_") {
+		t.Error("runtime metrics exposed without being enabled")
+	}
+
+	servers, _, _ = newTestServers(t, "--enable-go-metrics", "--enable-process-metrics")
+	metrics := scrapeMetrics(t, servers[0])
+	if !strings.Contains(metrics, "go_goroutines") {
+		t.Error("Go metrics not exposed when enabled")
+	}
+	if runtime.GOOS == "linux" && !strings.Contains(metrics, "process_start_time_seconds") {
+		t.Error("process metrics not exposed when enabled")
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Query parameters of signature of tracking URL and of its expiry, as Unix
+// time in seconds.
+const (
+	signatureParam = "sig"
+	expiryParam    = "exp"
+)
+
+// Returns signature of tracking URL path, signed query parameters and expiry:
+// HMAC-SHA256 of path and query of them, encoded in sorted order, with base64
+// URL encoding.
+func signature(secret, path string, query url.Values, expiry string) string {
+	signed := url.Values{}
+	for _, param := range *signedParams {
+		if values, ok := query[param]; ok {
+			signed[param] = values
+		}
+	}
+	signed.Set(expiryParam, expiry)
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(path + "?" + signed.Encode()))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Checks whether request of tracking image is signed with configured secret
+// and not expired. Requests are considered signed when signing is disabled.
+func signedRequest(r *http.Request) bool {
+	if *signingSecret == "" {
+		return true
+	}
+
+	query := r.URL.Query()
+
+	expiry := query.Get(expiryParam)
+	exp, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil || time.Now().Unix() > exp {
+		return false
+	}
+
+	expected := signature(*signingSecret, r.URL.Path, query, expiry)
+	return hmac.Equal([]byte(query.Get(signatureParam)), []byte(expected))
+}
+
+// Returns tracking URL signed with configured secret, valid for given
+// duration.
+func signURL(rawURL string, ttl time.Duration) (string, error) {
+	if *signingSecret == "" {
+		return "", errors.New("signing secret not given")
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+
+	query := u.Query()
+	query.Del(signatureParam)
+
+	expiry := strconv.FormatInt(time.Now().Add(ttl).Unix(), 10)
+	query.Set(expiryParam, expiry)
+	query.Set(signatureParam, signature(*signingSecret, u.Path, query, expiry))
+
+	u.RawQuery = query.Encode()
+
+	return u.String(), nil
+}
+
+// Prints signed tracking URL, exiting on failure.
+func sign() {
+	signed, err := signURL(*signURLArg, *signTTL)
+	if err != nil {
+		fatal("sign: URL not signed", "error", err)
+	}
+
+	fmt.Println(signed)
+}
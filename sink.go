@@ -0,0 +1,432 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Destination of tracking events. Writes queue events for delivery, so that
+// they never block on slow destinations.
+type eventSink interface {
+	Write(ctx context.Context, e *event) error
+	Flush(ctx context.Context) error
+	Close(ctx context.Context) error
+}
+
+// Constructors of event sinks by name.
+var sinkConstructors = map[string]func() (eventSink, error){
+	"log":        newLogSink,
+	"kafka":      newKafkaSink,
+	"sqlite":     newSQLiteSink,
+	"firehose":   newFirehoseSink,
+	"pubsub":     newPubSubSink,
+	"nats":       newNATSSink,
+	"webhook":    newWebhookSink,
+	"clickhouse": newClickHouseSink,
+	"fluent":     newFluentSink,
+}
+
+// Event sinks, set up before servers are started.
+var eventSinks []eventSink
+
+// Event not queued, as the queue of the sink is full or closed.
+var errEventDropped = errors.New("event dropped")
+
+// Delivery not attempted, as the circuit of the sink is open.
+var errCircuitOpen = errors.New("circuit open")
+
+// Delivery failure not to be retried, e.g. on http 4xx response. Events failing
+// permanently are written to dead letter file rather than spooled.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+
+func (e *permanentError) Unwrap() error { return e.err }
+
+// Tracking event queued for delivery, together with its JSON encoding.
+type queuedEvent struct {
+	event *event
+	line  []byte
+}
+
+// Event sink queueing events, delivered in batches by dedicated goroutines at
+// least every flush interval. Events are dropped when the queue is full, unless
+// overflow policy is to block, so that delivery never blocks serving of
+// tracking image. Deliveries are not attempted while circuit is open.
+type eventQueue struct {
+	name      string
+	deliver   func(ctx context.Context, batch []queuedEvent) ([]queuedEvent, error)
+	close     func() error
+	spool     *eventSpool
+	breaker   *circuitBreaker
+	events    chan queuedEvent
+	batchSize int
+	overflow  string
+
+	pending  atomic.Int64
+	progress atomic.Int64
+	flushNow chan struct{}
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+// Batching and concurrency of event delivery, and policy when the queue is
+// full: block, drop-new or drop-old.
+type queueSettings struct {
+	batchSize     int
+	flushInterval time.Duration
+	workers       int
+	overflow      string
+}
+
+// Returns configured batching and overflow policy of event delivery, by a
+// single worker.
+func defaultQueueSettings() queueSettings {
+	return queueSettings{batchSize: *sinkBatchSize, flushInterval: *sinkFlushInterval, workers: 1, overflow: *sinkOverflow}
+}
+
+// Creates event queue of named sink with configured size, delivered by given
+// number of workers. Deliver function returns events not delivered, spooled
+// when spool is configured or written to dead letter file, close function
+// releases the sink once queued events are delivered.
+func newEventQueue(name string, settings queueSettings, deliver func(ctx context.Context, batch []queuedEvent) ([]queuedEvent, error), closeSink func() error) (*eventQueue, error) {
+	spool, err := openEventSpool(name)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	q := &eventQueue{
+		name:      name,
+		deliver:   deliver,
+		close:     closeSink,
+		spool:     spool,
+		breaker:   newCircuitBreaker(name),
+		events:    make(chan queuedEvent, *sinkBufferSize),
+		batchSize: settings.batchSize,
+		overflow:  settings.overflow,
+		flushNow:  make(chan struct{}, 1),
+		ctx:       ctx,
+		cancel:    cancel,
+		done:      make(chan struct{}),
+	}
+	q.progress.Store(time.Now().UnixNano())
+
+	var wg sync.WaitGroup
+	for range max(settings.workers, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q.run(settings.flushInterval)
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(q.done)
+	}()
+
+	return q, nil
+}
+
+// Queues event to be delivered. When the queue is full either the event or the
+// oldest queued event is dropped, or the event waits until queued or context is
+// done. The event is dropped when the queue is closed.
+func (q *eventQueue) Write(ctx context.Context, e *event) error {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	if q.closed {
+		sinkDroppedEvents.WithLabelValues(q.name).Inc()
+		return errEventDropped
+	}
+
+	for {
+		q.pending.Add(1)
+		select {
+		case q.events <- queuedEvent{event: e, line: e.line}:
+			sinkQueuedEvents.WithLabelValues(q.name).Set(float64(len(q.events)))
+			return nil
+		default:
+			q.pending.Add(-1)
+		}
+
+		switch q.overflow {
+		case "block":
+			q.pending.Add(1)
+			select {
+			case q.events <- queuedEvent{event: e, line: e.line}:
+				sinkQueuedEvents.WithLabelValues(q.name).Set(float64(len(q.events)))
+				return nil
+			case <-ctx.Done():
+				q.pending.Add(-1)
+				sinkDroppedEvents.WithLabelValues(q.name).Inc()
+				return errEventDropped
+			}
+		case "drop-new":
+			sinkDroppedEvents.WithLabelValues(q.name).Inc()
+			return errEventDropped
+		}
+
+		select {
+		case <-q.events:
+			q.pending.Add(-1)
+			sinkDroppedEvents.WithLabelValues(q.name).Inc()
+		default:
+		}
+	}
+}
+
+// Delivers queued events right away, waiting until they are delivered or
+// context is done.
+func (q *eventQueue) Flush(ctx context.Context) error {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+
+	for q.pending.Load() > 0 {
+		select {
+		case q.flushNow <- struct{}{}:
+		default:
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+// Delivers queued events in batches until closed.
+func (q *eventQueue) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	batch := make([]queuedEvent, 0, q.batchSize)
+
+	// Spooled events are delivered first, new ones are spooled until the spool
+	// is drained, so that events are delivered in order. While circuit is open
+	// events are spooled or written to dead letter file right away.
+	flush := func() {
+		spooled := q.spool != nil && !q.spool.empty()
+		if len(batch) == 0 && !spooled {
+			return
+		}
+
+		allowed := q.breaker.allow()
+		drained := !spooled || (allowed && q.spool.drain(q.ctx, q.batchSize, q.deliverBatch))
+
+		if len(batch) == 0 {
+			return
+		}
+
+		failed, err := batch, error(nil)
+		if !allowed {
+			err = errCircuitOpen
+		} else if drained {
+			start := time.Now()
+			failed, err = q.deliverBatch(q.ctx, batch)
+			sinkDeliveryDuration.WithLabelValues(q.name).Observe(time.Since(start).Seconds())
+			sinkDeliveredEvents.WithLabelValues(q.name).Add(float64(len(batch) - len(failed)))
+		}
+
+		var permanent *permanentError
+		if len(failed) > 0 && q.spool != nil && (err == nil || !errors.As(err, &permanent)) {
+			if serr := q.spool.append(failed); serr == nil {
+				if err != nil {
+					sinkDeliveryErrors.WithLabelValues(q.name).Add(float64(len(failed)))
+					slog.Warn("sink: Events not delivered, spooled", "sink", q.name, "events", len(failed), "error", err)
+				}
+				failed, err = nil, nil
+			} else {
+				err = errors.Join(err, serr)
+			}
+		}
+
+		if err != nil {
+			sinkDeliveryErrors.WithLabelValues(q.name).Add(float64(len(failed)))
+			slog.Warn("sink: Events not delivered", "sink", q.name, "events", len(failed), "error", err)
+			writeDeadLetters(q.name, failed, err)
+		}
+
+		q.pending.Add(-int64(len(batch)))
+		batch = batch[:0]
+	}
+
+	for {
+		q.progress.Store(time.Now().UnixNano())
+
+		select {
+		case e, ok := <-q.events:
+			if !ok {
+				flush()
+				return
+			}
+			sinkQueuedEvents.WithLabelValues(q.name).Set(float64(len(q.events)))
+			batch = append(batch, e)
+			if len(batch) >= q.batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-q.flushNow:
+			for len(batch) < q.batchSize && len(q.events) > 0 {
+				e, ok := <-q.events
+				if !ok {
+					break
+				}
+				batch = append(batch, e)
+			}
+			flush()
+		}
+	}
+}
+
+// Checks whether queue is wedged: events are pending while none of its
+// workers made progress for longer than given threshold.
+func (q *eventQueue) wedged(threshold time.Duration) bool {
+	return q.pending.Load() > 0 && time.Since(time.Unix(0, q.progress.Load())) > threshold
+}
+
+// Delivers batch of events, recording outcome in circuit breaker. Permanent
+// failures do not open the circuit, as the sink responds.
+func (q *eventQueue) deliverBatch(ctx context.Context, batch []queuedEvent) ([]queuedEvent, error) {
+	failed, err := q.deliver(ctx, batch)
+
+	var permanent *permanentError
+	if err != nil && !errors.As(err, &permanent) {
+		q.breaker.failure()
+	} else {
+		q.breaker.success()
+	}
+
+	return failed, err
+}
+
+// Delivers queued events, stops the delivering goroutines and closes the sink,
+// aborting delivery when context is done.
+func (q *eventQueue) Close(ctx context.Context) error {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.events)
+	}
+	q.mu.Unlock()
+
+	select {
+	case <-q.done:
+	case <-ctx.Done():
+		q.cancel()
+		<-q.done
+	}
+
+	if err := q.close(); err != nil {
+		return fmt.Errorf("%s sink: %w", q.name, err)
+	}
+	return nil
+}
+
+// Returns names of event sinks: given ones, and ones implied by their
+// configuration, i.e. event log, Kafka and SQLite, each once.
+func sinkNames() []string {
+	names := slices.Clone(*sinks)
+	implied := map[string]bool{
+		"log":    *eventLogFilePath != "",
+		"kafka":  *kafkaBrokers != "",
+		"sqlite": *sqlitePath != "",
+	}
+	for _, name := range []string{"log", "kafka", "sqlite"} {
+		if implied[name] {
+			names = append(names, name)
+		}
+	}
+
+	var unique []string
+	seen := map[string]bool{}
+	for _, name := range names {
+		if !seen[name] {
+			seen[name] = true
+			unique = append(unique, name)
+		}
+	}
+
+	return unique
+}
+
+// Creates named event sink as configured.
+func newEventSink(name string) (eventSink, error) {
+	s, err := sinkConstructors[name]()
+	if err != nil {
+		return nil, fmt.Errorf("%s sink: %w", name, err)
+	}
+	return s, nil
+}
+
+// Initializes dead letter file and event sinks.
+func initSinks() error {
+	if err := initDeadLetters(); err != nil {
+		return err
+	}
+
+	for _, name := range sinkNames() {
+		s, err := newEventSink(name)
+		if err != nil {
+			return err
+		}
+		eventSinks = append(eventSinks, s)
+	}
+
+	return nil
+}
+
+// Writes event to all event sinks in parallel, each queueing it on its own, so
+// that sink waiting for room in its full queue does not hold up others.
+func writeEvent(ctx context.Context, e *event) {
+	if len(eventSinks) == 1 {
+		eventSinks[0].Write(ctx, e)
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, s := range eventSinks {
+		wg.Add(1)
+		go func(s eventSink) {
+			defer wg.Done()
+			s.Write(ctx, e)
+		}(s)
+	}
+	wg.Wait()
+}
+
+// Delivers queued events of all sinks and closes them, within context deadline,
+// in parallel.
+func closeSinks(ctx context.Context) {
+	var wg sync.WaitGroup
+
+	for _, s := range eventSinks {
+		wg.Add(1)
+		go func(s eventSink) {
+			defer wg.Done()
+			if err := s.Close(ctx); err != nil {
+				slog.Warn("sink: Sink not closed", "error", err)
+			}
+		}(s)
+	}
+
+	wg.Wait()
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// Event sink waiting until context of writes is done, as queue full under
+// block overflow policy does.
+type blockedSink struct{}
+
+func (blockedSink) Write(ctx context.Context, e *event) error {
+	<-ctx.Done()
+	return errEventDropped
+}
+
+func (blockedSink) Flush(ctx context.Context) error { return nil }
+func (blockedSink) Close(ctx context.Context) error { return nil }
+
+// Event sink passing written events to channel.
+type channelSink chan *event
+
+func (s channelSink) Write(ctx context.Context, e *event) error {
+	s <- e
+	return nil
+}
+
+func (s channelSink) Flush(ctx context.Context) error { return nil }
+func (s channelSink) Close(ctx context.Context) error { return nil }
+
+func TestWriteEventNotHeldUpByBlockedSink(t *testing.T) {
+	written := make(channelSink, 1)
+
+	previous := eventSinks
+	eventSinks = []eventSink{blockedSink{}, written}
+	t.Cleanup(func() { eventSinks = previous })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		writeEvent(ctx, &event{})
+		close(done)
+	}()
+
+	select {
+	case <-written:
+	case <-time.After(5 * time.Second):
+		t.Fatal("event not written to sink while other one is blocked")
+	}
+
+	cancel()
+	<-done
+}
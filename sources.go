@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// Binary trie of address prefixes, IPv4 and IPv6 ones apart, matching address
+// in at most as many steps as it has bits, regardless of number of prefixes.
+type prefixTrie struct {
+	v4, v6 *trieNode
+}
+
+// Node of prefix trie, terminal when a prefix ends at it.
+type trieNode struct {
+	children [2]*trieNode
+	terminal bool
+}
+
+// Creates prefix trie of given prefixes.
+func newPrefixTrie(prefixes []netip.Prefix) *prefixTrie {
+	t := &prefixTrie{v4: &trieNode{}, v6: &trieNode{}}
+	for _, p := range prefixes {
+		t.insert(p)
+	}
+	return t
+}
+
+// Inserts prefix into trie.
+func (t *prefixTrie) insert(p netip.Prefix) {
+	p = p.Masked()
+
+	addr := p.Addr().Unmap()
+	n := t.v6
+	if addr.Is4() {
+		n = t.v4
+		if p.Addr().Is4In6() {
+			p = netip.PrefixFrom(addr, max(p.Bits()-96, 0))
+		}
+	}
+
+	b := addr.AsSlice()
+	for i := 0; i < p.Bits() && !n.terminal; i++ {
+		bit := b[i/8] >> (7 - i%8) & 1
+		if n.children[bit] == nil {
+			n.children[bit] = &trieNode{}
+		}
+		n = n.children[bit]
+	}
+	n.terminal = true
+}
+
+// Checks whether address matches any prefix of trie.
+func (t *prefixTrie) contains(addr netip.Addr) bool {
+	addr = addr.Unmap()
+
+	n := t.v6
+	if addr.Is4() {
+		n = t.v4
+	}
+
+	b := addr.AsSlice()
+	for i := 0; n != nil; i++ {
+		if n.terminal {
+			return true
+		}
+		if i == len(b)*8 {
+			return false
+		}
+		n = n.children[b[i/8]>>(7-i%8)&1]
+	}
+	return false
+}
+
+// Sources blocked from tracking paths, and sources allowed to reach metrics
+// and state, nil when respective file is not given.
+var (
+	blockedSources atomic.Pointer[prefixTrie]
+	allowedSources atomic.Pointer[prefixTrie]
+)
+
+// Loads blocked and allowed sources from configured files, reloaded on
+// SIGHUP.
+func initSources() error {
+	for _, l := range sourceLists() {
+		if err := l.load(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reloads blocked and allowed sources, leaving ones loaded before in effect on
+// failure.
+func reloadSources() {
+	for _, l := range sourceLists() {
+		if err := l.load(); err != nil {
+			slog.Warn("source: Source list not reloaded", "path", l.path, "error", err)
+		}
+	}
+}
+
+// List of sources loaded from file into trie.
+type sourceList struct {
+	path string
+	trie *atomic.Pointer[prefixTrie]
+}
+
+// Returns configured lists of sources.
+func sourceLists() []sourceList {
+	var lists []sourceList
+	if *blockCIDRFilePath != "" {
+		lists = append(lists, sourceList{*blockCIDRFilePath, &blockedSources})
+	}
+	if *allowCIDRFilePath != "" {
+		lists = append(lists, sourceList{*allowCIDRFilePath, &allowedSources})
+	}
+	return lists
+}
+
+// Loads sources from file, one address or CIDR per line, skipping empty lines
+// and comments.
+func (l sourceList) load() error {
+	f, err := os.Open(l.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var cidrs []string
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			cidrs = append(cidrs, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	prefixes, err := parsePrefixes(cidrs)
+	if err != nil {
+		return err
+	}
+
+	l.trie.Store(newPrefixTrie(prefixes))
+
+	slog.Info("source: Source list loaded", "path", l.path, "cidrs", len(prefixes))
+
+	return nil
+}
+
+// Checks whether real client address of request matches trie of sources.
+func sourceMatches(r *http.Request, sources *prefixTrie) bool {
+	addr, ok := parseHostIP(realClientIP(r))
+	return ok && sources.contains(addr)
+}
+
+// Wraps tracking handler with blocking of blocked sources: their requests are
+// answered with http 403 and counted as blocked. No-op when block file is not
+// given.
+func blockSources(next http.Handler) http.Handler {
+	if *blockCIDRFilePath == "" {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if sources := blockedSources.Load(); sources != nil && sourceMatches(r, sources) {
+			blockedRequests.WithLabelValues("blocked").Inc()
+			http.Error(w, "Error 403 (Forbidden)", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Wraps handler with allowing of allowed sources only: requests of other
+// sources are answered with http 403 and counted as not allowed. No-op when
+// allow file is not given.
+func allowSources(next http.Handler) http.Handler {
+	if *allowCIDRFilePath == "" {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if sources := allowedSources.Load(); sources != nil && !sourceMatches(r, sources) {
+			blockedRequests.WithLabelValues("not_allowed").Inc()
+			http.Error(w, "Error 403 (Forbidden)", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Size in bytes at which spool segment is closed and next one is started.
+const spoolSegmentSize = 4 * 1024 * 1024
+
+// Segment file of event spool.
+type spoolSegment struct {
+	path   string
+	seq    int
+	size   int64
+	events int
+}
+
+// Spool of events not delivered to a sink, appended as JSON lines to segment
+// files and delivered in order once the sink recovers. Oldest segments are
+// dropped when the spool exceeds its maximum size.
+type eventSpool struct {
+	name     string
+	dir      string
+	maxBytes int64
+
+	mu       sync.Mutex
+	segments []spoolSegment
+	bytes    int64
+}
+
+// Opens spool of named sink in configured directory, with segments spooled
+// before, disabled when directory is not given.
+func openEventSpool(name string) (*eventSpool, error) {
+	if *spoolDir == "" {
+		return nil, nil
+	}
+
+	dir := filepath.Join(*spoolDir, name)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &eventSpool{name: name, dir: dir, maxBytes: int64(*spoolMaxMB) * 1024 * 1024}
+
+	for _, entry := range entries {
+		seq, err := strconv.Atoi(strings.TrimSuffix(entry.Name(), ".jsonl"))
+		if err != nil || !strings.HasSuffix(entry.Name(), ".jsonl") {
+			continue
+		}
+
+		path := filepath.Join(dir, entry.Name())
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		s.segments = append(s.segments, spoolSegment{path: path, seq: seq, size: int64(len(b)), events: bytes.Count(b, []byte{'\n'})})
+		s.bytes += int64(len(b))
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i].seq < s.segments[j].seq })
+
+	if len(s.segments) > 0 {
+		slog.Info("spool: Spooled events found", "sink", name, "segments", len(s.segments), "bytes", s.bytes)
+	}
+	spoolBytes.WithLabelValues(name).Set(float64(s.bytes))
+
+	return s, nil
+}
+
+// Checks whether spool has no events.
+func (s *eventSpool) empty() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.segments) == 0
+}
+
+// Appends events to the last segment, or to a new one when it is full, and
+// drops oldest segments past maximum size of spool.
+func (s *eventSpool) append(events []queuedEvent) error {
+	var b []byte
+	for _, e := range events {
+		b = append(append(b, e.line...), '\n')
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.segments) == 0 || s.segments[len(s.segments)-1].size >= spoolSegmentSize {
+		seq := 1
+		if len(s.segments) > 0 {
+			seq = s.segments[len(s.segments)-1].seq + 1
+		}
+		s.segments = append(s.segments, spoolSegment{path: filepath.Join(s.dir, fmt.Sprintf("%020d.jsonl", seq)), seq: seq})
+	}
+
+	last := &s.segments[len(s.segments)-1]
+
+	f, err := os.OpenFile(last.path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	last.size += int64(len(b))
+	last.events += len(events)
+	s.bytes += int64(len(b))
+
+	for s.bytes > s.maxBytes && len(s.segments) > 1 {
+		oldest := s.segments[0]
+		if err := os.Remove(oldest.path); err != nil {
+			slog.Warn("spool: Spool segment not removed", "sink", s.name, "path", oldest.path, "error", err)
+			break
+		}
+		s.segments = s.segments[1:]
+		s.bytes -= oldest.size
+		spoolDroppedEvents.WithLabelValues(s.name).Add(float64(oldest.events))
+		slog.Warn("spool: Spool full, oldest events dropped", "sink", s.name, "events", oldest.events)
+	}
+
+	spoolBytes.WithLabelValues(s.name).Set(float64(s.bytes))
+
+	return nil
+}
+
+// Delivers spooled events in order, in batches of given size, until delivery
+// fails. Events failing permanently are written to dead letter file. Returns
+// whether spool is drained.
+func (s *eventSpool) drain(ctx context.Context, batchSize int, deliver func(ctx context.Context, batch []queuedEvent) ([]queuedEvent, error)) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for len(s.segments) > 0 {
+		segment := &s.segments[0]
+
+		events, err := readSpoolSegment(segment.path)
+		if err != nil {
+			slog.Warn("spool: Spool segment not read", "sink", s.name, "path", segment.path, "error", err)
+			return false
+		}
+
+		for len(events) > 0 {
+			batch := events[:min(batchSize, len(events))]
+
+			failed, err := deliver(ctx, batch)
+			sinkDeliveredEvents.WithLabelValues(s.name).Add(float64(len(batch) - len(failed)))
+
+			var permanent *permanentError
+			if err != nil && errors.As(err, &permanent) {
+				writeDeadLetters(s.name, failed, err)
+			} else if err != nil {
+				remaining := append(failed, events[len(batch):]...)
+				if err := s.rewrite(segment, remaining); err != nil {
+					slog.Warn("spool: Spool segment not rewritten", "sink", s.name, "path", segment.path, "error", err)
+				}
+				return false
+			}
+
+			events = events[len(batch):]
+		}
+
+		if err := os.Remove(segment.path); err != nil {
+			slog.Warn("spool: Spool segment not removed", "sink", s.name, "path", segment.path, "error", err)
+			return false
+		}
+		s.bytes -= segment.size
+		s.segments = s.segments[1:]
+
+		spoolBytes.WithLabelValues(s.name).Set(float64(s.bytes))
+	}
+
+	return true
+}
+
+// Rewrites segment with given events, replacing it atomically.
+func (s *eventSpool) rewrite(segment *spoolSegment, events []queuedEvent) error {
+	var b []byte
+	for _, e := range events {
+		b = append(append(b, e.line...), '\n')
+	}
+
+	tmp := segment.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, segment.path); err != nil {
+		return err
+	}
+
+	s.bytes += int64(len(b)) - segment.size
+	segment.size, segment.events = int64(len(b)), len(events)
+	spoolBytes.WithLabelValues(s.name).Set(float64(s.bytes))
+
+	return nil
+}
+
+// Reads events of spool segment, skipping malformed lines.
+func readSpoolSegment(path string) ([]queuedEvent, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var events []queuedEvent
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		line := append([]byte(nil), scanner.Bytes()...)
+
+		var e event
+		if err := json.Unmarshal(line, &e); err != nil {
+			continue
+		}
+		e.line = line
+
+		events = append(events, queuedEvent{event: &e, line: line})
+	}
+
+	return events, scanner.Err()
+}
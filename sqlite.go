@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// Maximum number of events returned by events endpoint at once.
+const maxEventsLimit = 1000
+
+// Interval of sweeps of events past retention.
+const sqliteRetentionSweepInterval = time.Hour
+
+// Schema migrations of event store, applied in order, each once, as tracked by
+// user version of the database.
+var sqliteMigrations = []string{
+	`CREATE TABLE events (
+		id          INTEGER PRIMARY KEY,
+		timestamp   INTEGER NOT NULL,
+		pixel_id    TEXT NOT NULL DEFAULT '',
+		remote_addr TEXT NOT NULL,
+		user_agent  TEXT NOT NULL,
+		referer     TEXT NOT NULL,
+		query       TEXT NOT NULL,
+		vars        TEXT NOT NULL
+	);
+	CREATE INDEX events_timestamp ON events (timestamp);
+	CREATE INDEX events_pixel_id_timestamp ON events (pixel_id, timestamp);`,
+}
+
+// Event store database, nil when event store is disabled.
+var eventStore *sql.DB
+
+// Creates SQLite event store at configured path, migrating its schema,
+// inserting events in transactions per batch and sweeping events past
+// retention.
+func newSQLiteSink() (eventSink, error) {
+	if *sqlitePath == "" {
+		return nil, errors.New("sqlite path not given")
+	}
+
+	db, err := sql.Open("sqlite", "file:"+*sqlitePath+"?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := migrateSQLite(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	settings := queueSettings{
+		batchSize:     *sqliteBatchSize,
+		flushInterval: *sqliteFlushInterval,
+		workers:       1,
+		overflow:      *sinkOverflow,
+	}
+
+	done, swept := make(chan struct{}), make(chan struct{})
+
+	q, err := newEventQueue("sqlite", settings, func(ctx context.Context, batch []queuedEvent) ([]queuedEvent, error) {
+		if err := insertEvents(ctx, db, batch); err != nil {
+			return batch, err
+		}
+		return nil, nil
+	}, func() error {
+		close(done)
+		<-swept
+		return db.Close()
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if *sqliteRetentionDays > 0 {
+		go sweepEvents(db, time.Duration(*sqliteRetentionDays)*24*time.Hour, done, swept)
+	} else {
+		close(swept)
+	}
+
+	eventStore = db
+
+	slog.Info("sqlite: Storing events", "path", *sqlitePath, "retention_days", *sqliteRetentionDays)
+
+	return q, nil
+}
+
+// Applies schema migrations not yet applied to the database.
+func migrateSQLite(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+
+	for i := version; i < len(sqliteMigrations); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(sqliteMigrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("sqlite migration %d: %w", i+1, err)
+		}
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+
+		slog.Info("sqlite: Schema migrated", "version", i+1)
+	}
+
+	return nil
+}
+
+// Inserts batch of events in a single transaction.
+func insertEvents(ctx context.Context, db *sql.DB, batch []queuedEvent) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, `INSERT INTO events
+		(timestamp, pixel_id, remote_addr, user_agent, referer, query, vars)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, e := range batch {
+		timestamp, err := time.Parse(time.RFC3339Nano, e.event.Timestamp)
+		if err != nil {
+			return err
+		}
+		query, err := json.Marshal(e.event.Query)
+		if err != nil {
+			return err
+		}
+		vars, err := json.Marshal(e.event.Vars)
+		if err != nil {
+			return err
+		}
+
+		if _, err := stmt.ExecContext(ctx, timestamp.UnixNano(), e.event.PixelID, e.event.RemoteAddr,
+			e.event.UserAgent, e.event.Referer, string(query), string(vars)); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Deletes events older than retention, at every sweep interval, until done is
+// closed. Swept is closed once sweeping stopped.
+func sweepEvents(db *sql.DB, retention time.Duration, done <-chan struct{}, swept chan<- struct{}) {
+	defer close(swept)
+
+	ticker := time.NewTicker(sqliteRetentionSweepInterval)
+	defer ticker.Stop()
+
+	for first := true; ; first = false {
+		if !first {
+			select {
+			case <-ticker.C:
+			case <-done:
+				return
+			}
+		}
+
+		result, err := db.Exec("DELETE FROM events WHERE timestamp < ?", time.Now().Add(-retention).UnixNano())
+		if err != nil {
+			slog.Warn("sqlite: Events past retention not deleted", "error", err)
+			continue
+		}
+
+		if n, _ := result.RowsAffected(); n > 0 {
+			slog.Info("sqlite: Events past retention deleted", "events", n)
+		}
+	}
+}
+
+// Serves stored events as JSON array, filtered by since (RFC 3339 timestamp)
+// and pixel query parameters, in order of time, at most limit of them.
+func serveEvents(w http.ResponseWriter, r *http.Request) {
+	var since int64
+	if s := r.URL.Query().Get("since"); s != "" {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			http.Error(w, "Error 400 (Invalid since)", http.StatusBadRequest)
+			return
+		}
+		since = t.UnixNano()
+	}
+
+	limit := 100
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxEventsLimit {
+			http.Error(w, "Error 400 (Invalid limit)", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	query := "SELECT timestamp, pixel_id, remote_addr, user_agent, referer, query, vars FROM events WHERE timestamp >= ?"
+	args := []any{since}
+	if pixel := r.URL.Query().Get("pixel"); pixel != "" {
+		query += " AND pixel_id = ?"
+		args = append(args, pixel)
+	}
+	query += " ORDER BY timestamp LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := eventStore.QueryContext(r.Context(), query, args...)
+	if err != nil {
+		slog.Warn("sqlite: Events not queried", "error", err)
+		http.Error(w, "Error 500 (Events not queried)", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	events := []event{}
+	for rows.Next() {
+		var e event
+		var timestamp int64
+		var rawQuery, rawVars string
+
+		if err := rows.Scan(&timestamp, &e.PixelID, &e.RemoteAddr, &e.UserAgent, &e.Referer, &rawQuery, &rawVars); err != nil {
+			slog.Warn("sqlite: Events not queried", "error", err)
+			http.Error(w, "Error 500 (Events not queried)", http.StatusInternalServerError)
+			return
+		}
+
+		e.Timestamp = time.Unix(0, timestamp).UTC().Format(time.RFC3339Nano)
+		json.Unmarshal([]byte(rawQuery), &e.Query)
+		json.Unmarshal([]byte(rawVars), &e.Vars)
+
+		events = append(events, e)
+	}
+	if err := rows.Err(); err != nil {
+		slog.Warn("sqlite: Events not queried", "error", err)
+		http.Error(w, "Error 500 (Events not queried)", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(events); err != nil {
+		slog.WarnContext(r.Context(), "sqlite: Response not written", "path", r.URL.Path, "error", err)
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCloseSQLiteSinkStopsSweep(t *testing.T) {
+	parseFlags(t, "--sqlite-path="+filepath.Join(t.TempDir(), "events.db"), "--sqlite-retention-days=1")
+
+	sink, err := newSQLiteSink()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	closed := make(chan error, 1)
+	go func() { closed <- sink.Close(ctx) }()
+
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-ctx.Done():
+		t.Fatal("sqlite sink not closed")
+	}
+}
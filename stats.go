@@ -0,0 +1,178 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Number of per second counters of rolling window of tracking requests, of
+// 15 minutes.
+const statsWindowSeconds = 15 * 60
+
+// Number of pixel identifiers of most hits served in stats.
+const statsTopPixels = 10
+
+// Statuses of tracking requests not counted as errors in stats.
+var statsSuccessStatuses = map[string]bool{"success": true, "prefetch": true, "not_modified": true, "unsigned": true}
+
+// Counters of tracking requests served in stats.
+var trackingStats requestStats
+
+// Counters of tracking requests: total, per second over rolling window, per
+// error status and per pixel identifier. Safe for concurrent use.
+type requestStats struct {
+	total atomic.Uint64
+
+	// Per second counters, of second since epoch in upper 32 bits and count
+	// in lower ones, updated together.
+	seconds [statsWindowSeconds]atomic.Uint64
+
+	errors sync.Map // status -> *atomic.Uint64
+	pixels sync.Map // pixel identifier label -> *atomic.Uint64
+}
+
+// Counts tracking request of given status at given time.
+func (s *requestStats) count(now time.Time, status string) {
+	s.total.Add(1)
+
+	sec := uint64(now.Unix())
+	counter := &s.seconds[sec%statsWindowSeconds]
+	for {
+		v := counter.Load()
+		next := sec<<32 | 1
+		if v>>32 == sec {
+			next = v + 1
+		}
+		if counter.CompareAndSwap(v, next) {
+			break
+		}
+	}
+
+	if !statsSuccessStatuses[status] {
+		countIn(&s.errors, status)
+	}
+}
+
+// Counts hit of pixel identifier label.
+func (s *requestStats) countPixel(label string) {
+	countIn(&s.pixels, label)
+}
+
+// Increments counter of key in map of counters.
+func countIn(m *sync.Map, key string) {
+	c, ok := m.Load(key)
+	if !ok {
+		c, _ = m.LoadOrStore(key, new(atomic.Uint64))
+	}
+	c.(*atomic.Uint64).Add(1)
+}
+
+// Returns number of tracking requests within given number of seconds before
+// given time, the current second included.
+func (s *requestStats) last(now time.Time, seconds int) uint64 {
+	sec := uint64(now.Unix())
+
+	var n uint64
+	for i := 0; i < seconds && i < statsWindowSeconds; i++ {
+		v := s.seconds[(sec-uint64(i))%statsWindowSeconds].Load()
+		if v>>32 == sec-uint64(i) {
+			n += v & 0xffffffff
+		}
+	}
+	return n
+}
+
+// Returns counts of counters of map.
+func countsOf(m *sync.Map) map[string]uint64 {
+	counts := map[string]uint64{}
+	m.Range(func(k, v any) bool {
+		counts[k.(string)] = v.(*atomic.Uint64).Load()
+		return true
+	})
+	return counts
+}
+
+// Pixel identifier with its hits, in stats.
+type pixelHits struct {
+	PixelID string `json:"pixel_id"`
+	Hits    uint64 `json:"hits"`
+}
+
+// Stats of service, as served.
+type serviceStats struct {
+	Requests struct {
+		Total   uint64 `json:"total"`
+		Last1m  uint64 `json:"last_1m"`
+		Last5m  uint64 `json:"last_5m"`
+		Last15m uint64 `json:"last_15m"`
+	} `json:"requests"`
+	Errors        map[string]uint64 `json:"errors"`
+	Healthy       bool              `json:"healthy"`
+	UptimeSeconds float64           `json:"uptime_seconds"`
+	TopPixels     []pixelHits       `json:"top_pixels"`
+}
+
+// Serves stats of tracking requests and service as JSON, indented with
+// pretty=1 query parameter.
+func serveStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		methodNotAllowed(w, r, "GET", "HEAD")
+		return
+	}
+
+	now := time.Now()
+
+	var stats serviceStats
+	stats.Requests.Total = trackingStats.total.Load()
+	stats.Requests.Last1m = trackingStats.last(now, 60)
+	stats.Requests.Last5m = trackingStats.last(now, 5*60)
+	stats.Requests.Last15m = trackingStats.last(now, 15*60)
+	stats.Errors = countsOf(&trackingStats.errors)
+	stats.Healthy = serviceHealthy()
+	stats.UptimeSeconds = now.Sub(startTime).Seconds()
+
+	stats.TopPixels = []pixelHits{}
+	for id, hits := range countsOf(&trackingStats.pixels) {
+		stats.TopPixels = append(stats.TopPixels, pixelHits{id, hits})
+	}
+	slices.SortFunc(stats.TopPixels, func(a, b pixelHits) int {
+		return cmp.Or(cmp.Compare(b.Hits, a.Hits), cmp.Compare(a.PixelID, b.PixelID))
+	})
+	stats.TopPixels = stats.TopPixels[:min(len(stats.TopPixels), statsTopPixels)]
+
+	writeJSON(w, r, http.StatusOK, stats)
+}
+
+// Writes value as JSON response of given status, indented with pretty=1 query
+// parameter.
+func writeJSON(w http.ResponseWriter, r *http.Request, status int, v any) {
+	var body []byte
+	var err error
+	if r.URL.Query().Get("pretty") == "1" {
+		body, err = json.MarshalIndent(v, "", "  ")
+	} else {
+		body, err = json.Marshal(v)
+	}
+	if err != nil {
+		http.Error(w, "Error 500 (Internal server error)", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if r.Method == "HEAD" {
+		return
+	}
+
+	if _, err := w.Write(append(body, '\n')); err != nil {
+		slog.DebugContext(r.Context(), "stats: Response not written", "path", r.URL.Path, "error", err)
+	}
+}
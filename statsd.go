@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Maximum size of StatsD packet, fitting in Ethernet MTU over UDP, and
+// interval of sending partially filled ones.
+const (
+	statsdMaxPacketSize = 1432
+	statsdFlushInterval = 100 * time.Millisecond
+)
+
+// StatsD client, nil when StatsD is disabled, in which case metrics are not
+// mirrored.
+var statsd *statsdClient
+
+// Client sending metrics to StatsD or DogStatsD, with tags in DogStatsD
+// format. Metrics are buffered up to configured number and sent in packets
+// by background goroutine, so that sending never blocks, metrics exceeding
+// buffer being dropped.
+type statsdClient struct {
+	prefix string
+	conn   net.Conn
+	lines  chan []byte
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// Initializes StatsD client for address like udp://host:8125 or
+// unixgram:///var/run/datadog/dsd.socket, when given.
+func initStatsD() error {
+	if *statsdAddress == "" {
+		return nil
+	}
+
+	network, addr, ok := strings.Cut(*statsdAddress, "://")
+	if !ok || (network != "udp" && network != "unixgram") {
+		return fmt.Errorf("invalid statsd address %q", *statsdAddress)
+	}
+
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return err
+	}
+
+	prefix := *statsdPrefix
+	if prefix != "" && !strings.HasSuffix(prefix, ".") {
+		prefix += "."
+	}
+
+	statsd = &statsdClient{prefix: prefix, conn: conn, lines: make(chan []byte, *statsdBufferSize), stop: make(chan struct{}), done: make(chan struct{})}
+	go statsd.run()
+
+	slog.Info("statsd: Sending metrics", "address", *statsdAddress, "prefix", *statsdPrefix)
+
+	return nil
+}
+
+// Counts value of named metric with tags of form name:value.
+func (c *statsdClient) count(name string, value int64, tags ...string) {
+	if c == nil {
+		return
+	}
+	c.send(name, strconv.FormatInt(value, 10), "c", tags)
+}
+
+// Records duration of named metric with tags of form name:value.
+func (c *statsdClient) timing(name string, d time.Duration, tags ...string) {
+	if c == nil {
+		return
+	}
+	c.send(name, strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', -1, 64), "ms", tags)
+}
+
+// Queues metric line, dropping it when buffer is full.
+func (c *statsdClient) send(name, value, kind string, tags []string) {
+	line := make([]byte, 0, 64)
+	line = append(line, c.prefix...)
+	line = append(line, name...)
+	line = append(line, ':')
+	line = append(line, value...)
+	line = append(line, '|')
+	line = append(line, kind...)
+	for i, tag := range tags {
+		if i == 0 {
+			line = append(line, "|#"...)
+		} else {
+			line = append(line, ',')
+		}
+		line = append(line, statsdTagReplacer.Replace(tag)...)
+	}
+
+	select {
+	case c.lines <- line:
+	default:
+		statsdDroppedMetrics.Inc()
+	}
+}
+
+// Replacer of characters not allowed in DogStatsD tags.
+var statsdTagReplacer = strings.NewReplacer("|", "_", ",", "_", "#", "_", "\n", "_")
+
+// Sends queued metric lines in packets of at most maximum size, sending
+// partially filled ones at flush interval, and all queued ones once stopped.
+func (c *statsdClient) run() {
+	ticker := time.NewTicker(statsdFlushInterval)
+	defer ticker.Stop()
+
+	packet := make([]byte, 0, statsdMaxPacketSize)
+
+	flush := func() {
+		if len(packet) == 0 {
+			return
+		}
+		if _, err := c.conn.Write(packet); err != nil {
+			statsdSendErrors.Inc()
+			slog.Debug("statsd: Metrics not sent", "address", *statsdAddress, "error", err)
+		}
+		packet = packet[:0]
+	}
+
+	add := func(line []byte) {
+		if len(packet) > 0 && len(packet)+1+len(line) > statsdMaxPacketSize {
+			flush()
+		}
+		if len(packet) > 0 {
+			packet = append(packet, '\n')
+		}
+		packet = append(packet, line...)
+	}
+
+	for {
+		select {
+		case line := <-c.lines:
+			add(line)
+		case <-ticker.C:
+			flush()
+		case <-c.stop:
+			for len(c.lines) > 0 {
+				add(<-c.lines)
+			}
+			flush()
+			close(c.done)
+			return
+		}
+	}
+}
+
+// Sends queued metric lines and closes connection to StatsD. Metrics sent
+// later are dropped once buffer is full. No-op when StatsD is disabled.
+func (c *statsdClient) close() error {
+	if c == nil {
+		return nil
+	}
+
+	close(c.stop)
+	<-c.done
+
+	return c.conn.Close()
+}
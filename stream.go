@@ -0,0 +1,174 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Number of events buffered per stream client, beyond which client is
+// dropped as too slow.
+const streamClientBuffer = 256
+
+// Interval of keepalive comments of event streams.
+const streamKeepaliveInterval = 15 * time.Second
+
+// Broadcaster of events to stream clients, nil when event stream is disabled.
+var eventStream *eventBroadcaster
+
+// Event sink broadcasting events to clients of event stream, never blocking:
+// clients whose buffers are full are dropped.
+type eventBroadcaster struct {
+	mu      sync.RWMutex
+	clients map[*streamClient]struct{}
+	count   atomic.Int64
+	done    chan struct{}
+	stop    sync.Once
+}
+
+// Client of event stream, of events of given pixel only, when given.
+type streamClient struct {
+	pixel   string
+	events  chan *event
+	dropped chan struct{}
+	drop    sync.Once
+}
+
+// Initializes event stream, broadcasting events as an event sink, when
+// enabled.
+func initEventStream() {
+	if !*enableEventStream {
+		return
+	}
+
+	eventStream = &eventBroadcaster{clients: map[*streamClient]struct{}{}, done: make(chan struct{})}
+	eventSinks = append(eventSinks, eventStream)
+}
+
+// Sends event to clients subscribed to it, dropping clients that are behind.
+func (b *eventBroadcaster) Write(_ context.Context, e *event) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for c := range b.clients {
+		if c.pixel != "" && c.pixel != e.PixelID {
+			continue
+		}
+		select {
+		case c.events <- e:
+		default:
+			c.drop.Do(func() {
+				streamDroppedClients.Inc()
+				close(c.dropped)
+			})
+		}
+	}
+	return nil
+}
+
+// Flushes nothing, as events are sent right away.
+func (b *eventBroadcaster) Flush(context.Context) error { return nil }
+
+// Ends streams of all clients.
+func (b *eventBroadcaster) Close(context.Context) error {
+	b.stop.Do(func() { close(b.done) })
+	return nil
+}
+
+// Subscribes client to events of given pixel, or of all when not given,
+// unless maximum number of clients is reached.
+func (b *eventBroadcaster) subscribe(pixel string) (*streamClient, bool) {
+	if b.count.Add(1) > int64(*eventStreamMaxClients) {
+		b.count.Add(-1)
+		return nil, false
+	}
+
+	c := &streamClient{pixel: pixel, events: make(chan *event, streamClientBuffer), dropped: make(chan struct{})}
+
+	b.mu.Lock()
+	b.clients[c] = struct{}{}
+	b.mu.Unlock()
+
+	streamClients.Inc()
+	return c, true
+}
+
+// Unsubscribes client.
+func (b *eventBroadcaster) unsubscribe(c *streamClient) {
+	b.mu.Lock()
+	delete(b.clients, c)
+	b.mu.Unlock()
+
+	b.count.Add(-1)
+	streamClients.Dec()
+}
+
+// Ends streams of all clients, on shutdown of servers, so that they do not
+// hold it up.
+func stopEventStream() {
+	if eventStream != nil {
+		eventStream.Close(context.Background())
+	}
+}
+
+// Serves stream of tracking events as server-sent events, of given pixel
+// only with pixel query parameter, until client disconnects or is dropped
+// for falling behind.
+func serveEventStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		methodNotAllowed(w, r, "GET")
+		return
+	}
+
+	c, ok := eventStream.subscribe(r.URL.Query().Get("pixel"))
+	if !ok {
+		http.Error(w, "Error 503 (Too many stream clients)", http.StatusServiceUnavailable)
+		return
+	}
+	defer eventStream.unsubscribe(c)
+
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	keepalive := time.NewTicker(streamKeepaliveInterval)
+	defer keepalive.Stop()
+
+	for {
+		var msg []byte
+
+		select {
+		case e := <-c.events:
+			msg = append(msg, "event: "...)
+			msg = append(msg, cmp.Or(e.Type, trackingEventType)...)
+			msg = append(msg, "\ndata: "...)
+			msg = append(msg, e.line...)
+			msg = append(msg, "\n\n"...)
+		case <-keepalive.C:
+			msg = []byte(": keepalive\n\n")
+		case <-c.dropped:
+			return
+		case <-eventStream.done:
+			return
+		case <-r.Context().Done():
+			return
+		}
+
+		if _, err := w.Write(msg); err != nil {
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"log/syslog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Minimum interval between attempts to connect to syslog.
+const syslogRedialInterval = 5 * time.Second
+
+// Log writer sending lines to syslog, reconnecting on write failure. While
+// disconnected lines go to stderr and are counted as dropped.
+type syslogWriter struct {
+	name    string
+	network string
+	addr    string
+	tag     string
+
+	mu       sync.Mutex
+	writer   *syslog.Writer
+	lastDial time.Time
+}
+
+// Creates syslog writer of named log for address like udp://host:514,
+// tcp://host:514 or unixgram:///dev/log. Connection failure is not an error,
+// writer keeps trying to connect.
+func newSyslogWriter(name, address, tag string) (*syslogWriter, error) {
+	network, addr, ok := strings.Cut(address, "://")
+	if !ok || (network != "udp" && network != "tcp" && network != "unixgram") {
+		return nil, fmt.Errorf("log: invalid syslog address %q", address)
+	}
+
+	w := &syslogWriter{name: name, network: network, addr: addr, tag: tag}
+	w.dial()
+
+	logFilesMu.Lock()
+	logWriters = append(logWriters, w)
+	logFilesMu.Unlock()
+
+	return w, nil
+}
+
+// Connects to syslog, when not connected.
+func (w *syslogWriter) dial() {
+	w.lastDial = time.Now()
+
+	writer, err := syslog.Dial(w.network, w.addr, syslog.LOG_INFO|syslog.LOG_USER, w.tag)
+	if err != nil {
+		slog.Warn("log: Syslog not connected", "address", w.network+"://"+w.addr, "error", err)
+		return
+	}
+	w.writer = writer
+}
+
+// Writes lines to syslog, one message per line, or to stderr while
+// disconnected.
+func (w *syslogWriter) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, line := range bytes.SplitAfter(b, []byte("\n")) {
+		if len(line) > 0 {
+			w.writeLine(line)
+		}
+	}
+
+	return len(b), nil
+}
+
+// Writes single line to syslog, or to stderr while disconnected.
+func (w *syslogWriter) writeLine(line []byte) {
+	if w.writer == nil && time.Since(w.lastDial) >= syslogRedialInterval {
+		w.dial()
+	}
+
+	if w.writer != nil {
+		if _, err := w.writer.Write(line); err == nil {
+			return
+		}
+		w.writer.Close()
+		w.writer = nil
+	}
+
+	syslogDroppedLines.WithLabelValues(w.name).Inc()
+	os.Stderr.Write(line)
+}
+
+// Closes connection to syslog.
+func (w *syslogWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.writer == nil {
+		return nil
+	}
+	err := w.writer.Close()
+	w.writer = nil
+	return err
+}
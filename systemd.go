@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/coreos/go-systemd/v22/daemon"
+)
+
+// Notifies systemd that service is ready, i.e. servers are listening, and when
+// started by upgrade that it is the main process now. No-op when not running as
+// systemd notify type service.
+func notifySystemdReady() {
+	if upgraded() {
+		notifySystemd(fmt.Sprintf("MAINPID=%d\n%s", os.Getpid(), daemon.SdNotifyReady))
+		return
+	}
+	notifySystemd(daemon.SdNotifyReady)
+}
+
+// Notifies systemd that service is stopping.
+func notifySystemdStopping() {
+	notifySystemd(daemon.SdNotifyStopping)
+}
+
+// Sends state to systemd via NOTIFY_SOCKET, logging failures.
+func notifySystemd(state string) {
+	if _, err := daemon.SdNotify(false, state); err != nil {
+		slog.Warn("systemd: Notification not sent", "state", state, "error", err)
+	}
+}
+
+// Starts pinging systemd watchdog at half the interval from WATCHDOG_USEC, but
+// only while service is healthy, so that eventually systemd restarts unhealthy
+// service. No-op when watchdog is not enabled.
+func startSystemdWatchdog() {
+	interval, err := daemon.SdWatchdogEnabled(false)
+	if err != nil {
+		slog.Warn("systemd: Watchdog not enabled", "error", err)
+		return
+	}
+
+	if interval == 0 {
+		return
+	}
+
+	go func() {
+		for range time.Tick(interval / 2) {
+			if serviceHealthy() {
+				notifySystemd(daemon.SdNotifyWatchdog)
+			}
+		}
+	}()
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"cmp"
+	"container/heap"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Number of epochs of sliding window of top values, rotated in turn.
+const topEpochs = 4
+
+// Maximum length of values counted in top values, longer ones truncated.
+const maxTopValueLength = 256
+
+// Fields of tracking requests of which top values are counted.
+var topFields = map[string]*topValues{}
+
+// Initializes counting of top referer domains, user agents and pixel
+// identifiers of tracking requests, over configured window.
+func initTopValues() error {
+	if *topWindow < topEpochs*time.Second {
+		return fmt.Errorf("top window %v below %v", *topWindow, topEpochs*time.Second)
+	}
+	if *topCapacity <= 0 {
+		return fmt.Errorf("top capacity %d not positive", *topCapacity)
+	}
+
+	for _, field := range []string{"referer", "user_agent", "pixel_id"} {
+		topFields[field] = newTopValues(*topWindow, *topCapacity)
+	}
+
+	return nil
+}
+
+// Counts top values of tracking request.
+func countTopValues(r *http.Request) {
+	if len(topFields) == 0 {
+		return
+	}
+
+	if referer := r.Referer(); referer != "" {
+		if u, err := url.Parse(referer); err == nil && u.Hostname() != "" {
+			topFields["referer"].count(time.Now(), strings.ToLower(u.Hostname()))
+		}
+	}
+	if ua := r.UserAgent(); ua != "" {
+		topFields["user_agent"].count(time.Now(), ua)
+	}
+	if id := mux.Vars(r)["pixel_id"]; id != "" {
+		topFields["pixel_id"].count(time.Now(), id)
+	}
+}
+
+// Most frequent values over sliding window, of window split in epochs each
+// counted by its own space-saving sketch of bounded capacity. Counts are
+// overestimated by at most their error. Safe for concurrent use.
+type topValues struct {
+	epoch    time.Duration
+	capacity int
+
+	mu      sync.Mutex
+	current int
+	started time.Time
+	epochs  [topEpochs]*spaceSaving
+}
+
+// Creates top values over window, of sketches of given capacity.
+func newTopValues(window time.Duration, capacity int) *topValues {
+	t := &topValues{epoch: window / topEpochs, capacity: capacity, started: time.Now()}
+	for i := range t.epochs {
+		t.epochs[i] = newSpaceSaving(capacity)
+	}
+	return t
+}
+
+// Rotates epochs past at given time, dropping their counts.
+func (t *topValues) rotate(now time.Time) {
+	for i := 0; i < topEpochs && now.Sub(t.started) >= t.epoch; i++ {
+		t.current = (t.current + 1) % topEpochs
+		t.epochs[t.current] = newSpaceSaving(t.capacity)
+		t.started = t.started.Add(t.epoch)
+	}
+	if now.Sub(t.started) >= t.epoch {
+		t.started = now
+	}
+}
+
+// Counts value at given time.
+func (t *topValues) count(now time.Time, value string) {
+	if len(value) > maxTopValueLength {
+		value = value[:maxTopValueLength]
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.rotate(now)
+	t.epochs[t.current].add(value)
+}
+
+// Value with its estimated count and maximum overestimation of it.
+type topValue struct {
+	Value string `json:"value"`
+	Count uint64 `json:"count"`
+	Error uint64 `json:"error"`
+}
+
+// Returns at most n most frequent values over window before given time.
+func (t *topValues) top(now time.Time, n int) []topValue {
+	t.mu.Lock()
+	merged := map[string]topValue{}
+	t.rotate(now)
+	for _, s := range t.epochs {
+		for _, e := range s.entries {
+			v := merged[e.value]
+			v.Value, v.Count, v.Error = e.value, v.Count+e.count, v.Error+e.error
+			merged[e.value] = v
+		}
+	}
+	t.mu.Unlock()
+
+	values := make([]topValue, 0, len(merged))
+	for _, v := range merged {
+		values = append(values, v)
+	}
+	slices.SortFunc(values, func(a, b topValue) int {
+		return cmp.Or(cmp.Compare(b.Count, a.Count), cmp.Compare(a.Value, b.Value))
+	})
+
+	return values[:min(len(values), n)]
+}
+
+// Space-saving sketch of most frequent values, of at most capacity entries,
+// ordered in min-heap by count. New values replace least frequent one when
+// sketch is full, inheriting its count as their error.
+type spaceSaving struct {
+	capacity int
+	entries  []*topEntry
+	index    map[string]*topEntry
+}
+
+// Entry of space-saving sketch.
+type topEntry struct {
+	value string
+	count uint64
+	error uint64
+	heap  int
+}
+
+// Creates space-saving sketch of given capacity.
+func newSpaceSaving(capacity int) *spaceSaving {
+	return &spaceSaving{capacity: capacity, index: make(map[string]*topEntry, capacity)}
+}
+
+// Counts value.
+func (s *spaceSaving) add(value string) {
+	if e, ok := s.index[value]; ok {
+		e.count++
+		heap.Fix(s, e.heap)
+		return
+	}
+
+	if len(s.entries) < s.capacity {
+		e := &topEntry{value: value, count: 1}
+		s.index[value] = e
+		heap.Push(s, e)
+		return
+	}
+
+	e := s.entries[0]
+	delete(s.index, e.value)
+	e.value, e.error, e.count = value, e.count, e.count+1
+	s.index[value] = e
+	heap.Fix(s, 0)
+}
+
+func (s *spaceSaving) Len() int           { return len(s.entries) }
+func (s *spaceSaving) Less(i, j int) bool { return s.entries[i].count < s.entries[j].count }
+
+func (s *spaceSaving) Swap(i, j int) {
+	s.entries[i], s.entries[j] = s.entries[j], s.entries[i]
+	s.entries[i].heap, s.entries[j].heap = i, j
+}
+
+func (s *spaceSaving) Push(x any) {
+	e := x.(*topEntry)
+	e.heap = len(s.entries)
+	s.entries = append(s.entries, e)
+}
+
+func (s *spaceSaving) Pop() any {
+	e := s.entries[len(s.entries)-1]
+	s.entries = s.entries[:len(s.entries)-1]
+	return e
+}
+
+// Serves most frequent values of field given by field query parameter:
+// referer domains, user agents or pixel identifiers of tracking requests over
+// window, at most n of them, 10 by default.
+func serveTopValues(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		methodNotAllowed(w, r, "GET", "HEAD")
+		return
+	}
+
+	field := r.URL.Query().Get("field")
+	values, ok := topFields[field]
+	if !ok {
+		http.Error(w, "Error 400 (Unknown field)", http.StatusBadRequest)
+		return
+	}
+
+	n := 10
+	if s := r.URL.Query().Get("n"); s != "" {
+		var err error
+		if n, err = strconv.Atoi(s); err != nil || n <= 0 {
+			http.Error(w, "Error 400 (Invalid n)", http.StatusBadRequest)
+			return
+		}
+	}
+
+	writeJSON(w, r, http.StatusOK, struct {
+		Field         string     `json:"field"`
+		WindowSeconds float64    `json:"window_seconds"`
+		Top           []topValue `json:"top"`
+	}{field, topWindow.Seconds(), values.top(time.Now(), n)})
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Tracer of spans of service, no-op unless tracing is enabled.
+var tracer = otel.Tracer("serve-and-track")
+
+// Tracer provider, nil when tracing is disabled.
+var tracerProvider *sdktrace.TracerProvider
+
+// Initializes tracing exporting spans to OTLP endpoint like grpc://host:4317,
+// grpcs://host:4317 or http(s)://host:4318, when given. Spans are sampled at
+// configured ratio, unless their parent, propagated as W3C trace context, is
+// sampled already.
+func initTracing() error {
+	if *otlpEndpoint == "" {
+		return nil
+	}
+
+	if *traceSampleRatio < 0 || *traceSampleRatio > 1 {
+		return fmt.Errorf("trace sample ratio %v out of range [0, 1]", *traceSampleRatio)
+	}
+
+	u, err := url.Parse(*otlpEndpoint)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	var exporter sdktrace.SpanExporter
+	switch u.Scheme {
+	case "grpc", "grpcs":
+		options := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(u.Host)}
+		if u.Scheme == "grpc" {
+			options = append(options, otlptracegrpc.WithInsecure())
+		}
+		exporter, err = otlptracegrpc.New(ctx, options...)
+	case "http", "https":
+		if u.Path == "" {
+			u.Path = "/v1/traces"
+		}
+		exporter, err = otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(u.String()))
+	default:
+		return fmt.Errorf("invalid otlp endpoint %q", *otlpEndpoint)
+	}
+	if err != nil {
+		return err
+	}
+
+	tracerProvider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(*traceSampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(
+			semconv.ServiceName("serve-and-track"),
+			semconv.ServiceVersion(version),
+		)),
+	)
+
+	otel.SetTracerProvider(tracerProvider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	return nil
+}
+
+// Exports spans ended and stops tracing, within context deadline.
+func stopTracing(ctx context.Context) {
+	if tracerProvider == nil {
+		return
+	}
+
+	if err := tracerProvider.Shutdown(ctx); err != nil {
+		slog.Warn("trace: Spans not exported", "error", err)
+	}
+}
+
+// Wraps handler with server spans of requests, continuing traces of W3C trace
+// context of requests. Spans are named after method, and after handler by
+// instrumentation of routes. No-op unless tracing is enabled.
+func traceRequests(next http.Handler) http.Handler {
+	if tracerProvider == nil {
+		return next
+	}
+
+	return otelhttp.NewHandler(next, "http",
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string { return r.Method }))
+}
+
+// Returns trace identifier of request of given context, empty when it is not
+// traced.
+func traceID(ctx context.Context) string {
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		return sc.TraceID().String()
+	}
+	return ""
+}
+
+// Wraps delivery of batches of events to named sink with spans, children of
+// span of request of first event of batch, linked to spans of other ones.
+func tracedDelivery(sink string, deliver func(ctx context.Context, batch []queuedEvent) ([]queuedEvent, error)) func(ctx context.Context, batch []queuedEvent) ([]queuedEvent, error) {
+	if tracerProvider == nil {
+		return deliver
+	}
+
+	return func(ctx context.Context, batch []queuedEvent) ([]queuedEvent, error) {
+		var parent trace.SpanContext
+		var links []trace.Link
+		for _, e := range batch {
+			if sc := e.event.spanContext; sc.IsValid() {
+				if !parent.IsValid() {
+					parent = sc
+				} else {
+					links = append(links, trace.Link{SpanContext: sc})
+				}
+			}
+		}
+		if parent.IsValid() {
+			ctx = trace.ContextWithSpanContext(ctx, parent)
+		}
+
+		ctx, span := tracer.Start(ctx, sink+" deliver",
+			trace.WithSpanKind(trace.SpanKindProducer),
+			trace.WithLinks(links...),
+			trace.WithAttributes(attribute.String("sink", sink), attribute.Int("events", len(batch))))
+		defer span.End()
+
+		failed, err := deliver(ctx, batch)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			span.SetAttributes(attribute.Int("events_failed", len(failed)))
+		}
+
+		return failed, err
+	}
+}
@@ -0,0 +1 @@
+!function(w,d){var e="%ENDPOINT%",p="%PIXEL_ID%";(new Image).src=e+(p?"/"+encodeURIComponent(p):"")+"?url="+encodeURIComponent(d.location.href)+"&ref="+encodeURIComponent(d.referrer)+"&n="+Math.random().toString(36).slice(2)}(window,document);
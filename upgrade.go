@@ -0,0 +1,186 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Environment variables via which listening sockets and readiness pipe are
+// passed to the new process on upgrade.
+const (
+	upgradeListenFDsEnv = "SERVE_AND_TRACK_LISTEN_FDS"
+	upgradeReadyFDEnv   = "SERVE_AND_TRACK_READY_FD"
+)
+
+// Listening sockets of servers by address, handed over to the new process on
+// upgrade.
+var (
+	serverListenersMu sync.Mutex
+	serverListeners   = make(map[string]net.Listener)
+)
+
+// Records listening socket of server at given address.
+func registerListener(addr string, l net.Listener) {
+	serverListenersMu.Lock()
+	defer serverListenersMu.Unlock()
+
+	serverListeners[addr] = l
+}
+
+// Returns listening socket of given address inherited from the previous process
+// on upgrade, nil when there is none. Inherited Unix domain sockets remove their
+// socket file when closed, as ones created by this process do.
+func inheritedListener(addr string) (net.Listener, error) {
+	for _, entry := range strings.Split(os.Getenv(upgradeListenFDsEnv), ";") {
+		entryAddr, fd, ok := strings.Cut(entry, "=")
+		if !ok || entryAddr != addr {
+			continue
+		}
+
+		n, err := strconv.Atoi(fd)
+		if err != nil {
+			return nil, fmt.Errorf("upgrade: invalid fd of %s: %q", addr, fd)
+		}
+
+		f := os.NewFile(uintptr(n), addr)
+		defer f.Close()
+
+		listener, err := net.FileListener(f)
+		if ul, ok := listener.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(true)
+		}
+		return listener, err
+	}
+
+	return nil, nil
+}
+
+// Checks whether process has been started by upgrade of the previous one.
+func upgraded() bool {
+	return os.Getenv(upgradeReadyFDEnv) != ""
+}
+
+// Notifies the previous process that servers of this one are ready, so that it
+// can stop. No-op when not started by upgrade.
+func notifyUpgradeReady() {
+	fd, err := strconv.Atoi(os.Getenv(upgradeReadyFDEnv))
+	if err != nil {
+		return
+	}
+
+	f := os.NewFile(uintptr(fd), "ready")
+	if _, err := f.Write([]byte{1}); err != nil {
+		slog.Warn("upgrade: Readiness not notified", "error", err)
+	}
+	f.Close()
+
+	os.Unsetenv(upgradeListenFDsEnv)
+	os.Unsetenv(upgradeReadyFDEnv)
+}
+
+// Upgrades the process: starts the current binary with listening sockets passed
+// over and waits for it to be ready. On error the new process is killed and the
+// current one keeps serving; on success the current one is to stop.
+func upgrade() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	ready, readyWriter, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer ready.Close()
+
+	files, fds, err := listenerFiles()
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	if err != nil {
+		readyWriter.Close()
+		return err
+	}
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append(files, readyWriter)
+	cmd.Env = append(os.Environ(),
+		upgradeListenFDsEnv+"="+fds,
+		upgradeReadyFDEnv+"="+strconv.Itoa(3+len(files)))
+
+	err = cmd.Start()
+	readyWriter.Close()
+	if err != nil {
+		return err
+	}
+
+	slog.Info("upgrade: Process started", "pid", cmd.Process.Pid)
+
+	if err := ready.SetReadDeadline(time.Now().Add(*upgradeTimeout)); err != nil {
+		slog.Warn("upgrade: Readiness timeout not set", "error", err)
+	}
+
+	if _, err := ready.Read(make([]byte, 1)); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return fmt.Errorf("upgrade: process %d not ready: %w", cmd.Process.Pid, err)
+	}
+
+	// Sockets are now shared with the new process, which must keep them.
+	serverListenersMu.Lock()
+	for _, l := range serverListeners {
+		if ul, ok := l.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+	serverListenersMu.Unlock()
+
+	slog.Info("upgrade: Process ready", "pid", cmd.Process.Pid)
+	return nil
+}
+
+// Returns files of listening sockets, to be passed to the new process starting
+// from fd 3, along with their address to fd mapping.
+func listenerFiles() ([]*os.File, string, error) {
+	serverListenersMu.Lock()
+	defer serverListenersMu.Unlock()
+
+	addrs := make([]string, 0, len(serverListeners))
+	for addr := range serverListeners {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+
+	var files []*os.File
+	var fds []string
+
+	for _, addr := range addrs {
+		l, ok := serverListeners[addr].(interface{ File() (*os.File, error) })
+		if !ok {
+			return files, "", errors.New("upgrade: listener of " + addr + " cannot be passed over")
+		}
+
+		f, err := l.File()
+		if err != nil {
+			return files, "", err
+		}
+
+		fds = append(fds, addr+"="+strconv.Itoa(3+len(files)))
+		files = append(files, f)
+	}
+
+	return files, strings.Join(fds, ";"), nil
+}
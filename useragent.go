@@ -0,0 +1,117 @@
+package main
+
+import (
+	"strings"
+	"sync"
+)
+
+// Maximum number of classified user agents cached.
+const userAgentCacheSize = 10000
+
+// Class of device and family of browser of user agent, other when not
+// recognized.
+type userAgentClass struct {
+	device  string
+	browser string
+}
+
+// Substrings of user agents of crawlers and other automated clients.
+var botUserAgents = []string{
+	"bot", "crawl", "spider", "slurp", "curl/", "wget/", "python-", "go-http-client", "java/",
+	"headless", "facebookexternalhit", "preview", "monitor", "googleimageproxy",
+}
+
+// Browser families, by substring of user agent, in order of precedence: more
+// specific ones first, as user agents claim compatibility with others.
+var browserUserAgents = []struct {
+	substring string
+	family    string
+}{
+	{"edg", "edge"},
+	{"opr/", "opera"},
+	{"opera", "opera"},
+	{"samsungbrowser", "samsung"},
+	{"firefox/", "firefox"},
+	{"fxios", "firefox"},
+	{"crios", "chrome"},
+	{"chrome/", "chrome"},
+	{"chromium", "chrome"},
+	{"msie", "ie"},
+	{"trident/", "ie"},
+	{"safari/", "safari"},
+}
+
+// Classified user agents, cached in two generations, the current one being
+// rotated when full, so that frequent user agents stay and memory use is
+// bounded.
+var userAgentCache = struct {
+	sync.Mutex
+	current  map[string]userAgentClass
+	previous map[string]userAgentClass
+}{
+	current: map[string]userAgentClass{},
+}
+
+// Returns class of user agent, cached.
+func classifyUserAgent(ua string) userAgentClass {
+	c := &userAgentCache
+
+	c.Lock()
+	class, ok := c.current[ua]
+	if !ok {
+		if class, ok = c.previous[ua]; ok {
+			c.current[ua] = class
+		}
+	}
+	c.Unlock()
+
+	if ok {
+		return class
+	}
+
+	class = parseUserAgent(ua)
+
+	c.Lock()
+	if len(c.current) >= userAgentCacheSize/2 {
+		c.previous, c.current = c.current, make(map[string]userAgentClass, len(c.current))
+	}
+	c.current[ua] = class
+	c.Unlock()
+
+	return class
+}
+
+// Classifies user agent by device class: bot, tablet, mobile or desktop, and
+// browser family, other when not recognized.
+func parseUserAgent(ua string) userAgentClass {
+	ua = strings.ToLower(ua)
+	class := userAgentClass{device: "other", browser: "other"}
+
+	for _, s := range botUserAgents {
+		if strings.Contains(ua, s) {
+			class.device = "bot"
+			return class
+		}
+	}
+
+	switch {
+	case strings.Contains(ua, "ipad") || strings.Contains(ua, "tablet") || strings.Contains(ua, "kindle") ||
+		strings.Contains(ua, "silk/") || strings.Contains(ua, "android") && !strings.Contains(ua, "mobile"):
+		class.device = "tablet"
+	case strings.Contains(ua, "mobi") || strings.Contains(ua, "iphone") || strings.Contains(ua, "ipod") ||
+		strings.Contains(ua, "android") || strings.Contains(ua, "windows phone"):
+		class.device = "mobile"
+	case strings.Contains(ua, "windows nt") || strings.Contains(ua, "macintosh") || strings.Contains(ua, "x11") ||
+		strings.Contains(ua, "cros ") || strings.Contains(ua, "linux"):
+		class.device = "desktop"
+	}
+
+	for _, b := range browserUserAgents {
+		if strings.Contains(ua, b.substring) {
+			class.browser = b.family
+			break
+		}
+	}
+
+	return class
+}
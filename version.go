@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"runtime/debug"
+)
+
+// Build information, set at build time, e.g.:
+//
+//	go build -ldflags "-X main.version=1.2.3 -X main.commit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%FT%TZ)"
+//
+// Commit defaults to VCS revision recorded by go build, when available.
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = "unknown"
+)
+
+func init() {
+	if commit != "" {
+		return
+	}
+	commit = "unknown"
+
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			if s.Key == "vcs.revision" {
+				commit = s.Value
+			}
+		}
+	}
+}
+
+// Returns build information, as printed by --version.
+func versionString() string {
+	return "serve-and-track " + version + " (commit " + commit + ", built " + buildDate + ", " + runtime.Version() + ")"
+}
+
+// Wraps handler with Server header of service name and version on every
+// response. No-op unless enabled.
+func serverHeader(next http.Handler) http.Handler {
+	if !*serverHeaderEnabled {
+		return next
+	}
+
+	value := "serve-and-track/" + version
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", value)
+		next.ServeHTTP(w, r)
+	})
+}
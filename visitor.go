@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+)
+
+// Size in bytes of random visitor identifiers.
+const visitorIDSize = 16
+
+// SameSite attributes of visitor cookie, by name.
+var visitorCookieSameSites = map[string]http.SameSite{
+	"lax":    http.SameSiteLaxMode,
+	"strict": http.SameSiteStrictMode,
+	"none":   http.SameSiteNoneMode,
+}
+
+// Checks visitor and opt-out cookie configuration: cookies of SameSite none
+// are accepted by browsers only when secure.
+func initCookies() error {
+	if *visitorCookieName != "" && *visitorCookieSameSite == "none" && !*visitorCookieSecure {
+		return errors.New("visitor cookie of SameSite none not secure")
+	}
+	if *optOutURLPath != "" && *optOutCookieSameSite == "none" && !*optOutCookieSecure {
+		return errors.New("opt-out cookie of SameSite none not secure")
+	}
+	return nil
+}
+
+// Returns visitor identifier of visitor cookie of request, when valid, a
+// random one otherwise, set as visitor cookie of response. Empty when
+// visitor cookie is not enabled, or when client asks not to be tracked and
+// visitor cookie is disabled then, or do not track is respected, or when
+// client opted out.
+func visitorCookie(w http.ResponseWriter, r *http.Request) string {
+	if *visitorCookieName == "" {
+		return ""
+	}
+	if (*visitorCookieDisableOnDNT || *respectDNT) && doNotTrack(r) || optedOut(r) {
+		return ""
+	}
+
+	if c, err := r.Cookie(*visitorCookieName); err == nil && validVisitorID(c.Value) {
+		return c.Value
+	}
+
+	b := make([]byte, visitorIDSize)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	id := hex.EncodeToString(b)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     *visitorCookieName,
+		Value:    id,
+		Path:     "/",
+		Domain:   *visitorCookieDomain,
+		MaxAge:   int(visitorCookieMaxAge.Seconds()),
+		Secure:   *visitorCookieSecure,
+		HttpOnly: true,
+		SameSite: visitorCookieSameSites[*visitorCookieSameSite],
+	})
+
+	return id
+}
+
+// Checks whether visitor identifier is one generated: hex encoded random
+// bytes.
+func validVisitorID(id string) bool {
+	if len(id) != 2*visitorIDSize {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Backoff of webhook retries: the first one and the maximum one.
+const (
+	webhookMinBackoff = 500 * time.Millisecond
+	webhookMaxBackoff = 30 * time.Second
+)
+
+// Creates webhook sink posting batches of events as JSON arrays to
+// configured URL, by capped number of concurrent workers. Failed posts are
+// retried with exponential backoff and jitter, unless failed permanently.
+func newWebhookSink() (eventSink, error) {
+	if *webhookURL == "" {
+		return nil, errors.New("webhook url not given")
+	}
+
+	var authName, authValue string
+	if *webhookAuthHeader != "" {
+		name, value, ok := strings.Cut(*webhookAuthHeader, ":")
+		if !ok {
+			return nil, fmt.Errorf("webhook auth header %q not in name: value form", *webhookAuthHeader)
+		}
+		authName, authValue = strings.TrimSpace(name), strings.TrimSpace(value)
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	post := func(ctx context.Context, body []byte) error {
+		req, err := http.NewRequestWithContext(ctx, "POST", *webhookURL, bytes.NewReader(body))
+		if err != nil {
+			return &permanentError{err}
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", "serve-and-track")
+		if authName != "" {
+			req.Header.Set(authName, authValue)
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		switch {
+		case resp.StatusCode >= 200 && resp.StatusCode < 300:
+			return nil
+		case resp.StatusCode >= 400 && resp.StatusCode < 500:
+			return &permanentError{fmt.Errorf("webhook response status %d", resp.StatusCode)}
+		default:
+			return fmt.Errorf("webhook response status %d", resp.StatusCode)
+		}
+	}
+
+	settings := queueSettings{
+		batchSize:     *webhookBatchSize,
+		flushInterval: *webhookFlushInterval,
+		workers:       *webhookConcurrency,
+		overflow:      *sinkOverflow,
+	}
+
+	q, err := newEventQueue("webhook", settings, tracedDelivery("webhook", func(ctx context.Context, batch []queuedEvent) ([]queuedEvent, error) {
+		body := []byte{'['}
+		for i, e := range batch {
+			if i > 0 {
+				body = append(body, ',')
+			}
+			body = append(body, e.line...)
+		}
+		body = append(body, ']')
+
+		backoff := webhookMinBackoff
+
+		for attempt := 0; ; attempt++ {
+			err := post(ctx, body)
+			if err == nil {
+				return nil, nil
+			}
+
+			var permanent *permanentError
+			if errors.As(err, &permanent) || attempt == *webhookMaxRetries {
+				return batch, err
+			}
+
+			sinkRetries.WithLabelValues("webhook").Inc()
+
+			select {
+			case <-time.After(rand.N(backoff) + backoff/2):
+			case <-ctx.Done():
+				return batch, ctx.Err()
+			}
+			backoff = min(2*backoff, webhookMaxBackoff)
+		}
+	}), func() error {
+		client.CloseIdleConnections()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	slog.Info("webhook: Posting events", "url", *webhookURL, "batch_size", *webhookBatchSize, "concurrency", *webhookConcurrency)
+
+	return q, nil
+}